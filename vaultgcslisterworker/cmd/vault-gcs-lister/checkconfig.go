@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/config"
+)
+
+// checkConfigCommand validates the config and the TLS files without
+// contacting Vault
+func checkConfigCommand(args []string) int {
+	flagSet := flag.NewFlagSet("check-config", flag.ExitOnError)
+	argsConfig := bindArgsConfig(flagSet)
+	flagSet.Parse(args)
+
+	errs := argsConfig.Validate()
+	if err := checkTLSFiles(argsConfig.TLSConf); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "invalid config: %s\n", err)
+		}
+		return 1
+	}
+
+	for _, target := range argsConfig.GetTargets() {
+		fmt.Printf(
+			"target %s: secrets path %s, project %s, %d sinks\n",
+			target.ID,
+			target.SecretsPath,
+			target.ProjectID,
+			len(target.SinkConfs),
+		)
+	}
+	fmt.Println("config valid")
+	return 0
+}
+
+// checkTLSFiles makes sure the TLS files exist, the cert matches the key, and
+// the CA cert is parseable
+func checkTLSFiles(tlsConf *config.TLSConfig) error {
+	if err := validateTLSConfig(tlsConf); err != nil {
+		return err
+	}
+
+	keyPair, err := tls.LoadX509KeyPair(tlsConf.CertPath, tlsConf.KeyPath)
+	if err != nil {
+		return errors.Wrap(err, "invalid cert and key pair")
+	}
+
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return errors.Wrap(err, "invalid cert")
+	}
+
+	if time.Now().After(cert.NotAfter) {
+		return errors.Errorf("cert expired at %s", cert.NotAfter.Format(time.RFC3339))
+	}
+
+	caCertBytes, err := ioutil.ReadFile(tlsConf.CACertPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to read CA cert")
+	}
+
+	if !x509.NewCertPool().AppendCertsFromPEM(caCertBytes) {
+		return errors.New("invalid CA cert, no PEM certificate found")
+	}
+
+	return nil
+}
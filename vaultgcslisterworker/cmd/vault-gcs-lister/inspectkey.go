@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/config"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/log"
+	"github.com/mikeadityas/vault-gcs-lister/pkg/leasechain"
+)
+
+type keyReport struct {
+	TargetID    string             `json:"target_id"`
+	SecretsPath string             `json:"secrets_path"`
+	LeaseID     string             `json:"lease_id"`
+	TTL         int                `json:"ttl_seconds"`
+	Key         leasechain.KeyInfo `json:"key"`
+	Revoked     bool               `json:"revoked"`
+}
+
+// inspectKeyCommand fetches a key of a target and prints its non-secret
+// metadata
+func inspectKeyCommand(args []string) int {
+	flagSet := flag.NewFlagSet("inspect-key", flag.ExitOnError)
+	argsConfig := bindArgsConfig(flagSet)
+	targetID := flagSet.String("target", "", "ID of the target to fetch the key of, defaults to the first target")
+	revoke := flagSet.Bool("revoke", false, "Revoke the fetched GCP lease before exiting")
+	flagSet.Parse(args)
+
+	initLogger(argsConfig.LogConf)
+
+	target := findTarget(argsConfig, *targetID)
+	if target == nil {
+		fmt.Fprintf(os.Stderr, "unknown target %q\n", *targetID)
+		return 1
+	}
+
+	chain, err := leasechain.New(chainBaseOptions(argsConfig)...)
+	if err != nil {
+		log.Logger.Sugar().Error(err)
+		return 1
+	}
+
+	session, err := chain.Login(context.Background())
+	if err != nil {
+		log.Logger.Sugar().Error(err)
+		return 1
+	}
+
+	key, err := session.FetchKey(context.Background(), target.ID)
+	if err != nil {
+		log.Logger.Sugar().Errorw("Failed to fetch GCP service account key", "err", err)
+		return 1
+	}
+
+	report := &keyReport{
+		TargetID:    target.ID,
+		SecretsPath: target.SecretsPath,
+		LeaseID:     key.LeaseID,
+		TTL:         int(key.TTL / time.Second),
+		Key:         key.Info,
+	}
+
+	exitCode := 0
+	if *revoke {
+		if err := session.Revoke(context.Background(), key); err != nil {
+			log.Logger.Sugar().Errorw("Failed to revoke GCP lease", "err", err)
+			exitCode = 1
+		} else {
+			report.Revoked = true
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		log.Logger.Sugar().Errorw("Failed to print key report", "err", err)
+		return 1
+	}
+	return exitCode
+}
+
+func findTarget(argsConfig *config.ArgsConfig, targetID string) *config.TargetConfig {
+	targets := argsConfig.GetTargets()
+	if targetID == "" {
+		return targets[0]
+	}
+
+	for _, target := range targets {
+		if target.ID == targetID {
+			return target
+		}
+	}
+	return nil
+}
@@ -1,97 +1,138 @@
 package main
 
 import (
-	"context"
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
 	"syscall"
-	"time"
 
-	"github.com/cermati/devops-toolkit/common-libs/toolkit-go/pkg/cvault"
-	"github.com/cermati/devops-toolkit/common-libs/toolkit-go/pkg/log"
 	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/config"
-	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/gcp"
-	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/gcs"
-	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/vault"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/log"
 	"github.com/pkg/errors"
 )
 
-func main() {
-	argsConfig := getArgsConfig()
-
-	initLogger(argsConfig.LogConf)
-
-	ctx := context.Background()
-
-	vaultLeaseMgr, vaultDaemon := initVault(ctx, argsConfig.VaultConf, argsConfig.TLSConf)
+const (
+	defaultCommand string = "run"
+)
 
-	vaultRefreshPeriod := time.Duration(vaultLeaseMgr.Client().TTL()) * time.Second
-	vaultRenewTime := time.Now().Add(vaultRefreshPeriod)
-	log.Logger.Sugar().Infow("Next Vault token renew", "renew_time", vaultRenewTime.Format(time.RFC3339))
+type command struct {
+	description string
+	run         func(args []string) int
+}
 
-	gcpLeaseMgr, gcpDaemon := initGCP(
-		ctx,
-		argsConfig.SecretsPath,
-		vaultLeaseMgr.Client(),
-		argsConfig.EarlyRenewal,
-	)
+var commands = map[string]command{
+	"run": {
+		description: "Run the lease chain until SIGINT or SIGTERM",
+		run:         runCommand,
+	},
+	"once": {
+		description: "Fetch a key, list the buckets once and print a JSON report",
+		run:         onceCommand,
+	},
+	"check-config": {
+		description: "Validate the config and the TLS files without contacting Vault",
+		run:         checkConfigCommand,
+	},
+	"inspect-key": {
+		description: "Fetch a key and print its non-secret metadata",
+		run:         inspectKeyCommand,
+	},
+	"stress": {
+		description: "Simulate many concurrent GCP lease managers against the secrets engine cache",
+		run:         stressCommand,
+	},
+	"status": {
+		description: "Print the lease tree of a running worker through its admin API",
+		run:         statusCommand,
+	},
+	"version": {
+		description: "Print the build info",
+		run:         versionCommand,
+	},
+}
 
-	vaultLeaseMgr.Register(gcpLeaseMgr)
-	defer vaultLeaseMgr.Deregister(gcpLeaseMgr)
+func main() {
+	commandName, args := defaultCommand, os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		commandName, args = args[0], args[1:]
+	}
 
-	gcsBucketListerSvc, gcsDaemon := initGCS(
-		ctx,
-		argsConfig.ProjectID,
-		gcpLeaseMgr,
-		argsConfig.Interval,
-	)
+	cmd, ok := commands[commandName]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", commandName)
+		printUsage()
+		os.Exit(2)
+	}
 
-	gcpLeaseMgr.Register(gcsBucketListerSvc)
+	os.Exit(cmd.run(args))
+}
 
-	log.Logger.Sugar().Info("Starting Vault daemon...")
-	if err := vaultDaemon.Start(); err != nil {
-		log.Logger.Sugar().Fatalw("failed starting Vault daemon", "err", err.Error())
-	}
-	log.Logger.Sugar().Info("Vault daemon started")
-	defer vaultDaemon.Stop()
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
 
-	log.Logger.Sugar().Info("Starting GCP daemon...")
-	if err := gcpDaemon.Start(); err != nil {
-		log.Logger.Sugar().Fatalw("failed starting GCP daemon", "err", err.Error())
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
 	}
-	log.Logger.Sugar().Info("GCP daemon started")
-	defer gcpDaemon.Stop()
+	sort.Strings(names)
 
-	log.Logger.Sugar().Info("Starting GCS daemon...")
-	if err := gcsDaemon.Start(); err != nil {
-		log.Logger.Sugar().Fatalw("failed starting GCS daemon", "err", err.Error())
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", name, commands[name].description)
 	}
-	log.Logger.Sugar().Info("GCS daemon started")
-	defer gcsDaemon.Stop()
-
-	waitForSignal()
+	fmt.Fprintf(os.Stderr, "\nThe default command is %s. Run '%s <command> -h' for its flags.\n", defaultCommand, os.Args[0])
 }
 
-func getArgsConfig() *config.ArgsConfig {
+// bindArgsConfig loads config.yml and binds the flags overriding it to the
+// flag set, the returned config is complete once the flag set is parsed
+func bindArgsConfig(flagSet *flag.FlagSet) *config.ArgsConfig {
 	cfg := config.LoadFromFile("config.yml")
 
-	flag.StringVar(&cfg.SecretsPath, "secrets-path", cfg.SecretsPath, "GCP secrets engine path")
-	flag.StringVar(&cfg.ProjectID, "project-id", cfg.ProjectID, "GCP project ID")
-	flag.DurationVar(&cfg.Interval, "interval", cfg.Interval, "The interval to list the GCS bucket")
-	flag.DurationVar(&cfg.EarlyRenewal, "early-renewal", cfg.EarlyRenewal, "The early renewal duration")
+	flagSet.StringVar(&cfg.SecretsPath, "secrets-path", cfg.SecretsPath, "GCP secrets engine path")
+	flagSet.StringVar(&cfg.ProjectID, "project-id", cfg.ProjectID, "GCP project ID")
+	flagSet.DurationVar(&cfg.Interval, "interval", cfg.Interval, "The interval to list the GCS bucket")
+	flagSet.Var(&cfg.EarlyRenewal, "early-renewal", "How long before its expiry the key is renewed, a duration or a percentage of the TTL such as 25%")
+	flagSet.DurationVar(&cfg.MinRemaining, "min-remaining", cfg.MinRemaining, "The lifetime the key must have left to be handed to the consumers")
+
+	flagSet.StringVar(&cfg.GCSConf.Prefix, "gcs.prefix", cfg.GCSConf.Prefix, "Only list GCS buckets whose names begin with this prefix")
+	flagSet.IntVar(&cfg.GCSConf.PageSize, "gcs.page-size", cfg.GCSConf.PageSize, "The number of GCS buckets requested per page")
+
+	flagSet.StringVar(&cfg.VaultConf.Address, "vault.address", cfg.VaultConf.Address, "Vault address")
+	flagSet.StringVar(&cfg.VaultConf.RoleName, "vault.role", cfg.VaultConf.RoleName, "Vault role name")
+	flagSet.Var(&cfg.VaultConf.EarlyRenewal, "vault.early-renewal", "How long before its expiry the Vault token is renewed, a duration or a percentage of the TTL such as 25%")
+	flagSet.DurationVar(&cfg.VaultConf.MinRemaining, "vault.min-remaining", cfg.VaultConf.MinRemaining, "The lifetime the Vault token must have left")
+	flagSet.StringVar(&cfg.VaultConf.Client, "vault.client", cfg.VaultConf.Client, "Vault client (hashicorp, or toolkit when built with the toolkit tag)")
+
+	flagSet.StringVar(&cfg.HealthConf.Address, "health.address", cfg.HealthConf.Address, "Address serving /healthz, /readyz and /debug/schedule, empty disables it")
 
-	flag.StringVar(&cfg.VaultConf.Address, "vault.address", cfg.VaultConf.Address, "Vault address")
-	flag.StringVar(&cfg.VaultConf.RoleName, "vault.role", cfg.VaultConf.RoleName, "Vault role name")
+	flagSet.StringVar(&cfg.MetadataConf.Address, "metadata.address", cfg.MetadataConf.Address, "Address serving the GCE metadata emulation, empty disables it")
+	flagSet.StringVar(&cfg.MetadataConf.Target, "metadata.target", cfg.MetadataConf.Target, "Target whose key is served by the metadata emulation, the first target by default")
+	flagSet.StringVar(&cfg.AdminConf.Address, "admin.address", cfg.AdminConf.Address, "Address serving the admin API and /debug/events, empty disables it")
 
-	flag.StringVar(&cfg.LogConf.Format, "log.level", cfg.LogConf.Format, "Log level (debug, info, warning, error)")
-	flag.StringVar(&cfg.LogConf.Level, "log.format", cfg.LogConf.Level, "Log format (text, json)")
+	flagSet.StringVar(&cfg.TracingConf.Exporter, "tracing.exporter", cfg.TracingConf.Exporter, "Trace exporter (otlp, file), empty disables tracing")
+	flagSet.StringVar(&cfg.TracingConf.Endpoint, "tracing.endpoint", cfg.TracingConf.Endpoint, "Base URL of the OTLP/HTTP receiver of the otlp exporter")
+	flagSet.StringVar(&cfg.TracingConf.Path, "tracing.path", cfg.TracingConf.Path, "File the file exporter appends the traces to")
 
-	flag.StringVar(&cfg.TLSConf.CACertPath, "tls.ca", cfg.TLSConf.CACertPath, "Location of CA cert file")
-	flag.StringVar(&cfg.TLSConf.CertPath, "tls.cert", cfg.TLSConf.CertPath, "Location of cert file")
-	flag.StringVar(&cfg.TLSConf.KeyPath, "tls.key", cfg.TLSConf.KeyPath, "Location of key file")
+	flagSet.StringVar(&cfg.PersistConf.Path, "persistence.path", cfg.PersistConf.Path, "Directory keeping the encrypted leases across restarts, empty disables it")
 
-	flag.Parse()
+	flagSet.StringVar(&cfg.CoordConf.Mode, "coordination.mode", cfg.CoordConf.Mode, "Leader election among the replicas (kubernetes, file), empty lets every replica fetch its own keys")
+	flagSet.StringVar(&cfg.CoordConf.Identity, "coordination.identity", cfg.CoordConf.Identity, "Identity of the replica in the election, the hostname by default")
+	flagSet.StringVar(&cfg.CoordConf.LockPath, "coordination.lock-path", cfg.CoordConf.LockPath, "Lock file of the file election")
+	flagSet.StringVar(&cfg.CoordConf.Address, "coordination.address", cfg.CoordConf.Address, "Address serving the keys of the leader to the followers")
+	flagSet.StringVar(&cfg.CoordConf.AdvertiseAddress, "coordination.advertise-address", cfg.CoordConf.AdvertiseAddress, "URL the followers reach the coordination address at")
+
+	flagSet.DurationVar(&cfg.ScheduleConf.StartupJitter, "schedule.startup-jitter", cfg.ScheduleConf.StartupJitter, "Delays the start by a random duration up to it")
+	flagSet.Float64Var(&cfg.ScheduleConf.RenewalWindow.From, "schedule.renewal-window.from", cfg.ScheduleConf.RenewalWindow.From, "Fraction of the TTL the renewal window starts at, 0 disables the window")
+	flagSet.Float64Var(&cfg.ScheduleConf.RenewalWindow.To, "schedule.renewal-window.to", cfg.ScheduleConf.RenewalWindow.To, "Fraction of the TTL the renewal window ends at")
+
+	flagSet.StringVar(&cfg.LogConf.Level, "log.level", cfg.LogConf.Level, "Log level (debug, info, warning, error)")
+	flagSet.StringVar(&cfg.LogConf.Format, "log.format", cfg.LogConf.Format, "Log format (text, json)")
+
+	flagSet.StringVar(&cfg.TLSConf.CACertPath, "tls.ca", cfg.TLSConf.CACertPath, "Location of CA cert file")
+	flagSet.StringVar(&cfg.TLSConf.CertPath, "tls.cert", cfg.TLSConf.CertPath, "Location of cert file")
+	flagSet.StringVar(&cfg.TLSConf.KeyPath, "tls.key", cfg.TLSConf.KeyPath, "Location of key file")
 
 	return cfg
 }
@@ -107,70 +148,6 @@ func initLogger(logConf *config.LogConfig) {
 	}
 }
 
-func initVault(
-	ctx context.Context,
-	vaultConf *config.VaultConfig,
-	tlsConf *config.TLSConfig,
-) (*vault.VaultLeaseManager, vault.Daemon) {
-	log.Logger.Sugar().Info("Validating TLS config")
-	if err := validateTLSConfig(tlsConf); err != nil {
-		log.Logger.Sugar().Fatal(err)
-	}
-	log.Logger.Sugar().Info("TLS config valid!")
-
-	log.Logger.Sugar().Info("Initializing Vault lease manager")
-	if err := vault.NewVaultLeaseManager(vaultConf, tlsConf); err != nil {
-		log.Logger.Sugar().Fatal(err)
-	}
-	log.Logger.Sugar().Info("Vault lease manager initialized")
-
-	vaultLeaseMgr := vault.GetInstance()
-
-	vaultCtx, vaultCancel := context.WithCancel(ctx)
-	vaultRefreshPeriod := time.Duration(vaultLeaseMgr.Client().TTL()) * time.Second
-	vaultDaemon := vaultLeaseMgr.Daemonize(vaultCtx, vaultCancel, vaultRefreshPeriod)
-
-	return vaultLeaseMgr, vaultDaemon
-}
-
-func initGCP(
-	ctx context.Context,
-	secretsPath string,
-	vaultClient cvault.CVault,
-	earlyRenewal time.Duration,
-) (*gcp.GCPLeaseManager, gcp.Daemon) {
-	log.Logger.Sugar().Info("Initializing GCP lease manager")
-	gcpLeaseMgr := gcp.NewGCPLeaseManager("gcp-01", secretsPath, vaultClient)
-	log.Logger.Sugar().Info("GCP lease manager initialized")
-
-	gcpCtx, gcpCancel := context.WithCancel(ctx)
-	gcpRefreshPeriod := time.Duration(gcpLeaseMgr.GetTTL()) * time.Second
-	gcpDaemon := gcpLeaseMgr.Daemonize(gcpCtx, gcpCancel, gcpRefreshPeriod, earlyRenewal)
-
-	return gcpLeaseMgr, gcpDaemon
-}
-
-func initGCS(
-	ctx context.Context,
-	projectID string,
-	gcpLeaseMgr *gcp.GCPLeaseManager,
-	interval time.Duration,
-) (*gcs.BucketListerService, gcs.Daemon) {
-	gcsCtx, gcsCancel := context.WithCancel(ctx)
-
-	log.Logger.Sugar().Info("Initializing GCS bucket lister service")
-	gcsBucketListerSvc := gcs.NewBucketListerService(
-		gcsCtx,
-		gcsCancel,
-		"gcs-01",
-		projectID,
-		gcpLeaseMgr,
-	)
-	log.Logger.Sugar().Info("GCS bucket lister service initialized")
-
-	return gcsBucketListerSvc, gcsBucketListerSvc.Daemonize(interval)
-}
-
 func validateTLSConfig(tlsConf *config.TLSConfig) error {
 	var err error
 	tlsConf.CACertPath, err = config.ValidateFilePathValue(tlsConf.CACertPath)
@@ -192,7 +169,7 @@ func validateTLSConfig(tlsConf *config.TLSConfig) error {
 }
 
 func waitForSignal() {
-	sigs := make(chan os.Signal)
+	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	<-sigs
 }
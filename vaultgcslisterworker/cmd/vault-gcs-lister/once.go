@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"time"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/config"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/log"
+	"github.com/mikeadityas/vault-gcs-lister/pkg/leasechain"
+)
+
+type onceReport struct {
+	Success          bool                `json:"success"`
+	StartedAt        time.Time           `json:"started_at"`
+	VaultLoginMillis int64               `json:"vault_login_latency_ms"`
+	Error            string              `json:"error,omitempty"`
+	Targets          []*onceTargetReport `json:"targets"`
+}
+
+type onceTargetReport struct {
+	TargetID    string              `json:"target_id"`
+	SecretsPath string              `json:"secrets_path"`
+	ProjectID   string              `json:"project_id"`
+	KeyID       string              `json:"key_id,omitempty"`
+	LeaseID     string              `json:"lease_id,omitempty"`
+	TTL         int                 `json:"ttl_seconds"`
+	FetchMillis int64               `json:"fetch_latency_ms"`
+	ListMillis  int64               `json:"list_latency_ms"`
+	Buckets     []leasechain.Bucket `json:"buckets"`
+	Success     bool                `json:"success"`
+	Revoked     bool                `json:"revoked"`
+	Error       string              `json:"error,omitempty"`
+	RevokeError string              `json:"revoke_error,omitempty"`
+}
+
+// onceCommand logs into Vault, fetches one key for every target, lists its
+// buckets once and prints a JSON report. It returns the process exit code.
+func onceCommand(args []string) int {
+	flagSet := flag.NewFlagSet("once", flag.ExitOnError)
+	argsConfig := bindArgsConfig(flagSet)
+	revoke := flagSet.Bool("revoke", false, "Revoke the fetched GCP leases before exiting")
+	flagSet.Parse(args)
+
+	initLogger(argsConfig.LogConf)
+
+	report := &onceReport{
+		StartedAt: time.Now(),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	session, err := loginOnce(ctx, argsConfig, report)
+	if err != nil {
+		report.Error = err.Error()
+		return printOnceReport(report)
+	}
+
+	report.Success = true
+	for _, target := range argsConfig.GetTargets() {
+		targetReport, key := probeOnce(ctx, session, target)
+
+		if *revoke && key != nil {
+			if err := session.Revoke(ctx, key); err != nil {
+				targetReport.RevokeError = err.Error()
+				targetReport.Success = false
+			} else {
+				targetReport.Revoked = true
+			}
+		}
+
+		report.Success = report.Success && targetReport.Success
+		report.Targets = append(report.Targets, targetReport)
+	}
+
+	return printOnceReport(report)
+}
+
+func loginOnce(ctx context.Context, argsConfig *config.ArgsConfig, report *onceReport) (*leasechain.Session, error) {
+	chain, err := leasechain.New(chainBaseOptions(argsConfig)...)
+	if err != nil {
+		return nil, err
+	}
+
+	loginStart := time.Now()
+	session, err := chain.Login(ctx)
+	report.VaultLoginMillis = time.Since(loginStart).Milliseconds()
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// probeOnce also returns the fetched key, nil if the fetch failed
+func probeOnce(ctx context.Context, session *leasechain.Session, target *config.TargetConfig) (*onceTargetReport, *leasechain.Key) {
+	targetReport := &onceTargetReport{
+		TargetID:    target.ID,
+		SecretsPath: target.SecretsPath,
+		ProjectID:   target.ProjectID,
+	}
+
+	fetchStart := time.Now()
+	key, err := session.FetchKey(ctx, target.ID)
+	targetReport.FetchMillis = time.Since(fetchStart).Milliseconds()
+	if err != nil {
+		targetReport.Error = err.Error()
+		return targetReport, nil
+	}
+	targetReport.KeyID = key.Info.PrivateKeyID
+	targetReport.LeaseID = key.LeaseID
+	targetReport.TTL = int(key.TTL / time.Second)
+
+	listStart := time.Now()
+	buckets, err := session.ListBuckets(ctx, key)
+	targetReport.ListMillis = time.Since(listStart).Milliseconds()
+	if err != nil {
+		targetReport.Error = err.Error()
+		return targetReport, key
+	}
+
+	targetReport.Buckets = buckets
+	targetReport.Success = true
+	return targetReport, key
+}
+
+func printOnceReport(report *onceReport) int {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		log.Logger.Sugar().Errorw("Failed to print report", "err", err)
+		return 1
+	}
+
+	if !report.Success {
+		return 1
+	}
+	return 0
+}
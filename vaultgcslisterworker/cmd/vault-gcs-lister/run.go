@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/admin"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/config"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/credfile"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/gcp"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/log"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/metadata"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/sink"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/tracing"
+	"github.com/mikeadityas/vault-gcs-lister/pkg/leasechain"
+)
+
+// shutdownTimeout bounds the flush of the traces and the shutdown of each
+// HTTP server once the lease chain stopped
+const shutdownTimeout = 5 * time.Second
+
+// runCommand runs the lease chain until it receives SIGINT or SIGTERM
+func runCommand(args []string) int {
+	flagSet := flag.NewFlagSet("run", flag.ExitOnError)
+	argsConfig := bindArgsConfig(flagSet)
+	flagSet.Parse(args)
+
+	initLogger(argsConfig.LogConf)
+	if err := run(argsConfig); err != nil {
+		log.Logger.Sugar().Errorw("Failed running the lease chain", "err", err.Error())
+		return 1
+	}
+	return 0
+}
+
+// run returns instead of exiting on errors, so the deferred shutdowns and the
+// event history dump always run
+func run(argsConfig *config.ArgsConfig) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	shutdownTracing, err := tracing.Init(argsConfig.TracingConf)
+	if err != nil {
+		return errors.Wrap(err, "failed initializing tracing")
+	}
+	defer func() {
+		// Flush the spans of the shutdown, the run context is done by now
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer shutdownCancel()
+
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			log.Logger.Sugar().Errorw("Failed to flush traces", "err", err)
+		}
+	}()
+
+	chainOpts, sinks, err := initChainOptions(argsConfig)
+	for _, listingSink := range sinks {
+		defer listingSink.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	chain, err := leasechain.New(chainOpts...)
+	if err != nil {
+		return err
+	}
+
+	adminToken := os.ExpandEnv(argsConfig.AdminConf.Token)
+	if argsConfig.AdminConf.Address != "" && adminToken == "" {
+		return errors.New("admin.token is required to serve the admin API")
+	}
+
+	healthMux := http.NewServeMux()
+	healthMux.Handle("/debug/schedule", chain.ScheduleHandler())
+	healthMux.Handle("/", chain.HealthHandler())
+	if healthServer := startHTTPServer("health check", argsConfig.HealthConf.Address, healthMux); healthServer != nil {
+		defer shutdownHTTPServer("health check", healthServer)
+	}
+	defer chain.DumpEvents()
+
+	adminHandler := admin.Handler(chain, adminToken)
+	if adminServer := startHTTPServer("admin", argsConfig.AdminConf.Address, adminHandler); adminServer != nil {
+		defer shutdownHTTPServer("admin", adminServer)
+	}
+
+	go func() {
+		waitForSignal()
+		cancel()
+	}()
+
+	return chain.Run(ctx)
+}
+
+// chainBaseOptions translates the Vault login and the targets of the config to
+// options of the lease chain, all the one-shot commands need
+func chainBaseOptions(argsConfig *config.ArgsConfig) []leasechain.Option {
+	chainOpts := []leasechain.Option{
+		leasechain.WithVault(argsConfig.VaultConf.Address, argsConfig.VaultConf.RoleName),
+		leasechain.WithVaultClient(argsConfig.VaultConf.Client),
+		leasechain.WithTLS(argsConfig.TLSConf.CACertPath, argsConfig.TLSConf.CertPath, argsConfig.TLSConf.KeyPath),
+	}
+
+	for _, target := range argsConfig.GetTargets() {
+		expected := keyExpectation(target)
+		chainOpts = append(chainOpts, leasechain.WithTarget(leasechain.Target{
+			ID:                  target.ID,
+			SecretsPath:         target.SecretsPath,
+			EarlyRenewal:        target.EarlyRenewal.Duration,
+			EarlyRenewalPercent: target.EarlyRenewal.Percent,
+			MinRemaining:        target.MinRemaining,
+			ExpectedClientEmail: expected.ClientEmail,
+			ExpectedProjectID:   expected.ProjectID,
+			ProjectID:           target.ProjectID,
+			Interval:            target.Interval,
+			Prefix:              target.GCSConf.Prefix,
+			PageSize:            target.GCSConf.PageSize,
+		}))
+	}
+	return chainOpts
+}
+
+// initChainOptions translates the config to the options of the lease chain,
+// it also returns the sinks to close once the chain stops, even on error
+func initChainOptions(argsConfig *config.ArgsConfig) ([]leasechain.Option, []leasechain.Sink, error) {
+	chainOpts := append(
+		chainBaseOptions(argsConfig),
+		leasechain.WithVaultRenewal(leasechain.Renewal{
+			EarlyRenewal:        argsConfig.VaultConf.EarlyRenewal.Duration,
+			EarlyRenewalPercent: argsConfig.VaultConf.EarlyRenewal.Percent,
+			MinRemaining:        argsConfig.VaultConf.MinRemaining,
+		}),
+		leasechain.WithPersistence(argsConfig.PersistConf.Path, os.ExpandEnv(argsConfig.PersistConf.Passphrase)),
+		leasechain.WithSchedule(leasechain.Schedule{
+			StartupJitter:     argsConfig.ScheduleConf.StartupJitter,
+			RenewalWindowFrom: argsConfig.ScheduleConf.RenewalWindow.From,
+			RenewalWindowTo:   argsConfig.ScheduleConf.RenewalWindow.To,
+		}),
+	)
+
+	if coordConf := argsConfig.CoordConf; coordConf.Mode != "" {
+		chainOpts = append(chainOpts, leasechain.WithCoordination(leasechain.Coordination{
+			Mode:             coordConf.Mode,
+			Identity:         coordConf.Identity,
+			LeaseName:        coordConf.LeaseName,
+			LeaseNamespace:   coordConf.LeaseNamespace,
+			LockPath:         coordConf.LockPath,
+			LeaseDuration:    coordConf.LeaseDuration,
+			RetryPeriod:      coordConf.RetryPeriod,
+			Address:          coordConf.Address,
+			AdvertiseAddress: os.ExpandEnv(coordConf.AdvertiseAddress),
+		}))
+	}
+
+	var sinks []leasechain.Sink
+	for _, target := range argsConfig.GetTargets() {
+		targetSinks, err := initSinks(target.ID, target.SinkConfs)
+		for _, listingSink := range targetSinks {
+			chainOpts = append(chainOpts, leasechain.WithSink(target.ID, listingSink))
+			sinks = append(sinks, listingSink)
+		}
+		if err != nil {
+			return nil, sinks, err
+		}
+
+		credFileWriter, err := initCredFile(target)
+		if err != nil {
+			return nil, sinks, err
+		}
+		if credFileWriter != nil {
+			chainOpts = append(chainOpts, leasechain.WithConsumer(target.ID, credFileWriter))
+		}
+	}
+
+	if metadataConf := argsConfig.MetadataConf; metadataConf.Address != "" {
+		target := findTarget(argsConfig, metadataConf.Target)
+		if target == nil {
+			return nil, sinks, errors.Errorf("unknown metadata target %s", metadataConf.Target)
+		}
+
+		metadataServer := metadata.NewServer("metadata-"+target.ID, metadataConf.Address)
+		chainOpts = append(chainOpts, leasechain.WithConsumer(target.ID, metadataServer))
+	}
+
+	return chainOpts, sinks, nil
+}
+
+// startHTTPServer serves handler on address in the background, it returns nil
+// if address is empty
+func startHTTPServer(name, address string, handler http.Handler) *http.Server {
+	if address == "" {
+		return nil
+	}
+
+	httpServer := &http.Server{
+		Addr:    address,
+		Handler: handler,
+	}
+
+	go func() {
+		log.Logger.Sugar().Infow("Serving "+name+" server", "address", address)
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Logger.Sugar().Errorw("The "+name+" server stopped", "err", err)
+		}
+	}()
+	return httpServer
+}
+
+// shutdownHTTPServer waits up to shutdownTimeout for the requests in flight
+func shutdownHTTPServer(name string, httpServer *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Logger.Sugar().Errorw("Failed to shut down the "+name+" server", "err", err)
+	}
+}
+
+// keyExpectation returns the service account the keys of target must belong to
+func keyExpectation(target *config.TargetConfig) gcp.KeyExpectation {
+	if target.KeyConf == nil {
+		return gcp.KeyExpectation{}
+	}
+	return gcp.KeyExpectation{
+		ClientEmail: target.KeyConf.ClientEmail,
+		ProjectID:   target.KeyConf.ProjectID,
+	}
+}
+
+// initCredFile returns nil if the target has no credentials file
+func initCredFile(target *config.TargetConfig) (*credfile.Writer, error) {
+	if target.CredFileConf == nil || target.CredFileConf.Path == "" {
+		return nil, nil
+	}
+
+	log.Logger.Sugar().Infow("Initializing credentials file writer", "path", target.CredFileConf.Path)
+	credFileWriter, err := credfile.NewWriter(
+		"credfile-"+target.ID,
+		target.CredFileConf.Path,
+		target.CredFileConf.Hook,
+		target.CredFileConf.HookTimeout,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return credFileWriter, nil
+}
+
+// initSinks also returns the sinks created before an error, to be closed
+func initSinks(targetID string, sinkConfs []*config.SinkConfig) ([]leasechain.Sink, error) {
+	var sinks []leasechain.Sink
+	for idx, sinkConf := range sinkConfs {
+		sinkID := fmt.Sprintf("%s-%s-%d", targetID, sinkConf.Type, idx)
+
+		log.Logger.Sugar().Infow("Initializing GCS listing sink", "sink_id", sinkID)
+		listingSink, err := sink.New(sinkID, sinkConf)
+		if err != nil {
+			return sinks, err
+		}
+		sinks = append(sinks, listingSink)
+	}
+	return sinks, nil
+}
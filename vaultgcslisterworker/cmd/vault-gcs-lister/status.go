@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/config"
+	"github.com/mikeadityas/vault-gcs-lister/pkg/leasechain"
+)
+
+// statusCommand queries the admin API of a running worker and prints its
+// lease tree
+func statusCommand(args []string) int {
+	argsConfig := config.LoadFromFile("config.yml")
+
+	flagSet := flag.NewFlagSet("status", flag.ExitOnError)
+	addr := flagSet.String("addr", argsConfig.AdminConf.Address, "Address of the admin API of the running worker")
+	output := flagSet.String("output", "table", "Output format (table, json)")
+	timeout := flagSet.Duration("timeout", 10*time.Second, "Timeout of the request to the admin API")
+	flagSet.Parse(args)
+
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "unknown output %q\n", *output)
+		return 2
+	}
+
+	state, err := fetchState(*addr, os.ExpandEnv(argsConfig.AdminConf.Token), *timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to query the worker: %s\n", err)
+		return 1
+	}
+
+	if *output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(state); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to print the state: %s\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	if err := printStateTable(os.Stdout, state, time.Now()); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to print the state: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// fetchState gets the state of the worker serving the admin API on addr
+func fetchState(addr, token string, timeout time.Duration) (*leasechain.State, error) {
+	if addr == "" {
+		return nil, errors.New("the admin API address is empty, set --addr or admin.address")
+	}
+	if strings.HasPrefix(addr, ":") {
+		addr = "127.0.0.1" + addr
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(addr, "/")+"/admin/state", nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid admin API address")
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		errResp := struct {
+			Error string `json:"error"`
+		}{}
+		json.NewDecoder(resp.Body).Decode(&errResp)
+		return nil, errors.Errorf("the admin API answered %s: %s", resp.Status, errResp.Error)
+	}
+
+	state := &leasechain.State{}
+	if err := json.NewDecoder(resp.Body).Decode(state); err != nil {
+		return nil, errors.Wrap(err, "invalid state")
+	}
+	return state, nil
+}
+
+// printStateTable prints the lease tree, each GCP key under the Vault token
+// and each GCS lister under its key
+func printStateTable(out io.Writer, state *leasechain.State, now time.Time) error {
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "COMPONENT\tSTATE\tTTL\tLAST SUCCESS\tNEXT RUN\tRETRIES\tLAST ERROR")
+
+	printStateRow(tw, "vault token", state.Vault.ComponentStatus, state.Vault.TokenExpiresAt, now)
+	for _, target := range state.Targets {
+		keyName := fmt.Sprintf("└─ %s key", target.ID)
+		if target.Key.KeyID != "" {
+			keyName += " " + target.Key.KeyID
+		}
+		printStateRow(tw, keyName, target.Key.ComponentStatus, target.Key.ExpiresAt, now)
+
+		if target.Lister != nil {
+			listerName := fmt.Sprintf("   └─ %s lister %s", target.ID, target.Lister.ProjectID)
+			if target.Lister.Paused {
+				listerName += " (paused)"
+			}
+			printStateRow(tw, listerName, target.Lister.ComponentStatus, time.Time{}, now)
+		}
+	}
+	return tw.Flush()
+}
+
+func printStateRow(tw io.Writer, name string, status leasechain.ComponentStatus, expiresAt, now time.Time) {
+	state := string(status.State)
+	if state == "" {
+		state = "-"
+	}
+
+	lastErr := "-"
+	if status.LastErr != "" {
+		lastErr = status.LastErr
+		if status.ErrClass != "" {
+			lastErr = status.ErrClass + ": " + lastErr
+		}
+	}
+
+	fmt.Fprintf(
+		tw,
+		"%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+		name,
+		state,
+		formatRemaining(expiresAt, now),
+		formatTime(status.LastSuccessAt),
+		formatTime(status.NextRunAt),
+		status.NumRetry,
+		lastErr,
+	)
+}
+
+func formatRemaining(expiresAt, now time.Time) string {
+	if expiresAt.IsZero() {
+		return "-"
+	}
+	if !expiresAt.After(now) {
+		return "expired"
+	}
+	return expiresAt.Sub(now).Round(time.Second).String()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/log"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/stress"
+	"github.com/mikeadityas/vault-gcs-lister/pkg/leasechain"
+)
+
+const (
+	defaultKeyLimit int = 10
+)
+
+// stressCommand simulates many GCP lease managers in one process against
+// the GCP secrets engine cache and prints a summary of the requests
+func stressCommand(args []string) int {
+	flagSet := flag.NewFlagSet("stress", flag.ExitOnError)
+	argsConfig := bindArgsConfig(flagSet)
+	targetID := flagSet.String("target", "", "ID of the target to stress, defaults to the first target")
+	numClients := flagSet.Int("clients", 5, "Number of simulated GCP lease managers")
+	stressConf := stress.Config{}
+	flagSet.Float64Var(&stressConf.Rate, "rate", 1, "Maximum requests per second across all clients")
+	flagSet.DurationVar(&stressConf.RampUp, "ramp-up", 1*time.Minute, "Period over which the clients are started")
+	flagSet.DurationVar(&stressConf.Duration, "duration", 5*time.Minute, "How long the load is generated")
+	flagSet.DurationVar(&stressConf.TTL, "ttl", 0, "How long a client holds a key before requesting a new one, 0 requests as fast as the rate allows")
+	flagSet.Float64Var(&stressConf.TTLJitter, "ttl-jitter", 0.1, "Fraction by which the TTL is randomized")
+	keyLimit := flagSet.Int("key-limit", defaultKeyLimit, "Service account key limit of the roleset")
+	output := flagSet.String("output", "text", "Summary format (text, json)")
+	flagSet.Parse(args)
+
+	initLogger(argsConfig.LogConf)
+
+	if *numClients <= 0 || stressConf.Rate <= 0 || stressConf.Duration <= 0 {
+		fmt.Fprintln(os.Stderr, "clients, rate and duration must be positive")
+		return 2
+	}
+
+	target := findTarget(argsConfig, *targetID)
+	if target == nil {
+		fmt.Fprintf(os.Stderr, "unknown target %q\n", *targetID)
+		return 1
+	}
+
+	chain, err := leasechain.New(chainBaseOptions(argsConfig)...)
+	if err != nil {
+		log.Logger.Sugar().Error(err)
+		return 1
+	}
+
+	session, err := chain.Login(context.Background())
+	if err != nil {
+		log.Logger.Sugar().Error(err)
+		return 1
+	}
+
+	clients := make([]stress.Client, 0, *numClients)
+	for idx := 0; idx < *numClients; idx++ {
+		clients = append(clients, &stressClient{
+			id:       fmt.Sprintf("gcp-%s-stress-%02d", target.ID, idx+1),
+			targetID: target.ID,
+			session:  session,
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		waitForSignal()
+		cancel()
+	}()
+
+	log.Logger.Sugar().Infow(
+		"Starting stress test",
+		"target_id", target.ID,
+		"clients", *numClients,
+		"rate", stressConf.Rate,
+		"duration", stressConf.Duration,
+	)
+	summary := stress.Run(ctx, stressConf, clients)
+	summary.KeyLimit = *keyLimit
+
+	switch *output {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(summary); err != nil {
+			log.Logger.Sugar().Errorw("Failed to print stress summary", "err", err)
+			return 1
+		}
+	default:
+		summary.Print(os.Stdout)
+	}
+
+	if summary.Errors > 0 || summary.DistinctKeys > summary.KeyLimit {
+		return 1
+	}
+	return 0
+}
+
+// stressClient fetches the keys of a target through a session shared by all
+// the simulated clients, like the GCP lease managers of a chain share its
+// Vault token
+type stressClient struct {
+	id       string
+	targetID string
+	session  *leasechain.Session
+	keyID    string
+}
+
+func (sc *stressClient) GetNewLease(ctx context.Context) error {
+	key, err := sc.session.FetchKey(ctx, sc.targetID)
+	if err != nil {
+		return err
+	}
+	sc.keyID = key.Info.PrivateKeyID
+	return nil
+}
+
+func (sc *stressClient) GetKeyID() string {
+	return sc.keyID
+}
+
+func (sc *stressClient) GetID() string {
+	return sc.id
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Build info, injected with -ldflags "-X main.version=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+func versionCommand(args []string) int {
+	fmt.Printf(
+		"vault-gcs-lister %s (commit %s, built %s, %s %s/%s)\n",
+		version,
+		commit,
+		buildDate,
+		runtime.Version(),
+		runtime.GOOS,
+		runtime.GOARCH,
+	)
+	return 0
+}
@@ -0,0 +1,138 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/log"
+	"github.com/mikeadityas/vault-gcs-lister/pkg/leasechain"
+)
+
+const targetsPath = "/admin/targets/"
+
+// Controller is the part of a lease chain controlled by the admin API
+type Controller interface {
+	RotateKey(targetID string) error
+	RenewToken() error
+	ListNow(targetID string) error
+	PauseLister(targetID string) error
+	ResumeLister(targetID string) error
+	State() (*leasechain.State, error)
+	EventsHandler() http.Handler
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type actionResponse struct {
+	Action string `json:"action"`
+	Target string `json:"target,omitempty"`
+}
+
+// Handler returns the handler of the admin API and of /debug/events, every
+// request must carry token as its bearer token
+func Handler(controller Controller, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/events", controller.EventsHandler())
+	mux.HandleFunc("/admin/state", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+
+		state, err := controller.State()
+		if err != nil {
+			writeError(w, statusCode(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, state)
+	})
+	mux.HandleFunc("/admin/vault/renew", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		runAction(w, "renew", "", controller.RenewToken())
+	})
+	mux.HandleFunc(targetsPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, targetsPath), "/")
+		if len(parts) != 2 || parts[0] == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		targetID, action := parts[0], parts[1]
+		actions := map[string]func(string) error{
+			"rotate": controller.RotateKey,
+			"list":   controller.ListNow,
+			"pause":  controller.PauseLister,
+			"resume": controller.ResumeLister,
+		}
+		actionFunc, ok := actions[action]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		runAction(w, action, targetID, actionFunc(targetID))
+	})
+	return authenticate(mux, token)
+}
+
+// authenticate rejects requests without token as their bearer token
+func authenticate(next http.Handler, token string) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actual := []byte(r.Header.Get("Authorization"))
+		if token == "" || subtle.ConstantTimeCompare(actual, expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("invalid bearer token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func runAction(w http.ResponseWriter, action, targetID string, err error) {
+	if err != nil {
+		writeError(w, statusCode(err), err)
+		return
+	}
+
+	log.Logger.Sugar().Infow("Admin action requested", "action", action, "target", targetID)
+	writeJSON(w, http.StatusAccepted, actionResponse{Action: action, Target: targetID})
+}
+
+func statusCode(err error) int {
+	switch errors.Cause(err) {
+	case leasechain.ErrUnknownTarget:
+		return http.StatusNotFound
+	case leasechain.ErrNoLister:
+		return http.StatusConflict
+	case leasechain.ErrNotRunning:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeError(w http.ResponseWriter, statusCode int, err error) {
+	writeJSON(w, statusCode, errorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Logger.Sugar().Errorw("Failed to write admin response", "err", err)
+	}
+}
@@ -0,0 +1,166 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/mikeadityas/vault-gcs-lister/pkg/leasechain"
+)
+
+const testToken = "admin-token"
+
+// fakeController knows the target infra, whose lister runs, and the target
+// data, which has no lister
+type fakeController struct {
+	running bool
+	actions []string
+}
+
+func (fc *fakeController) target(action, targetID string, needsLister bool) error {
+	if !fc.running {
+		return leasechain.ErrNotRunning
+	}
+	switch {
+	case targetID != "infra" && targetID != "data":
+		return errors.Wrapf(leasechain.ErrUnknownTarget, "target %s", targetID)
+	case needsLister && targetID == "data":
+		return errors.Wrapf(leasechain.ErrNoLister, "target %s", targetID)
+	}
+	fc.actions = append(fc.actions, action+" "+targetID)
+	return nil
+}
+
+func (fc *fakeController) RotateKey(targetID string) error {
+	return fc.target("rotate", targetID, false)
+}
+
+func (fc *fakeController) RenewToken() error {
+	if !fc.running {
+		return leasechain.ErrNotRunning
+	}
+	fc.actions = append(fc.actions, "renew")
+	return nil
+}
+
+func (fc *fakeController) ListNow(targetID string) error {
+	return fc.target("list", targetID, true)
+}
+
+func (fc *fakeController) PauseLister(targetID string) error {
+	return fc.target("pause", targetID, true)
+}
+
+func (fc *fakeController) ResumeLister(targetID string) error {
+	return fc.target("resume", targetID, true)
+}
+
+func (fc *fakeController) State() (*leasechain.State, error) {
+	if !fc.running {
+		return nil, leasechain.ErrNotRunning
+	}
+	return &leasechain.State{}, nil
+}
+
+func (fc *fakeController) EventsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	})
+}
+
+func serve(handler http.Handler, method, path, token string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestAuthentication(t *testing.T) {
+	controller := &fakeController{running: true}
+	handler := Handler(controller, testToken)
+
+	for _, path := range []string{"/admin/targets/infra/rotate", "/admin/vault/renew", "/admin/state", "/debug/events"} {
+		method := http.MethodPost
+		if path == "/admin/state" || path == "/debug/events" {
+			method = http.MethodGet
+		}
+
+		for name, token := range map[string]string{"no token": "", "wrong token": "other-token"} {
+			t.Run(name+" "+path, func(t *testing.T) {
+				resp := serve(handler, method, path, token)
+				if resp.Code != http.StatusUnauthorized {
+					t.Fatalf("expected 401, got %d", resp.Code)
+				}
+				if resp.Header().Get("WWW-Authenticate") != "Bearer" {
+					t.Errorf("expected a bearer challenge, got %q", resp.Header().Get("WWW-Authenticate"))
+				}
+			})
+		}
+	}
+	if len(controller.actions) != 0 {
+		t.Fatalf("unauthenticated requests must not act, got %v", controller.actions)
+	}
+
+	// Without a configured token every request is rejected
+	if resp := serve(Handler(controller, ""), http.MethodPost, "/admin/vault/renew", ""); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a configured token, got %d", resp.Code)
+	}
+}
+
+func TestActions(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		notRunning bool
+		statusCode int
+		action     string
+	}{
+		{name: "rotate", method: http.MethodPost, path: "/admin/targets/infra/rotate", statusCode: http.StatusAccepted, action: "rotate infra"},
+		{name: "list", method: http.MethodPost, path: "/admin/targets/infra/list", statusCode: http.StatusAccepted, action: "list infra"},
+		{name: "pause", method: http.MethodPost, path: "/admin/targets/infra/pause", statusCode: http.StatusAccepted, action: "pause infra"},
+		{name: "resume", method: http.MethodPost, path: "/admin/targets/infra/resume", statusCode: http.StatusAccepted, action: "resume infra"},
+		{name: "renew", method: http.MethodPost, path: "/admin/vault/renew", statusCode: http.StatusAccepted, action: "renew"},
+		{name: "rotate without lister", method: http.MethodPost, path: "/admin/targets/data/rotate", statusCode: http.StatusAccepted, action: "rotate data"},
+		{name: "unknown target", method: http.MethodPost, path: "/admin/targets/other/rotate", statusCode: http.StatusNotFound},
+		{name: "no lister", method: http.MethodPost, path: "/admin/targets/data/list", statusCode: http.StatusConflict},
+		{name: "not running", method: http.MethodPost, path: "/admin/targets/infra/rotate", notRunning: true, statusCode: http.StatusServiceUnavailable},
+		{name: "unknown action", method: http.MethodPost, path: "/admin/targets/infra/delete", statusCode: http.StatusNotFound},
+		{name: "wrong method", method: http.MethodGet, path: "/admin/targets/infra/rotate", statusCode: http.StatusMethodNotAllowed},
+		{name: "state", method: http.MethodGet, path: "/admin/state", statusCode: http.StatusOK},
+		{name: "events", method: http.MethodGet, path: "/debug/events", statusCode: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controller := &fakeController{running: !tt.notRunning}
+			resp := serve(Handler(controller, testToken), tt.method, tt.path, testToken)
+			if resp.Code != tt.statusCode {
+				t.Fatalf("expected %d, got %d: %s", tt.statusCode, resp.Code, resp.Body.String())
+			}
+
+			if tt.action == "" {
+				if len(controller.actions) != 0 {
+					t.Fatalf("expected no action, got %v", controller.actions)
+				}
+				return
+			}
+			if len(controller.actions) != 1 || controller.actions[0] != tt.action {
+				t.Fatalf("expected the action %q, got %v", tt.action, controller.actions)
+			}
+			actionResp := actionResponse{}
+			if err := json.Unmarshal(resp.Body.Bytes(), &actionResp); err != nil {
+				t.Fatal(err)
+			}
+			if actionResp.Action == "" {
+				t.Fatalf("expected the requested action, got %s", resp.Body.String())
+			}
+		})
+	}
+}
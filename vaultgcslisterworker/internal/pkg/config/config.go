@@ -1,8 +1,11 @@
 package config
 
 import (
+	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/mitchellh/copystructure"
@@ -10,22 +13,181 @@ import (
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v3"
 
-	cermaFile "github.com/cermati/devops-toolkit/common-libs/toolkit-go/pkg/file"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/util/lease"
 )
 
+// EarlyRenewal is a duration such as 2m or a percentage of the TTL such as 25%
+type EarlyRenewal = lease.EarlyRenewal
+
 type ArgsConfig struct {
-	SecretsPath  string        `yaml:"secrets_path,omitempty"`
-	ProjectID    string        `yaml:"project_id,omitempty"`
-	Interval     time.Duration `yaml:"interval,omitempty"`
-	EarlyRenewal time.Duration `yaml:"early_renewal,omitempty"`
-	VaultConf    *VaultConfig  `yaml:"vault,omitempty"`
-	LogConf      *LogConfig    `yaml:"log,omitempty"`
-	TLSConf      *TLSConfig    `yaml:"tls,omitempty"`
+	SecretsPath  string          `yaml:"secrets_path,omitempty"`
+	ProjectID    string          `yaml:"project_id,omitempty"`
+	Interval     time.Duration   `yaml:"interval,omitempty"`
+	EarlyRenewal EarlyRenewal    `yaml:"early_renewal,omitempty"`
+	MinRemaining time.Duration   `yaml:"min_remaining,omitempty"`
+	KeyConf      *KeyConfig      `yaml:"key,omitempty"`
+	GCSConf      *GCSConfig      `yaml:"gcs,omitempty"`
+	SinkConfs    []*SinkConfig   `yaml:"sinks,omitempty"`
+	CredFileConf *CredFileConfig `yaml:"credentials_file,omitempty"`
+	Targets      []*TargetConfig `yaml:"targets,omitempty"`
+	VaultConf    *VaultConfig    `yaml:"vault,omitempty"`
+	HealthConf   *HealthConfig   `yaml:"health,omitempty"`
+	MetadataConf *MetadataConfig `yaml:"metadata,omitempty"`
+	AdminConf    *AdminConfig    `yaml:"admin,omitempty"`
+	TracingConf  *TracingConfig  `yaml:"tracing,omitempty"`
+	PersistConf  *PersistConfig  `yaml:"persistence,omitempty"`
+	CoordConf    *CoordConfig    `yaml:"coordination,omitempty"`
+	ScheduleConf *ScheduleConfig `yaml:"schedule,omitempty"`
+	LogConf      *LogConfig      `yaml:"log,omitempty"`
+	TLSConf      *TLSConfig      `yaml:"tls,omitempty"`
+}
+
+// TargetConfig is a GCP secrets path paired with the GCS project listed with
+// its keys. Empty fields fall back to the top level values.
+type TargetConfig struct {
+	ID           string          `yaml:"id,omitempty"`
+	SecretsPath  string          `yaml:"secrets_path,omitempty"`
+	ProjectID    string          `yaml:"project_id,omitempty"`
+	Interval     time.Duration   `yaml:"interval,omitempty"`
+	EarlyRenewal EarlyRenewal    `yaml:"early_renewal,omitempty"`
+	MinRemaining time.Duration   `yaml:"min_remaining,omitempty"`
+	KeyConf      *KeyConfig      `yaml:"key,omitempty"`
+	GCSConf      *GCSConfig      `yaml:"gcs,omitempty"`
+	SinkConfs    []*SinkConfig   `yaml:"sinks,omitempty"`
+	CredFileConf *CredFileConfig `yaml:"credentials_file,omitempty"`
+}
+
+// KeyConfig is the service account the leased keys must belong to, empty
+// fields are not checked
+type KeyConfig struct {
+	ClientEmail string `yaml:"client_email,omitempty"`
+	ProjectID   string `yaml:"project_id,omitempty"`
+}
+
+type GCSConfig struct {
+	Prefix   string `yaml:"prefix,omitempty"`
+	PageSize int    `yaml:"page_size,omitempty"`
+}
+
+// SinkConfig configures where the listing results of a target are written to
+type SinkConfig struct {
+	// Type is one of file, stdout or webhook
+	Type string `yaml:"type,omitempty"`
+
+	// file
+	Path       string `yaml:"path,omitempty"`
+	MaxSizeMB  int    `yaml:"max_size_mb,omitempty"`
+	MaxBackups int    `yaml:"max_backups,omitempty"`
+
+	// webhook
+	URL        string        `yaml:"url,omitempty"`
+	Secret     string        `yaml:"secret,omitempty"`
+	MaxRetries int           `yaml:"max_retries,omitempty"`
+	Timeout    time.Duration `yaml:"timeout,omitempty"`
+}
+
+// CredFileConfig configures the file the key of a target is written to for
+// GOOGLE_APPLICATION_CREDENTIALS consumers
+type CredFileConfig struct {
+	Path string `yaml:"path,omitempty"`
+	// Hook is a shell command run after every write of a new key
+	Hook        string        `yaml:"hook,omitempty"`
+	HookTimeout time.Duration `yaml:"hook_timeout,omitempty"`
 }
 
 type VaultConfig struct {
 	RoleName string `yaml:"role_name,omitempty"`
 	Address  string `yaml:"address,omitempty"`
+	// Client is hashicorp, or toolkit when built with the toolkit tag
+	Client string `yaml:"client,omitempty"`
+	// EarlyRenewal renews the token before it expires, MinRemaining is the
+	// lifetime it must have left
+	EarlyRenewal EarlyRenewal  `yaml:"early_renewal,omitempty"`
+	MinRemaining time.Duration `yaml:"min_remaining,omitempty"`
+}
+
+type HealthConfig struct {
+	// Address serves /healthz and /readyz, empty disables the server
+	Address string `yaml:"address,omitempty"`
+}
+
+// MetadataConfig configures the GCE metadata server emulation serving the key
+// of a target
+type MetadataConfig struct {
+	// Address serves the metadata endpoints, empty disables the server
+	Address string `yaml:"address,omitempty"`
+	// Target is the ID of the served target, the first target by default
+	Target string `yaml:"target,omitempty"`
+}
+
+// AdminConfig configures the admin API controlling the daemons at runtime
+type AdminConfig struct {
+	// Address serves the admin endpoints, empty disables the server
+	Address string `yaml:"address,omitempty"`
+	// Token is the bearer token required by every request, environment
+	// variables are expanded
+	Token string `yaml:"token,omitempty"`
+}
+
+// TracingConfig configures the OpenTelemetry tracing of the lease chain
+type TracingConfig struct {
+	// Exporter is otlp, file, or empty to disable tracing
+	Exporter string `yaml:"exporter,omitempty"`
+	// Endpoint is the base URL of the OTLP/HTTP receiver, e.g.
+	// http://localhost:4318
+	Endpoint string `yaml:"endpoint,omitempty"`
+	// Headers are sent with every OTLP request, environment variables are
+	// expanded in the values
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// Path is the file the file exporter appends to
+	Path        string  `yaml:"path,omitempty"`
+	ServiceName string  `yaml:"service_name,omitempty"`
+	SampleRatio float64 `yaml:"sample_ratio,omitempty"`
+}
+
+// PersistConfig configures the encrypted persistence of the current leases
+// across restarts
+type PersistConfig struct {
+	// Path is the directory of the lease files, empty disables persistence
+	Path string `yaml:"path,omitempty"`
+	// Passphrase encrypts the lease files, environment variables are
+	// expanded. Empty uses the TLS client key.
+	Passphrase string `yaml:"passphrase,omitempty"`
+}
+
+// CoordConfig configures the election of the replica fetching the keys
+type CoordConfig struct {
+	// Mode is kubernetes, file, or empty to let every replica fetch its own
+	// keys
+	Mode string `yaml:"mode,omitempty"`
+	// Identity names this replica, the hostname by default
+	Identity       string        `yaml:"identity,omitempty"`
+	LeaseName      string        `yaml:"lease_name,omitempty"`
+	LeaseNamespace string        `yaml:"lease_namespace,omitempty"`
+	LockPath       string        `yaml:"lock_path,omitempty"`
+	LeaseDuration  time.Duration `yaml:"lease_duration,omitempty"`
+	RetryPeriod    time.Duration `yaml:"retry_period,omitempty"`
+	// Address serves the keys to the followers over mTLS
+	Address string `yaml:"address,omitempty"`
+	// AdvertiseAddress is the URL the followers reach Address at,
+	// environment variables are expanded
+	AdvertiseAddress string `yaml:"advertise_address,omitempty"`
+}
+
+// ScheduleConfig staggers the renewals of replicas started together
+type ScheduleConfig struct {
+	// StartupJitter delays the start by a random duration up to it
+	StartupJitter time.Duration `yaml:"startup_jitter,omitempty"`
+	// RenewalWindow renews the leases at a random point of their TTL
+	RenewalWindow *RenewalWindowConfig `yaml:"renewal_window,omitempty"`
+}
+
+// RenewalWindowConfig is the part of the TTL of a lease it is renewed in, as
+// fractions of the TTL, e.g. 0.66 to 0.8. Zero values renew early_renewal
+// before the expiry instead.
+type RenewalWindowConfig struct {
+	From float64 `yaml:"from,omitempty"`
+	To   float64 `yaml:"to,omitempty"`
 }
 
 type LogConfig struct {
@@ -43,10 +205,54 @@ var defaultConfig = ArgsConfig{
 	SecretsPath:  "v1.1/cermati/infra/gcp-cermati/infrastructure-260106/key/cermati-infra-gcslister-gcslisterworker",
 	ProjectID:    "infrastructure-260106",
 	Interval:     1 * time.Minute,
-	EarlyRenewal: 2 * time.Minute,
+	EarlyRenewal: EarlyRenewal{Duration: 2 * time.Minute},
+	MinRemaining: 0,
+	GCSConf: &GCSConfig{
+		Prefix:   "",
+		PageSize: 100,
+	},
 	VaultConf: &VaultConfig{
 		Address:  "https://vault-test.cermati.com:9443",
 		RoleName: "cermati-infra-gcslister-gcslisterworker",
+		Client:   "hashicorp",
+		EarlyRenewal: EarlyRenewal{
+			Duration: 2 * time.Minute,
+		},
+		MinRemaining: 0,
+	},
+	HealthConf: &HealthConfig{
+		Address: ":8080",
+	},
+	MetadataConf: &MetadataConfig{
+		Address: "",
+		Target:  "",
+	},
+	AdminConf: &AdminConfig{
+		Address: "",
+		Token:   "",
+	},
+	TracingConf: &TracingConfig{
+		Exporter:    "",
+		ServiceName: "vault-gcs-lister",
+		SampleRatio: 1,
+	},
+	PersistConf: &PersistConfig{
+		Path:       "",
+		Passphrase: "",
+	},
+	CoordConf: &CoordConfig{
+		Mode:          "",
+		LeaseName:     "vault-gcs-lister",
+		LeaseDuration: 15 * time.Second,
+		RetryPeriod:   2 * time.Second,
+		Address:       ":8443",
+	},
+	ScheduleConf: &ScheduleConfig{
+		StartupJitter: 0,
+		RenewalWindow: &RenewalWindowConfig{
+			From: 0,
+			To:   0,
+		},
 	},
 	LogConf: &LogConfig{
 		Level:  "debug",
@@ -59,13 +265,81 @@ var defaultConfig = ArgsConfig{
 	},
 }
 
-func ValidateFilePathValue(path string) (string, error) {
+// GetTargets returns the configured targets with their empty fields filled
+// from the top level values. Without any configured target, a single target
+// is built from the top level values.
+func (cfg *ArgsConfig) GetTargets() []*TargetConfig {
+	if len(cfg.Targets) == 0 {
+		return []*TargetConfig{
+			{
+				ID:           "01",
+				SecretsPath:  cfg.SecretsPath,
+				ProjectID:    cfg.ProjectID,
+				Interval:     cfg.Interval,
+				EarlyRenewal: cfg.EarlyRenewal,
+				MinRemaining: cfg.MinRemaining,
+				KeyConf:      cfg.KeyConf,
+				GCSConf:      cfg.GCSConf,
+				SinkConfs:    cfg.SinkConfs,
+				CredFileConf: cfg.CredFileConf,
+			},
+		}
+	}
+
+	targets := make([]*TargetConfig, 0, len(cfg.Targets))
+	for idx, target := range cfg.Targets {
+		filled := *target
+		if filled.ID == "" {
+			filled.ID = fmt.Sprintf("%02d", idx+1)
+		}
+		if filled.SecretsPath == "" {
+			filled.SecretsPath = cfg.SecretsPath
+		}
+		if filled.ProjectID == "" {
+			filled.ProjectID = cfg.ProjectID
+		}
+		if filled.Interval == 0 {
+			filled.Interval = cfg.Interval
+		}
+		if filled.EarlyRenewal.IsZero() {
+			filled.EarlyRenewal = cfg.EarlyRenewal
+		}
+		if filled.MinRemaining == 0 {
+			filled.MinRemaining = cfg.MinRemaining
+		}
+		if filled.KeyConf == nil {
+			filled.KeyConf = cfg.KeyConf
+		}
+		if filled.GCSConf == nil {
+			filled.GCSConf = cfg.GCSConf
+		}
+		if filled.SinkConfs == nil {
+			filled.SinkConfs = cfg.SinkConfs
+		}
+		if filled.CredFileConf == nil {
+			filled.CredFileConf = cfg.CredFileConf
+		}
+		targets = append(targets, &filled)
+	}
+	return targets
+}
+
+// ExpandPath expands the environment variables and the home directory in path
+func ExpandPath(path string) (string, error) {
 	expandedPath, err := homedir.Expand(os.ExpandEnv(path))
 	if err != nil {
 		return "", errors.Wrapf(err, "invalid path")
 	}
+	return expandedPath, nil
+}
+
+func ValidateFilePathValue(path string) (string, error) {
+	expandedPath, err := ExpandPath(path)
+	if err != nil {
+		return "", err
+	}
 
-	if !cermaFile.IsFileExists(expandedPath) {
+	if info, err := os.Stat(expandedPath); err != nil || info.IsDir() {
 		return "", errors.Errorf("file not found in %s", expandedPath)
 	}
 	return expandedPath, nil
@@ -93,3 +367,202 @@ func LoadFromFile(configFile string) *ArgsConfig {
 
 	return &cfg
 }
+
+// Validate checks the config for mistakes that can be found without contacting
+// Vault, it returns every mistake found
+func (cfg *ArgsConfig) Validate() []error {
+	var errs []error
+
+	if cfg.VaultConf.Address == "" {
+		errs = append(errs, errors.New("vault.address is empty"))
+	} else if _, err := url.Parse(cfg.VaultConf.Address); err != nil {
+		errs = append(errs, errors.Wrap(err, "invalid vault.address"))
+	}
+
+	if cfg.VaultConf.RoleName == "" {
+		errs = append(errs, errors.New("vault.role_name is empty"))
+	}
+
+	switch cfg.VaultConf.Client {
+	case "", "hashicorp", "toolkit":
+	default:
+		errs = append(errs, errors.Errorf("unknown vault.client %q", cfg.VaultConf.Client))
+	}
+
+	if err := cfg.VaultConf.EarlyRenewal.Validate(); err != nil {
+		errs = append(errs, errors.Wrap(err, "invalid vault.early_renewal"))
+	}
+
+	if cfg.VaultConf.MinRemaining < 0 {
+		errs = append(errs, errors.New("vault.min_remaining must not be negative"))
+	}
+
+	switch cfg.LogConf.Level {
+	case "debug", "info", "warning", "error":
+	default:
+		errs = append(errs, errors.Errorf("unknown log.level %q", cfg.LogConf.Level))
+	}
+
+	switch cfg.LogConf.Format {
+	case "text", "json":
+	default:
+		errs = append(errs, errors.Errorf("unknown log.format %q", cfg.LogConf.Format))
+	}
+
+	targetIDs := map[string]bool{}
+	credFilePaths := map[string]string{}
+	for _, target := range cfg.GetTargets() {
+		if targetIDs[target.ID] {
+			errs = append(errs, errors.Errorf("duplicate target %s", target.ID))
+		}
+		targetIDs[target.ID] = true
+
+		if target.CredFileConf != nil && target.CredFileConf.Path != "" {
+			if otherID, ok := credFilePaths[target.CredFileConf.Path]; ok {
+				errs = append(errs, errors.Errorf(
+					"targets %s and %s write the same credentials_file %s",
+					otherID, target.ID, target.CredFileConf.Path,
+				))
+			}
+			credFilePaths[target.CredFileConf.Path] = target.ID
+		}
+
+		for _, err := range target.validate() {
+			errs = append(errs, errors.Wrapf(err, "target %s", target.ID))
+		}
+	}
+
+	if cfg.MetadataConf.Address != "" && cfg.MetadataConf.Target != "" && !targetIDs[cfg.MetadataConf.Target] {
+		errs = append(errs, errors.Errorf("metadata.target %s is not a target", cfg.MetadataConf.Target))
+	}
+
+	if cfg.AdminConf.Address != "" && os.ExpandEnv(cfg.AdminConf.Token) == "" {
+		errs = append(errs, errors.New("admin.token is empty while admin.address is set"))
+	}
+
+	switch cfg.TracingConf.Exporter {
+	case "":
+	case "otlp":
+		if endpoint, err := url.Parse(cfg.TracingConf.Endpoint); err != nil || !endpoint.IsAbs() {
+			errs = append(errs, errors.Errorf("tracing.endpoint %q is not an absolute URL", cfg.TracingConf.Endpoint))
+		}
+	case "file":
+		if cfg.TracingConf.Path == "" {
+			errs = append(errs, errors.New("tracing.path is empty"))
+		}
+	default:
+		errs = append(errs, errors.Errorf("unknown tracing.exporter %q", cfg.TracingConf.Exporter))
+	}
+
+	if cfg.TracingConf.SampleRatio < 0 || cfg.TracingConf.SampleRatio > 1 {
+		errs = append(errs, errors.Errorf("tracing.sample_ratio %v is not between 0 and 1", cfg.TracingConf.SampleRatio))
+	}
+
+	if cfg.PersistConf.Path != "" && os.ExpandEnv(cfg.PersistConf.Passphrase) == "" && cfg.TLSConf.KeyPath == "" {
+		errs = append(errs, errors.New("persistence.passphrase and tls.key are empty while persistence.path is set"))
+	}
+
+	switch cfg.CoordConf.Mode {
+	case "":
+	case "kubernetes", "file":
+		if cfg.CoordConf.Mode == "kubernetes" && cfg.CoordConf.LeaseName == "" {
+			errs = append(errs, errors.New("coordination.lease_name is empty"))
+		}
+		if cfg.CoordConf.Mode == "file" && cfg.CoordConf.LockPath == "" {
+			errs = append(errs, errors.New("coordination.lock_path is empty"))
+		}
+		if cfg.CoordConf.Address == "" {
+			errs = append(errs, errors.New("coordination.address is empty"))
+		}
+		if advertise, err := url.Parse(os.ExpandEnv(cfg.CoordConf.AdvertiseAddress)); err != nil || advertise.Scheme != "https" || advertise.Host == "" {
+			errs = append(errs, errors.Errorf("coordination.advertise_address %q is not an https URL", cfg.CoordConf.AdvertiseAddress))
+		}
+		if cfg.CoordConf.RetryPeriod >= cfg.CoordConf.LeaseDuration {
+			errs = append(errs, errors.New("coordination.retry_period must be shorter than coordination.lease_duration"))
+		}
+	default:
+		errs = append(errs, errors.Errorf("unknown coordination.mode %q", cfg.CoordConf.Mode))
+	}
+
+	if cfg.ScheduleConf.StartupJitter < 0 {
+		errs = append(errs, errors.New("schedule.startup_jitter must not be negative"))
+	}
+
+	if window := cfg.ScheduleConf.RenewalWindow; window.From != 0 || window.To != 0 {
+		if window.From <= 0 || window.From > window.To || window.To >= 1 {
+			errs = append(errs, errors.Errorf("schedule.renewal_window %v-%v must satisfy 0 < from <= to < 1", window.From, window.To))
+		}
+	}
+
+	return errs
+}
+
+func (target *TargetConfig) validate() []error {
+	var errs []error
+
+	if target.SecretsPath == "" {
+		errs = append(errs, errors.New("secrets_path is empty"))
+	}
+
+	if target.ProjectID == "" {
+		errs = append(errs, errors.New("project_id is empty"))
+	}
+
+	if target.Interval <= 0 {
+		errs = append(errs, errors.New("interval must be positive"))
+	}
+
+	if err := target.EarlyRenewal.Validate(); err != nil {
+		errs = append(errs, errors.Wrap(err, "invalid early_renewal"))
+	}
+
+	if target.MinRemaining < 0 {
+		errs = append(errs, errors.New("min_remaining must not be negative"))
+	}
+
+	if target.KeyConf != nil && target.KeyConf.ClientEmail != "" && !strings.Contains(target.KeyConf.ClientEmail, "@") {
+		errs = append(errs, errors.Errorf("key.client_email %q is not an email", target.KeyConf.ClientEmail))
+	}
+
+	if target.CredFileConf != nil {
+		if target.CredFileConf.Path == "" && target.CredFileConf.Hook != "" {
+			errs = append(errs, errors.New("credentials_file.hook is set without credentials_file.path"))
+		}
+		if target.CredFileConf.HookTimeout < 0 {
+			errs = append(errs, errors.New("credentials_file.hook_timeout must not be negative"))
+		}
+	}
+
+	if target.GCSConf != nil && target.GCSConf.PageSize < 0 {
+		errs = append(errs, errors.New("gcs.page_size must not be negative"))
+	}
+
+	for idx, sinkConf := range target.SinkConfs {
+		if err := sinkConf.validate(); err != nil {
+			errs = append(errs, errors.Wrapf(err, "sink %d", idx))
+		}
+	}
+
+	return errs
+}
+
+func (sinkConf *SinkConfig) validate() error {
+	switch sinkConf.Type {
+	case "file":
+		if sinkConf.Path == "" {
+			return errors.New("file sink path is empty")
+		}
+	case "stdout":
+	case "webhook":
+		webhookURL, err := url.Parse(sinkConf.URL)
+		if err != nil {
+			return errors.Wrap(err, "invalid webhook sink url")
+		}
+		if webhookURL.Scheme != "http" && webhookURL.Scheme != "https" {
+			return errors.Errorf("webhook sink url %q is not http(s)", sinkConf.URL)
+		}
+	default:
+		return errors.Errorf("unknown sink type %q", sinkConf.Type)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package coordination
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/health"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/history"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/log"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/util/errclass"
+)
+
+const (
+	component = "coordination"
+
+	DefaultLeaseDuration time.Duration = 15 * time.Second
+	DefaultRetryPeriod   time.Duration = 2 * time.Second
+)
+
+// Record identifies the holder of the leadership and where the followers
+// fetch the keys from
+type Record struct {
+	Identity string `json:"identity"`
+	Address  string `json:"address"`
+}
+
+// Lock is the lock shared by the replicas, held by the leader
+type Lock interface {
+	// Acquire takes the lock for record, or renews it if record already holds
+	// it. It returns whether record holds the lock and the current holder,
+	// whose identity is empty if the lock is free.
+	Acquire(ctx context.Context, record Record) (bool, Record, error)
+	// Release frees the lock if record holds it
+	Release(ctx context.Context, record Record) error
+}
+
+// Elector campaigns for the leadership among the replicas, only the leader
+// fetches the keys from Vault
+type Elector struct {
+	lock          Lock
+	record        Record
+	leaseDuration time.Duration
+	retryPeriod   time.Duration
+	status        *health.Status
+	events        *history.Buffer
+
+	mutex     sync.RWMutex
+	leader    bool
+	holder    Record
+	renewedAt time.Time
+}
+
+// NewElector campaigns with record as the identity and address of this
+// replica. The leader steps down once it fails to renew the lock for
+// leaseDuration. Its status is kept in registry and its elections are recorded
+// in events.
+func NewElector(lock Lock, record Record, leaseDuration, retryPeriod time.Duration, registry *health.Registry, events *history.Buffer) *Elector {
+	if leaseDuration <= 0 {
+		leaseDuration = DefaultLeaseDuration
+	}
+	if retryPeriod <= 0 {
+		retryPeriod = DefaultRetryPeriod
+	}
+
+	return &Elector{
+		lock:          lock,
+		record:        record,
+		leaseDuration: leaseDuration,
+		retryPeriod:   retryPeriod,
+		status:        registry.Register(component),
+		events:        events,
+	}
+}
+
+// Run campaigns every retry period until ctx is done, then releases the lock
+// if this replica is the leader
+func (e *Elector) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.retryPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			e.release()
+			return
+		case <-ticker.C:
+			e.Campaign(ctx)
+		}
+	}
+}
+
+// Campaign runs a single round of the election, the chain runs one before
+// starting its daemons so they know whether to fetch from Vault
+func (e *Elector) Campaign(ctx context.Context) {
+	held, holder, err := e.lock.Acquire(ctx, e.record)
+	if err != nil {
+		e.status.SetRetrying(string(errclass.Transient), err, 0)
+		log.Logger.Sugar().Warnw("Failed to campaign for the leadership", "identity", e.record.Identity, "err", err)
+
+		// Without a renewal another replica may take the lock once it
+		// expires, the leader steps down before that can happen
+		e.mutex.RLock()
+		expired := e.leader && time.Since(e.renewedAt) >= e.leaseDuration
+		e.mutex.RUnlock()
+		if expired {
+			e.setLeader(false, Record{})
+		}
+		return
+	}
+
+	e.status.SetHealthy()
+	e.status.SetNextRun(time.Now().Add(e.retryPeriod))
+	e.setLeader(held, holder)
+}
+
+// IsLeader reports whether this replica fetches the keys from Vault
+func (e *Elector) IsLeader() bool {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	return e.leader
+}
+
+// Leader returns the current leader, its identity is empty if unknown
+func (e *Elector) Leader() Record {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	return e.holder
+}
+
+// Identity returns the identity and address of this replica
+func (e *Elector) Identity() Record {
+	return e.record
+}
+
+func (e *Elector) setLeader(leader bool, holder Record) {
+	e.mutex.Lock()
+	wasLeader := e.leader
+	previous := e.holder
+	e.leader = leader
+	e.holder = holder
+	if leader {
+		e.renewedAt = time.Now()
+	}
+	e.mutex.Unlock()
+
+	switch {
+	case leader && !wasLeader:
+		log.Logger.Sugar().Infow("Elected leader, fetching the keys from Vault", "identity", e.record.Identity)
+		e.events.Record(component, history.LeaderElected, "Elected leader", "identity", e.record.Identity)
+	case !leader && wasLeader:
+		log.Logger.Sugar().Warnw("Lost the leadership", "identity", e.record.Identity, "leader", holder.Identity)
+		e.events.Record(component, history.LeaderLost, "Lost the leadership", "identity", e.record.Identity, "leader", holder.Identity)
+	case !leader && holder.Identity != previous.Identity:
+		log.Logger.Sugar().Infow("Following leader", "leader", holder.Identity, "leader_address", holder.Address)
+	}
+}
+
+func (e *Elector) release() {
+	if !e.IsLeader() {
+		return
+	}
+
+	// The context of the chain is done, the release gets its own deadline
+	ctx, cancel := context.WithTimeout(context.Background(), e.retryPeriod)
+	defer cancel()
+
+	if err := e.lock.Release(ctx, e.record); err != nil {
+		log.Logger.Sugar().Warnw("Failed to release the leadership", "identity", e.record.Identity, "err", err)
+		return
+	}
+
+	e.mutex.Lock()
+	e.leader = false
+	e.holder = Record{}
+	e.mutex.Unlock()
+	log.Logger.Sugar().Infow("Released the leadership", "identity", e.record.Identity)
+}
@@ -0,0 +1,103 @@
+package coordination
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/health"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/history"
+)
+
+// memoryLock is held by the first record acquiring it, or by holder, and
+// fails every Acquire while failing is set
+type memoryLock struct {
+	mutex   sync.Mutex
+	holder  Record
+	failing bool
+}
+
+func (ml *memoryLock) Acquire(ctx context.Context, record Record) (bool, Record, error) {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	if ml.failing {
+		return false, Record{}, errors.New("lock unreachable")
+	}
+	if ml.holder.Identity == "" {
+		ml.holder = record
+	}
+	return ml.holder.Identity == record.Identity, ml.holder, nil
+}
+
+func (ml *memoryLock) Release(ctx context.Context, record Record) error {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	if ml.holder.Identity == record.Identity {
+		ml.holder = Record{}
+	}
+	return nil
+}
+
+func (ml *memoryLock) setFailing(failing bool) {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	ml.failing = failing
+}
+
+func newTestElector(lock Lock, identity string, leaseDuration time.Duration) *Elector {
+	return NewElector(
+		lock,
+		Record{Identity: identity, Address: "https://" + identity + ":8443"},
+		leaseDuration,
+		leaseDuration/10,
+		health.NewRegistry(),
+		history.NewBuffer(history.DefaultCapacity),
+	)
+}
+
+func TestLeaderStepsDown(t *testing.T) {
+	lock := &memoryLock{}
+	elector := newTestElector(lock, "leader", 200*time.Millisecond)
+	events := elector.events
+	ctx := context.Background()
+
+	elector.Campaign(ctx)
+	if !elector.IsLeader() {
+		t.Fatal("expected to lead")
+	}
+
+	// A failed renewal within the lease duration keeps the leadership
+	lock.setFailing(true)
+	elector.Campaign(ctx)
+	if !elector.IsLeader() {
+		t.Fatal("a single failed renewal must not step down")
+	}
+
+	// Once the lease may have expired another replica may lead
+	time.Sleep(250 * time.Millisecond)
+	elector.Campaign(ctx)
+	if elector.IsLeader() {
+		t.Fatal("expected the leader to step down once its lease expired")
+	}
+
+	var kinds []history.Kind
+	for _, event := range events.Events(history.Filter{}) {
+		kinds = append(kinds, event.Kind)
+	}
+	if len(kinds) != 2 || kinds[0] != history.LeaderElected || kinds[1] != history.LeaderLost {
+		t.Fatalf("expected the election and the loss of the leadership, got %v", kinds)
+	}
+
+	// The lock is back, the replica leads again
+	lock.setFailing(false)
+	elector.Campaign(ctx)
+	if !elector.IsLeader() {
+		t.Fatal("expected to lead again")
+	}
+}
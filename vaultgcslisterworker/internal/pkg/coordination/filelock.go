@@ -0,0 +1,112 @@
+package coordination
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// FileLock is an exclusive lock on a file for replicas on the same host,
+// e.g. for local testing. The leader holds the lock for as long as it runs
+// and writes its record into the file, the lock is freed by the OS when the
+// leader dies.
+type FileLock struct {
+	path string
+
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func NewFileLock(path string) (*FileLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, errors.Wrap(err, "failed to create lock file directory")
+	}
+	return &FileLock{path: path}, nil
+}
+
+func (fl *FileLock) Acquire(ctx context.Context, record Record) (bool, Record, error) {
+	fl.mutex.Lock()
+	defer fl.mutex.Unlock()
+
+	if fl.file != nil {
+		return true, record, nil
+	}
+
+	file, err := os.OpenFile(fl.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return false, Record{}, errors.Wrap(err, "failed to open lock file")
+	}
+
+	locked, err := tryLockFile(file)
+	if err != nil || !locked {
+		file.Close()
+		if err != nil {
+			return false, Record{}, err
+		}
+
+		holder, err := readRecord(fl.path)
+		return false, holder, err
+	}
+
+	if err := writeRecord(file, record); err != nil {
+		unlockFile(file)
+		file.Close()
+		return false, Record{}, err
+	}
+	fl.file = file
+	return true, record, nil
+}
+
+func (fl *FileLock) Release(ctx context.Context, record Record) error {
+	fl.mutex.Lock()
+	defer fl.mutex.Unlock()
+
+	if fl.file == nil {
+		return nil
+	}
+
+	// The record is cleared while the file is still locked, so followers
+	// never read a stale leader
+	fl.file.Truncate(0)
+	err := unlockFile(fl.file)
+	fl.file.Close()
+	fl.file = nil
+	return err
+}
+
+func writeRecord(file *os.File, record Record) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode lock record")
+	}
+	if err := file.Truncate(0); err != nil {
+		return errors.Wrap(err, "failed to truncate lock file")
+	}
+	if _, err := file.WriteAt(body, 0); err != nil {
+		return errors.Wrap(err, "failed to write lock file")
+	}
+	return file.Sync()
+}
+
+// readRecord reads the record of the leader, it is empty while the leader
+// is still writing it
+func readRecord(path string) (Record, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Record{}, errors.Wrap(err, "failed to read lock file")
+	}
+
+	record := Record{}
+	if len(body) == 0 {
+		return record, nil
+	}
+	if err := json.Unmarshal(body, &record); err != nil {
+		return Record{}, nil
+	}
+	return record, nil
+}
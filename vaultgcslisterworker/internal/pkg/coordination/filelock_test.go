@@ -0,0 +1,63 @@
+//go:build !windows
+// +build !windows
+
+package coordination
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileLockFailover(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), "leader", "lock")
+	newLock := func() Lock {
+		lock, err := NewFileLock(lockPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lock
+	}
+
+	first := newTestElector(newLock(), "first", time.Second)
+	second := newTestElector(newLock(), "second", time.Second)
+	ctx := context.Background()
+
+	first.Campaign(ctx)
+	second.Campaign(ctx)
+	if !first.IsLeader() || second.IsLeader() {
+		t.Fatalf("expected first to lead, first %v second %v", first.IsLeader(), second.IsLeader())
+	}
+	if leader := second.Leader(); leader != first.Identity() {
+		t.Fatalf("expected second to follow first, got %+v", leader)
+	}
+
+	// Renewing the leadership keeps it
+	first.Campaign(ctx)
+	second.Campaign(ctx)
+	if !first.IsLeader() || second.IsLeader() {
+		t.Fatal("the leadership must stay with first")
+	}
+
+	// The leader releases the lock once it stops, the follower takes over
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan bool)
+	go func() {
+		first.Run(runCtx)
+		close(done)
+	}()
+	cancel()
+	<-done
+	if first.IsLeader() {
+		t.Fatal("first must release the leadership once stopped")
+	}
+
+	second.Campaign(ctx)
+	if !second.IsLeader() {
+		t.Fatal("expected second to take over")
+	}
+	if leader := second.Leader(); leader != second.Identity() {
+		t.Fatalf("expected second as leader, got %+v", leader)
+	}
+}
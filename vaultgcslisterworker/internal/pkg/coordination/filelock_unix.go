@@ -0,0 +1,29 @@
+//go:build !windows
+// +build !windows
+
+package coordination
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+func tryLockFile(file *os.File) (bool, error) {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "failed to lock file")
+	}
+	return true, nil
+}
+
+func unlockFile(file *os.File) error {
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_UN); err != nil {
+		return errors.Wrap(err, "failed to unlock file")
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build windows
+// +build windows
+
+package coordination
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+func tryLockFile(file *os.File) (bool, error) {
+	return false, errors.New("the file lock is not supported on Windows")
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
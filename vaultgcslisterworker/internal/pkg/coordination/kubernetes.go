@@ -0,0 +1,298 @@
+package coordination
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	addressAnnotation = "vault-gcs-lister/leader-address"
+	microTimeFormat   = "2006-01-02T15:04:05.000000Z07:00"
+	kubernetesTimeout = 10 * time.Second
+)
+
+// The Lease object of coordination.k8s.io/v1, only the fields the lock uses
+// and the labels and annotations it must not drop on update
+type kubernetesLease struct {
+	APIVersion string               `json:"apiVersion"`
+	Kind       string               `json:"kind"`
+	Metadata   kubernetesObjectMeta `json:"metadata"`
+	Spec       kubernetesLeaseSpec  `json:"spec"`
+}
+
+type kubernetesObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+type kubernetesLeaseSpec struct {
+	HolderIdentity       *string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds *int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          *string `json:"acquireTime,omitempty"`
+	RenewTime            *string `json:"renewTime,omitempty"`
+	LeaseTransitions     *int    `json:"leaseTransitions,omitempty"`
+}
+
+// KubernetesLock is a Lease object of the Kubernetes API, reached with the
+// service account of the pod. A lease is taken over once its holder has not
+// renewed it for its duration, as observed by this replica so clock skew
+// between the nodes does not matter.
+type KubernetesLock struct {
+	name          string
+	namespace     string
+	baseURL       string
+	tokenPath     string
+	leaseDuration time.Duration
+	client        *http.Client
+
+	observedRecord string
+	observedAt     time.Time
+}
+
+// NewKubernetesLock uses the Lease name in namespace, the namespace of the
+// pod if empty
+func NewKubernetesLock(name, namespace string, leaseDuration time.Duration) (*KubernetesLock, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set, the worker does not run in a pod")
+	}
+
+	if namespace == "" {
+		namespaceBytes, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read the namespace of the pod")
+		}
+		namespace = strings.TrimSpace(string(namespaceBytes))
+	}
+
+	caCert, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the Kubernetes CA cert")
+	}
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(caCert) {
+		return nil, errors.New("invalid Kubernetes CA cert")
+	}
+
+	if leaseDuration <= 0 {
+		leaseDuration = DefaultLeaseDuration
+	}
+
+	return &KubernetesLock{
+		name:          name,
+		namespace:     namespace,
+		baseURL:       "https://" + net.JoinHostPort(host, port),
+		tokenPath:     filepath.Join(serviceAccountDir, "token"),
+		leaseDuration: leaseDuration,
+		client: &http.Client{
+			Timeout: kubernetesTimeout,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: caPool},
+			},
+		},
+	}, nil
+}
+
+func (kl *KubernetesLock) Acquire(ctx context.Context, record Record) (bool, Record, error) {
+	now := time.Now()
+	lease := &kubernetesLease{}
+	statusCode, err := kl.do(ctx, http.MethodGet, kl.leaseURL(), nil, lease)
+	if err != nil {
+		return false, Record{}, err
+	}
+
+	if statusCode == http.StatusNotFound {
+		lease = &kubernetesLease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   kubernetesObjectMeta{Name: kl.name, Namespace: kl.namespace},
+		}
+		kl.hold(lease, record, now)
+
+		statusCode, err := kl.do(ctx, http.MethodPost, kl.leasesURL(), lease, nil)
+		if err != nil {
+			return false, Record{}, err
+		}
+		// Another replica created the lease first
+		if statusCode == http.StatusConflict {
+			return false, Record{}, nil
+		}
+		kl.observe(lease, now)
+		return true, record, nil
+	}
+
+	holder := leaseHolder(lease)
+	kl.observe(lease, now)
+
+	duration := kl.leaseDuration
+	if lease.Spec.LeaseDurationSeconds != nil {
+		duration = time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+	}
+	if holder.Identity != "" && holder.Identity != record.Identity && now.Before(kl.observedAt.Add(duration)) {
+		return false, holder, nil
+	}
+
+	kl.hold(lease, record, now)
+	statusCode, err = kl.do(ctx, http.MethodPut, kl.leaseURL(), lease, nil)
+	if err != nil {
+		return false, Record{}, err
+	}
+	// The lease changed since it was read, e.g. another replica took it
+	if statusCode == http.StatusConflict {
+		return false, holder, nil
+	}
+	kl.observe(lease, now)
+	return true, record, nil
+}
+
+func (kl *KubernetesLock) Release(ctx context.Context, record Record) error {
+	lease := &kubernetesLease{}
+	statusCode, err := kl.do(ctx, http.MethodGet, kl.leaseURL(), nil, lease)
+	if err != nil {
+		return err
+	}
+	if statusCode == http.StatusNotFound || leaseHolder(lease).Identity != record.Identity {
+		return nil
+	}
+
+	// An empty holder lets the next replica take the lease right away
+	empty := ""
+	renewTime := time.Now().Format(microTimeFormat)
+	lease.Spec.HolderIdentity = &empty
+	lease.Spec.RenewTime = &renewTime
+	delete(lease.Metadata.Annotations, addressAnnotation)
+
+	if _, err := kl.do(ctx, http.MethodPut, kl.leaseURL(), lease, nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+// hold makes record the holder of lease, counting a transition if it was
+// held by another replica
+func (kl *KubernetesLock) hold(lease *kubernetesLease, record Record, now time.Time) {
+	nowStr := now.Format(microTimeFormat)
+	durationSeconds := int(kl.leaseDuration / time.Second)
+	if durationSeconds < 1 {
+		durationSeconds = 1
+	}
+
+	if leaseHolder(lease).Identity != record.Identity {
+		transitions := 0
+		if lease.Spec.LeaseTransitions != nil {
+			transitions = *lease.Spec.LeaseTransitions + 1
+		}
+		identity := record.Identity
+		lease.Spec.HolderIdentity = &identity
+		lease.Spec.AcquireTime = &nowStr
+		lease.Spec.LeaseTransitions = &transitions
+	}
+	lease.Spec.RenewTime = &nowStr
+	lease.Spec.LeaseDurationSeconds = &durationSeconds
+
+	if lease.Metadata.Annotations == nil {
+		lease.Metadata.Annotations = map[string]string{}
+	}
+	lease.Metadata.Annotations[addressAnnotation] = record.Address
+}
+
+// observe notes when this replica saw the lease change
+func (kl *KubernetesLock) observe(lease *kubernetesLease, now time.Time) {
+	renewTime := ""
+	if lease.Spec.RenewTime != nil {
+		renewTime = *lease.Spec.RenewTime
+	}
+
+	observedRecord := leaseHolder(lease).Identity + "/" + renewTime
+	if observedRecord != kl.observedRecord {
+		kl.observedRecord = observedRecord
+		kl.observedAt = now
+	}
+}
+
+func leaseHolder(lease *kubernetesLease) Record {
+	holder := Record{Address: lease.Metadata.Annotations[addressAnnotation]}
+	if lease.Spec.HolderIdentity != nil {
+		holder.Identity = *lease.Spec.HolderIdentity
+	}
+	return holder
+}
+
+func (kl *KubernetesLock) leasesURL() string {
+	return fmt.Sprintf("%s/apis/coordination.k8s.io/v1/namespaces/%s/leases", kl.baseURL, kl.namespace)
+}
+
+func (kl *KubernetesLock) leaseURL() string {
+	return kl.leasesURL() + "/" + kl.name
+}
+
+// do sends a request to the Kubernetes API and decodes a successful answer
+// into out. Not found and conflict are returned as status codes, other
+// failures as errors.
+func (kl *KubernetesLock) do(ctx context.Context, method, url string, in, out interface{}) (int, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return 0, errors.Wrap(err, "failed to encode lease")
+		}
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, errors.Wrap(err, "invalid Kubernetes API request")
+	}
+	req = req.WithContext(ctx)
+
+	// The projected service account token is rotated, it is read every time
+	token, err := ioutil.ReadFile(kl.tokenPath)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read the service account token")
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := kl.client.Do(req)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to reach the Kubernetes API")
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound, resp.StatusCode == http.StatusConflict:
+		return resp.StatusCode, nil
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		status := struct {
+			Message string `json:"message"`
+		}{}
+		json.NewDecoder(resp.Body).Decode(&status)
+		return resp.StatusCode, errors.Errorf("the Kubernetes API answered %s to %s %s: %s", resp.Status, method, url, status.Message)
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, errors.Wrap(err, "invalid lease")
+		}
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,236 @@
+package coordination
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testNamespace = "lister"
+	testLeaseName = "vault-gcs-lister"
+	testLeasesURL = "/apis/coordination.k8s.io/v1/namespaces/" + testNamespace + "/leases"
+)
+
+// fakeKubernetes serves the Lease API of the Kubernetes API server, it
+// rejects the update of a stale resource version like the real one
+type fakeKubernetes struct {
+	*httptest.Server
+	t *testing.T
+
+	mutex   sync.Mutex
+	lease   *kubernetesLease
+	version int
+}
+
+func newFakeKubernetes(t *testing.T) *fakeKubernetes {
+	fk := &fakeKubernetes{t: t}
+	fk.Server = httptest.NewTLSServer(http.HandlerFunc(fk.serve))
+	t.Cleanup(fk.Close)
+	return fk
+}
+
+func (fk *fakeKubernetes) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer service-account-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	fk.mutex.Lock()
+	defer fk.mutex.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == testLeasesURL+"/"+testLeaseName:
+		if fk.lease == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(fk.lease)
+	case r.Method == http.MethodPost && r.URL.Path == testLeasesURL:
+		if fk.lease != nil {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		fk.store(w, r)
+	case r.Method == http.MethodPut && r.URL.Path == testLeasesURL+"/"+testLeaseName:
+		fk.store(w, r)
+	default:
+		fk.t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (fk *fakeKubernetes) store(w http.ResponseWriter, r *http.Request) {
+	lease := &kubernetesLease{}
+	if err := json.NewDecoder(r.Body).Decode(lease); err != nil {
+		fk.t.Errorf("invalid lease: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if fk.lease != nil && lease.Metadata.ResourceVersion != fk.lease.Metadata.ResourceVersion {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	fk.version++
+	lease.Metadata.ResourceVersion = strconv.Itoa(fk.version)
+	fk.lease = lease
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(lease)
+}
+
+// holder returns the holder of the stored lease and its transitions
+func (fk *fakeKubernetes) holder() (Record, int) {
+	fk.mutex.Lock()
+	defer fk.mutex.Unlock()
+
+	if fk.lease == nil {
+		return Record{}, 0
+	}
+	transitions := 0
+	if fk.lease.Spec.LeaseTransitions != nil {
+		transitions = *fk.lease.Spec.LeaseTransitions
+	}
+	return leaseHolder(fk.lease), transitions
+}
+
+// bumpVersion changes the resource version as a concurrent update would
+func (fk *fakeKubernetes) bumpVersion() {
+	fk.mutex.Lock()
+	defer fk.mutex.Unlock()
+
+	fk.version++
+	fk.lease.Metadata.ResourceVersion = strconv.Itoa(fk.version)
+}
+
+func newTestKubernetesLock(t *testing.T, fk *fakeKubernetes, leaseDuration time.Duration) *KubernetesLock {
+	t.Helper()
+
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenPath, []byte("service-account-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return &KubernetesLock{
+		name:          testLeaseName,
+		namespace:     testNamespace,
+		baseURL:       fk.URL,
+		tokenPath:     tokenPath,
+		leaseDuration: leaseDuration,
+		client:        fk.Client(),
+	}
+}
+
+func TestKubernetesLockFailover(t *testing.T) {
+	fk := newFakeKubernetes(t)
+	first := Record{Identity: "first", Address: "https://10.0.0.1:8443"}
+	second := Record{Identity: "second", Address: "https://10.0.0.2:8443"}
+	firstLock := newTestKubernetesLock(t, fk, time.Second)
+	secondLock := newTestKubernetesLock(t, fk, time.Second)
+	ctx := context.Background()
+
+	// The first replica creates the lease
+	if held, holder, err := firstLock.Acquire(ctx, first); err != nil || !held || holder != first {
+		t.Fatalf("expected first to create the lease, got %v %+v %v", held, holder, err)
+	}
+	if holder, transitions := fk.holder(); holder != first || transitions != 0 {
+		t.Fatalf("unexpected lease of %+v with %d transitions", holder, transitions)
+	}
+
+	// The second replica follows while the lease is renewed
+	if held, holder, err := secondLock.Acquire(ctx, second); err != nil || held || holder != first {
+		t.Fatalf("expected second to follow first, got %v %+v %v", held, holder, err)
+	}
+	if held, _, err := firstLock.Acquire(ctx, first); err != nil || !held {
+		t.Fatalf("expected first to renew the lease, got %v %v", held, err)
+	}
+	if held, _, err := secondLock.Acquire(ctx, second); err != nil || held {
+		t.Fatalf("expected second to keep following, got %v %v", held, err)
+	}
+
+	// Once first stops renewing for the lease duration, second takes over
+	time.Sleep(1100 * time.Millisecond)
+	if held, holder, err := secondLock.Acquire(ctx, second); err != nil || !held || holder != second {
+		t.Fatalf("expected second to take over, got %v %+v %v", held, holder, err)
+	}
+	if holder, transitions := fk.holder(); holder != second || transitions != 1 {
+		t.Fatalf("unexpected lease of %+v with %d transitions", holder, transitions)
+	}
+	if held, holder, err := firstLock.Acquire(ctx, first); err != nil || held || holder != second {
+		t.Fatalf("expected first to follow second, got %v %+v %v", held, holder, err)
+	}
+}
+
+func TestKubernetesLockRelease(t *testing.T) {
+	fk := newFakeKubernetes(t)
+	first := Record{Identity: "first", Address: "https://10.0.0.1:8443"}
+	second := Record{Identity: "second", Address: "https://10.0.0.2:8443"}
+	firstLock := newTestKubernetesLock(t, fk, time.Minute)
+	secondLock := newTestKubernetesLock(t, fk, time.Minute)
+	ctx := context.Background()
+
+	if held, _, err := firstLock.Acquire(ctx, first); err != nil || !held {
+		t.Fatalf("expected first to lead, got %v %v", held, err)
+	}
+
+	// Releasing the lease of another replica does nothing
+	if err := secondLock.Release(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+	if holder, _ := fk.holder(); holder != first {
+		t.Fatalf("expected first to keep the lease, got %+v", holder)
+	}
+
+	// A released lease is taken right away, without waiting for its duration
+	if err := firstLock.Release(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	if holder, _ := fk.holder(); holder != (Record{}) {
+		t.Fatalf("expected a released lease, got %+v", holder)
+	}
+	if held, holder, err := secondLock.Acquire(ctx, second); err != nil || !held || holder != second {
+		t.Fatalf("expected second to take the released lease, got %v %+v %v", held, holder, err)
+	}
+}
+
+func TestKubernetesLockConflict(t *testing.T) {
+	fk := newFakeKubernetes(t)
+	first := Record{Identity: "first", Address: "https://10.0.0.1:8443"}
+	lock := newTestKubernetesLock(t, fk, time.Minute)
+	ctx := context.Background()
+
+	if held, _, err := lock.Acquire(ctx, first); err != nil || !held {
+		t.Fatalf("expected first to lead, got %v %v", held, err)
+	}
+
+	// The lease changed between the read and the update of the renewal
+	fk.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			fk.bumpVersion()
+		}
+		fk.serve(w, r)
+	})
+
+	if held, _, err := lock.Acquire(ctx, first); err != nil || held {
+		t.Fatalf("expected a conflicting renewal not to hold the lease, got %v %v", held, err)
+	}
+}
+
+func TestKubernetesLockUnauthorized(t *testing.T) {
+	fk := newFakeKubernetes(t)
+	lock := newTestKubernetesLock(t, fk, time.Minute)
+	if err := ioutil.WriteFile(lock.tokenPath, []byte("expired"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := lock.Acquire(context.Background(), Record{Identity: "first"}); err == nil {
+		t.Fatal("expected an error when the Kubernetes API rejects the token")
+	}
+}
@@ -0,0 +1,102 @@
+package coordination
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/tracing"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/util/errclass"
+)
+
+const fetchTimeout = 10 * time.Second
+
+// VaultReader reads the GCP secrets from Vault, it is implemented by every
+// vault.VaultClient
+type VaultReader interface {
+	Get(ctx context.Context, path string) (*api.Secret, error)
+	LookupLease(ctx context.Context, leaseID string) (*api.Secret, error)
+}
+
+// SecretReader reads the GCP secrets from Vault on the leader, and from the
+// distribution endpoint of the leader on the followers
+type SecretReader struct {
+	vault   VaultReader
+	elector *Elector
+	client  *http.Client
+}
+
+func NewSecretReader(vault VaultReader, elector *Elector, tlsConf *tls.Config) *SecretReader {
+	return &SecretReader{
+		vault:   vault,
+		elector: elector,
+		client: &http.Client{
+			Timeout:   fetchTimeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConf},
+		},
+	}
+}
+
+func (sr *SecretReader) Get(ctx context.Context, path string) (*api.Secret, error) {
+	if sr.elector.IsLeader() {
+		return sr.vault.Get(ctx, path)
+	}
+	return sr.fetchFromLeader(ctx, path)
+}
+
+func (sr *SecretReader) LookupLease(ctx context.Context, leaseID string) (*api.Secret, error) {
+	return sr.vault.LookupLease(ctx, leaseID)
+}
+
+func (sr *SecretReader) fetchFromLeader(ctx context.Context, path string) (secret *api.Secret, err error) {
+	leader := sr.elector.Leader()
+	_, span := tracing.Start(
+		ctx,
+		"coordination.fetch_key",
+		attribute.String("vault.path", path),
+		attribute.String("leader.identity", leader.Identity),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	if leader.Address == "" {
+		return nil, errors.New("no leader is elected yet")
+	}
+
+	req, err := http.NewRequest(
+		http.MethodGet,
+		strings.TrimSuffix(leader.Address, "/")+secretPath+"?path="+url.QueryEscape(path),
+		nil,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid leader address")
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := sr.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to reach leader %s", leader.Identity)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		errResp := struct {
+			Error string `json:"error"`
+		}{}
+		json.NewDecoder(resp.Body).Decode(&errResp)
+		err := errors.Errorf("leader %s answered %s: %s", leader.Identity, resp.Status, errResp.Error)
+
+		// The leader may have no key yet, be stepping down, or not know the
+		// secrets path yet during a rolling deploy, all of which clear up
+		return nil, errclass.New(errclass.Transient, err)
+	}
+
+	return api.ParseSecret(resp.Body)
+}
@@ -0,0 +1,99 @@
+package coordination
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/log"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/util/secret"
+)
+
+const secretPath = "/coordination/v1/secret"
+
+// KeySource is the current key of a GCP lease manager
+type KeySource interface {
+	CurrentKey() (key []byte, keyID string, expiresAt time.Time)
+	GetLeaseID() string
+}
+
+// Server serves the keys of the leader to the followers, by secrets path
+type Server struct {
+	elector *Elector
+
+	mutex sync.RWMutex
+	keys  map[string]KeySource
+}
+
+func NewServer(elector *Elector) *Server {
+	return &Server{
+		elector: elector,
+		keys:    map[string]KeySource{},
+	}
+}
+
+// Register serves the key of the GCP lease manager reading secretsPath
+func (s *Server) Register(secretsPath string, keys KeySource) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.keys[secretsPath] = keys
+}
+
+// Handler serves GET /coordination/v1/secret?path=<secrets path>, which
+// answers the current key of the leader shaped like the Vault secret it was
+// read from, with the remaining TTL as lease duration
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(secretPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if !s.elector.IsLeader() {
+			writeError(w, http.StatusServiceUnavailable, "not the leader")
+			return
+		}
+
+		s.mutex.RLock()
+		keys, ok := s.keys[r.URL.Query().Get("path")]
+		s.mutex.RUnlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, "unknown secrets path")
+			return
+		}
+
+		key, keyID, expiresAt := keys.CurrentKey()
+		if len(key) == 0 {
+			writeError(w, http.StatusServiceUnavailable, "no valid key")
+			return
+		}
+		defer secret.Zero(key)
+
+		leaseDuration := 0
+		if !expiresAt.IsZero() {
+			leaseDuration = int(time.Until(expiresAt) / time.Second)
+		}
+
+		log.Logger.Sugar().Debugw("Serving key to follower", "private_key_id", keyID, "remote", r.RemoteAddr)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&api.Secret{
+			LeaseID:       keys.GetLeaseID(),
+			LeaseDuration: leaseDuration,
+			Data: map[string]interface{}{
+				"private_key_data": base64.StdEncoding.EncodeToString(key),
+			},
+		})
+	})
+	return mux
+}
+
+func writeError(w http.ResponseWriter, statusCode int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,96 @@
+package coordination
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// TLSConfigs returns the TLS configs of the server and the client of the
+// distribution endpoint. Both ends present the TLS client cert of the worker,
+// reloaded on every handshake to follow its rotation, and only accept a peer
+// whose cert is issued by the CA with the same common name. Host names are
+// not checked, the replicas reach each other by pod IP.
+func TLSConfigs(caCertPath, certPath, keyPath string) (*tls.Config, *tls.Config, error) {
+	caCert, err := ioutil.ReadFile(caCertPath)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read CA cert")
+	}
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(caCert) {
+		return nil, nil, errors.New("invalid CA cert")
+	}
+
+	loadCert := func() (*tls.Certificate, error) {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load TLS cert")
+		}
+		return &cert, nil
+	}
+
+	cert, err := loadCert()
+	if err != nil {
+		return nil, nil, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "invalid TLS cert")
+	}
+	verifyPeer := peerVerifier(caPool, leaf.Subject.CommonName)
+
+	serverConf := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.RequireAnyClientCert,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return loadCert()
+		},
+		VerifyPeerCertificate: verifyPeer,
+	}
+	clientConf := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return loadCert()
+		},
+		// The chain and the common name are verified by verifyPeer instead
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyPeer,
+	}
+	return serverConf, clientConf, nil
+}
+
+func peerVerifier(caPool *x509.CertPool, commonName string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("the peer presents no cert")
+		}
+
+		certs := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, rawCert := range rawCerts {
+			cert, err := x509.ParseCertificate(rawCert)
+			if err != nil {
+				return errors.Wrap(err, "invalid peer cert")
+			}
+			certs = append(certs, cert)
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		if _, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         caPool,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}); err != nil {
+			return errors.Wrap(err, "untrusted peer cert")
+		}
+
+		if certs[0].Subject.CommonName != commonName {
+			return errors.Errorf("peer cert of %q is not a replica of %q", certs[0].Subject.CommonName, commonName)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,285 @@
+package coordination
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/health"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/history"
+)
+
+// testCA issues the TLS client certs of the replicas
+type testCA struct {
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+	dir  string
+}
+
+var serialNumber int64
+
+func newTestKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newTestCA(t *testing.T, commonName string) *testCA {
+	t.Helper()
+
+	key := newTestKey(t)
+	serialNumber++
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serialNumber),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := &testCA{cert: cert, key: key, dir: t.TempDir()}
+	writeTestPEM(t, ca.caCertPath(), "CERTIFICATE", der)
+	return ca
+}
+
+func (ca *testCA) caCertPath() string {
+	return filepath.Join(ca.dir, "ca.pem")
+}
+
+// issue writes a client cert of commonName signed by the CA, it returns the
+// paths of the cert and its key
+func (ca *testCA) issue(t *testing.T, commonName string) (string, string) {
+	t.Helper()
+
+	key := newTestKey(t)
+	serialNumber++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serialNumber),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestPEM(t, certPath, "CERTIFICATE", der)
+	writeTestPEM(t, keyPath, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+	return certPath, keyPath
+}
+
+func writeTestPEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// replicaTLS returns the TLS configs of a replica with a cert of commonName
+// issued by ca, trusting trustedCA
+func replicaTLS(t *testing.T, ca, trustedCA *testCA, commonName string) (*tls.Config, *tls.Config) {
+	t.Helper()
+
+	certPath, keyPath := ca.issue(t, commonName)
+	serverConf, clientConf, err := TLSConfigs(trustedCA.caCertPath(), certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serverConf, clientConf
+}
+
+// startTLSServer serves handler over TLS with serverConf as is, httptest
+// would replace its certificate
+func startTLSServer(t *testing.T, serverConf *tls.Config, handler http.Handler) string {
+	t.Helper()
+
+	server := httptest.NewUnstartedServer(handler)
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.Listener = tls.NewListener(server.Listener, serverConf)
+	server.Start()
+	t.Cleanup(server.Close)
+	return "https://" + server.Listener.Addr().String()
+}
+
+func TestTLSConfigsMutualAuth(t *testing.T) {
+	ca := newTestCA(t, "replica CA")
+	otherCA := newTestCA(t, "other CA")
+	serverConf, _ := replicaTLS(t, ca, ca, "vault-gcs-lister")
+
+	address := startTLSServer(t, serverConf, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	// The client accepts any server, so only the checks of the server fail
+	clientOf := func(ca *testCA, commonName string) *tls.Config {
+		_, clientConf := replicaTLS(t, ca, ca, commonName)
+		clientConf.VerifyPeerCertificate = nil
+		return clientConf
+	}
+
+	tests := []struct {
+		name       string
+		clientConf *tls.Config
+		err        string
+	}{
+		{
+			name:       "replica",
+			clientConf: clientOf(ca, "vault-gcs-lister"),
+		},
+		{
+			name:       "client of another CA",
+			clientConf: clientOf(otherCA, "vault-gcs-lister"),
+			err:        "bad certificate",
+		},
+		{
+			name:       "client of another common name",
+			clientConf: clientOf(ca, "other-worker"),
+			err:        "bad certificate",
+		},
+		{
+			name:       "client without cert",
+			clientConf: &tls.Config{InsecureSkipVerify: true},
+			err:        "certificate required",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: tt.clientConf}}
+			resp, err := client.Get(address)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				resp.Body.Close()
+				return
+			}
+			if err == nil {
+				resp.Body.Close()
+				t.Fatal("expected the handshake to fail")
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestTLSConfigsRejectServer(t *testing.T) {
+	ca := newTestCA(t, "replica CA")
+	otherCA := newTestCA(t, "other CA")
+	_, clientConf := replicaTLS(t, ca, ca, "vault-gcs-lister")
+
+	tests := []struct {
+		name       string
+		serverConf *tls.Config
+		err        string
+	}{
+		{
+			name:       "server of another CA",
+			serverConf: func() *tls.Config { s, _ := replicaTLS(t, otherCA, ca, "vault-gcs-lister"); return s }(),
+			err:        "untrusted peer cert",
+		},
+		{
+			name:       "server of another common name",
+			serverConf: func() *tls.Config { s, _ := replicaTLS(t, ca, ca, "other-worker"); return s }(),
+			err:        "is not a replica of",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address := startTLSServer(t, tt.serverConf, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				t.Error("the client must not send a request to an untrusted server")
+			}))
+
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConf}}
+			resp, err := client.Get(address)
+			if err == nil {
+				resp.Body.Close()
+				t.Fatal("expected the client to reject the server")
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+// staticKeys is the key source of a leader
+type staticKeys struct {
+	key []byte
+}
+
+func (sk staticKeys) CurrentKey() ([]byte, string, time.Time) {
+	return append([]byte(nil), sk.key...), "key-1", time.Now().Add(time.Hour)
+}
+
+func (sk staticKeys) GetLeaseID() string {
+	return "gcp/key/infra/key-1"
+}
+
+func TestFollowerFetchesFromLeader(t *testing.T) {
+	ca := newTestCA(t, "replica CA")
+	serverConf, _ := replicaTLS(t, ca, ca, "vault-gcs-lister")
+	_, clientConf := replicaTLS(t, ca, ca, "vault-gcs-lister")
+
+	leader := NewElector(&memoryLock{}, Record{Identity: "leader"}, time.Minute, time.Second, health.NewRegistry(), history.NewBuffer(history.DefaultCapacity))
+	leader.Campaign(context.Background())
+	server := NewServer(leader)
+	server.Register("gcp/key/infra", staticKeys{key: []byte(`{"type": "service_account"}`)})
+	address := startTLSServer(t, serverConf, server.Handler())
+
+	follower := NewElector(&memoryLock{holder: Record{Identity: "leader", Address: address}}, Record{Identity: "follower"}, time.Minute, time.Second, health.NewRegistry(), history.NewBuffer(history.DefaultCapacity))
+	follower.Campaign(context.Background())
+	if follower.IsLeader() {
+		t.Fatal("the follower must not lead")
+	}
+
+	reader := NewSecretReader(nil, follower, clientConf)
+	secret, err := reader.Get(context.Background(), "gcp/key/infra")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret.LeaseID != "gcp/key/infra/key-1" || secret.LeaseDuration <= 0 {
+		t.Fatalf("unexpected secret %+v", secret)
+	}
+
+	if _, err := reader.Get(context.Background(), "gcp/key/other"); err == nil {
+		t.Fatal("expected an unknown secrets path to fail")
+	}
+}
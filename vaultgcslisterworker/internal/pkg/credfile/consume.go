@@ -0,0 +1,71 @@
+package credfile
+
+import (
+	"context"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/log"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/util/secret"
+	"github.com/mikeadityas/vault-gcs-lister/pkg/credentials"
+	"github.com/mikeadityas/vault-gcs-lister/pkg/leasechain"
+)
+
+// Consume keeps the credentials file in sync with the key of keys until ctx
+// is done. The file is left in place afterwards as the key stays valid until
+// its lease expires.
+func (w *Writer) Consume(ctx context.Context, keys credentials.KeySource, events <-chan leasechain.Event) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			w.handleEvent(ctx, keys, event)
+		}
+	}
+}
+
+func (w *Writer) handleEvent(ctx context.Context, keys credentials.KeySource, event leasechain.Event) {
+	switch e := event.(type) {
+	case leasechain.StaleLeaseEvent:
+		log.Logger.Sugar().Warnw("Credentials file writer received stale lease notification", "reason", e.Reason)
+		w.remove()
+	case leasechain.RevokedEvent:
+		log.Logger.Sugar().Warnw("Credentials file writer received revoked lease notification", "reason", e.Reason)
+		w.remove()
+	case leasechain.NewLeaseEvent:
+		log.Logger.Sugar().Infow("Credentials file writer received new lease notification", "private_key_id", e.KeyID)
+		serviceAccountKey, keyID, _ := keys.CurrentKey()
+		w.write(ctx, serviceAccountKey, keyID)
+	}
+}
+
+func (w *Writer) write(ctx context.Context, serviceAccountKey []byte, keyID string) {
+	err := w.Write(serviceAccountKey)
+	secret.Zero(serviceAccountKey)
+	if err != nil {
+		log.Logger.Sugar().Errorw("Failed to write credentials file", "path", w.path, "err", err)
+		return
+	}
+	log.Logger.Sugar().Infow("Credentials file written", "path", w.path, "private_key_id", keyID)
+
+	if w.hook == "" {
+		return
+	}
+
+	output, err := w.RunHook(ctx, keyID)
+	if err != nil {
+		log.Logger.Sugar().Errorw("Credentials hook failed", "hook", w.hook, "output", string(output), "err", err)
+		return
+	}
+	log.Logger.Sugar().Infow("Credentials hook finished", "hook", w.hook, "output", string(output))
+}
+
+func (w *Writer) remove() {
+	if err := w.Remove(); err != nil {
+		log.Logger.Sugar().Errorw("Failed to remove credentials file", "path", w.path, "err", err)
+		return
+	}
+	log.Logger.Sugar().Infow("Credentials file removed", "path", w.path)
+}
@@ -0,0 +1,124 @@
+package credfile
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/config"
+)
+
+const (
+	defaultHookTimeout time.Duration = 30 * time.Second
+)
+
+// Writer keeps the key of a target in a credentials file for
+// GOOGLE_APPLICATION_CREDENTIALS consumers, removing it once the key is stale
+type Writer struct {
+	id          string
+	path        string
+	hook        string
+	hookTimeout time.Duration
+}
+
+func NewWriter(id, path, hook string, hookTimeout time.Duration) (*Writer, error) {
+	expandedPath, err := config.ExpandPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if hookTimeout <= 0 {
+		hookTimeout = defaultHookTimeout
+	}
+
+	return &Writer{
+		id:          id,
+		path:        expandedPath,
+		hook:        hook,
+		hookTimeout: hookTimeout,
+	}, nil
+}
+
+func (w *Writer) GetID() string {
+	return w.id
+}
+
+// GetPath returns the expanded path of the credentials file
+func (w *Writer) GetPath() string {
+	return w.path
+}
+
+// Write atomically replaces the credentials file with serviceAccountKey, it
+// removes the file if the key is empty
+func (w *Writer) Write(serviceAccountKey []byte) error {
+	if len(serviceAccountKey) == 0 {
+		return w.Remove()
+	}
+
+	// The temp file lives next to the credentials file as rename is only
+	// atomic within a filesystem
+	tempFile, err := ioutil.TempFile(filepath.Dir(w.path), "."+filepath.Base(w.path)+".tmp-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temp credentials file")
+	}
+	tempPath := tempFile.Name()
+	defer os.Remove(tempPath)
+
+	if err := tempFile.Chmod(0600); err != nil {
+		tempFile.Close()
+		return errors.Wrap(err, "failed to chmod temp credentials file")
+	}
+	if _, err := tempFile.Write(serviceAccountKey); err != nil {
+		tempFile.Close()
+		return errors.Wrap(err, "failed to write temp credentials file")
+	}
+	if err := tempFile.Sync(); err != nil {
+		tempFile.Close()
+		return errors.Wrap(err, "failed to sync temp credentials file")
+	}
+	if err := tempFile.Close(); err != nil {
+		return errors.Wrap(err, "failed to close temp credentials file")
+	}
+
+	if err := os.Rename(tempPath, w.path); err != nil {
+		return errors.Wrap(err, "failed to replace credentials file")
+	}
+	return nil
+}
+
+// Remove removes the credentials file, a missing file is not an error
+func (w *Writer) Remove() error {
+	if err := os.Remove(w.path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove credentials file")
+	}
+	return nil
+}
+
+// RunHook runs the hook command through sh with CREDENTIALS_FILE and
+// PRIVATE_KEY_ID set, it returns the combined output of the hook
+func (w *Writer) RunHook(ctx context.Context, keyID string) ([]byte, error) {
+	if w.hook == "" {
+		return nil, nil
+	}
+
+	hookCtx, cancel := context.WithTimeout(ctx, w.hookTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(hookCtx, "sh", "-c", w.hook)
+	cmd.Env = append(
+		os.Environ(),
+		"CREDENTIALS_FILE="+w.path,
+		"PRIVATE_KEY_ID="+keyID,
+	)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return output, errors.Wrap(err, "credentials hook failed")
+	}
+	return output, nil
+}
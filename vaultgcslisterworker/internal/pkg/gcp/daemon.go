@@ -5,9 +5,16 @@ import (
 	"sync"
 	"time"
 
-	"github.com/cermati/devops-toolkit/common-libs/toolkit-go/pkg/log"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
 
-	leaseUtil "github.com/mikeadityas/vault-gcs-lister/internal/pkg/util/lease"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/health"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/history"
+	leaseMgr "github.com/mikeadityas/vault-gcs-lister/internal/pkg/leasemanager"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/log"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/schedule"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/tracing"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/util/errclass"
 )
 
 const (
@@ -22,33 +29,45 @@ type Daemon interface {
 type daemon struct {
 	gcpLeaseMgr           *GCPLeaseManager
 	refreshPeriodInSecond time.Duration
-	earlyRenewalInMinute  time.Duration
+	policy                schedule.Policy
 	ctx                   context.Context
 	ctxCancelFunc         context.CancelFunc
 	waitGroup             sync.WaitGroup
 	ticker                *time.Ticker
+	status                *health.Status
+	schedules             *schedule.Registry
+	events                *history.Buffer
+	expiryTimer           *time.Timer
 	numRetry              int
 	stopCh                chan bool
 }
 
 func (d *daemon) Start() error {
-	d.ensureServiceAccountKey(false)
+	if !d.restoreServiceAccountKey(d.ctx) {
+		d.ensureServiceAccountKey(d.ctx, "start", false)
+	}
 
 	go func() {
+		parentEvents := d.gcpLeaseMgr.parent.Events()
 		for {
 			select {
 			case <-d.ctx.Done():
 				d.stopCh <- true
 				return
-			case <-d.gcpLeaseMgr.forceStopCh:
-				log.Logger.Sugar().Warn("GCP daemon received force stop notification")
-				d.ticker.Stop()
-				d.gcpLeaseMgr.NotifyAllStaleLease()
-			case <-d.gcpLeaseMgr.forceNewCh:
-				log.Logger.Sugar().Info("GCP daemon received force new notification")
-				d.ensureServiceAccountKey(true)
-			case <-d.ticker.C:
-				d.ensureServiceAccountKey(false)
+			case event, ok := <-parentEvents:
+				if !ok {
+					parentEvents = nil
+					continue
+				}
+				d.handleParentEvent(event)
+			case req := <-d.gcpLeaseMgr.rotateCh:
+				log.Logger.Sugar().Warnw("GCP daemon received rotation request", "reason", req.reason)
+				d.events.Record(d.gcpLeaseMgr.GetID(), history.ForceNew, "GCP key rotation requested", "reason", req.reason)
+				d.ensureServiceAccountKey(req.Cause.Context(d.ctx), "rotation", true)
+			case <-d.tickerCh():
+				d.ensureServiceAccountKey(d.ctx, "schedule", false)
+			case <-d.expiryCh():
+				d.expireServiceAccountKey()
 			}
 		}
 	}()
@@ -62,29 +81,179 @@ func (d *daemon) Stop() error {
 	d.waitGroup.Wait()
 	d.ctxCancelFunc()
 	<-d.stopCh
+
+	// The consumers are stopped before the daemons, nothing reads the key
+	// anymore. The persisted lease is kept for the next start.
+	d.gcpLeaseMgr.wipeKey()
 	return nil
 }
 
-func (d *daemon) ensureServiceAccountKey(isForceNew bool) {
+// handleParentEvent keeps using the current key while the Vault token is
+// being renewed, the key is only dropped once the token is truly revoked
+func (d *daemon) handleParentEvent(event leaseMgr.Event) {
+	switch e := event.(type) {
+	case leaseMgr.ExpiringEvent:
+		log.Logger.Sugar().Infow(
+			"GCP daemon received expiring lease notification, keeping the current key until it expires",
+			"vault_expires_at", e.ExpiresAt.Format(time.RFC3339),
+			"key_expires_at", d.gcpLeaseMgr.GetExpiresAt().Format(time.RFC3339),
+		)
+		d.gcpLeaseMgr.setDegraded(true)
+		d.status.SetDegraded("Vault token is being renewed")
+	case leaseMgr.StaleLeaseEvent:
+		log.Logger.Sugar().Warnw(
+			"GCP daemon received stale lease notification, keeping the current key until it expires",
+			"reason", e.Reason,
+			"key_expires_at", d.gcpLeaseMgr.GetExpiresAt().Format(time.RFC3339),
+		)
+		d.gcpLeaseMgr.setDegraded(true)
+		d.status.SetDegraded("Vault lease is stale: " + e.Reason)
+	case leaseMgr.RevokedEvent:
+		log.Logger.Sugar().Warnw("GCP daemon received revoked lease notification", "reason", e.Reason)
+		d.stopTicker()
+		d.stopExpiryTimer()
+		d.gcpLeaseMgr.invalidate()
+		d.gcpLeaseMgr.Publish(leaseMgr.RevokedEvent{Cause: e.Cause, Reason: "Vault lease is revoked: " + e.Reason})
+		d.events.Record(d.gcpLeaseMgr.GetID(), history.Revoked, "GCP key dropped, the Vault lease is revoked", "reason", e.Reason)
+		d.status.SetRetrying(string(errclass.AuthExpired), errors.New("Vault lease is revoked: "+e.Reason), d.numRetry)
+	case leaseMgr.NewLeaseEvent:
+		d.gcpLeaseMgr.setDegraded(false)
+		if d.gcpLeaseMgr.HasValidKey() {
+			d.status.SetHealthy()
+			log.Logger.Sugar().Info("GCP daemon received new lease notification, the current key is still valid")
+			return
+		}
+
+		log.Logger.Sugar().Info("GCP daemon received new lease notification")
+		d.ensureServiceAccountKey(leaseMgr.ContextWithCause(d.ctx, event), "new_lease", true)
+	}
+}
+
+// expireServiceAccountKey drops the key once its own TTL runs out, or once
+// less than the minimum remaining lifetime is left
+func (d *daemon) expireServiceAccountKey() {
+	d.expiryTimer = nil
+	if d.gcpLeaseMgr.HasValidKey() {
+		return
+	}
+
+	log.Logger.Sugar().Warnw(
+		"GCP service account key expired",
+		"private_key_id", d.gcpLeaseMgr.GetKeyID(),
+		"min_remaining", d.policy.MinRemaining,
+	)
+	d.gcpLeaseMgr.invalidate()
+	d.gcpLeaseMgr.Publish(leaseMgr.StaleLeaseEvent{Reason: "GCP service account key expired"})
+	d.events.Record(d.gcpLeaseMgr.GetID(), history.StaleLease, "GCP service account key expired", "private_key_id", d.gcpLeaseMgr.GetKeyID())
+}
+
+func (d *daemon) tickerCh() <-chan time.Time {
+	if d.ticker == nil {
+		return nil
+	}
+	return d.ticker.C
+}
+
+func (d *daemon) stopTicker() {
+	if d.ticker != nil {
+		d.ticker.Stop()
+		d.ticker = nil
+	}
+	d.status.SetNextRun(time.Time{})
+}
+
+func (d *daemon) expiryCh() <-chan time.Time {
+	if d.expiryTimer == nil {
+		return nil
+	}
+	return d.expiryTimer.C
+}
+
+func (d *daemon) stopExpiryTimer() {
+	if d.expiryTimer != nil {
+		d.expiryTimer.Stop()
+		d.expiryTimer = nil
+	}
+}
+
+// ensureServiceAccountKey fetches a key, trigger names what asked for it in
+// the trace
+func (d *daemon) ensureServiceAccountKey(ctx context.Context, trigger string, isForceNew bool) {
 	d.waitGroup.Add(1)
 	defer d.waitGroup.Done()
 
+	ctx, span := tracing.Start(
+		ctx,
+		"gcp.ensure_key",
+		attribute.String("lease.id", d.gcpLeaseMgr.GetID()),
+		attribute.String("trigger", trigger),
+		attribute.Bool("force_new", isForceNew),
+	)
+	var err error
+	defer func() { tracing.End(span, err) }()
+
 	log.Logger.Sugar().Info("Ensuring GCP service account key...")
-	if err := d.gcpLeaseMgr.GetNewLease(); err != nil {
+	hadValidKey := d.gcpLeaseMgr.HasValidKey()
+	previousKeyID := d.gcpLeaseMgr.GetKeyID()
+	if err = d.gcpLeaseMgr.GetNewLease(ctx); err != nil {
 		if d.numRetry == 0 {
-			d.gcpLeaseMgr.NotifyAllStaleLease()
+			if d.gcpLeaseMgr.HasValidKey() {
+				d.gcpLeaseMgr.setDegraded(true)
+				d.gcpLeaseMgr.Publish(leaseMgr.ExpiringEvent{
+					Cause:     leaseMgr.CauseFrom(ctx),
+					ExpiresAt: d.gcpLeaseMgr.GetExpiresAt(),
+				})
+				d.events.Record(
+					d.gcpLeaseMgr.GetID(),
+					history.Expiring,
+					"Failed to refresh GCP key, keeping the current key until it expires",
+					"key_expires_at", d.gcpLeaseMgr.GetExpiresAt().Format(time.RFC3339),
+				)
+			} else {
+				d.gcpLeaseMgr.Publish(leaseMgr.StaleLeaseEvent{Cause: leaseMgr.CauseFrom(ctx), Reason: err.Error()})
+				d.events.Record(d.gcpLeaseMgr.GetID(), history.StaleLease, "No valid GCP key", "err", err)
+			}
+		}
+
+		errClass, retryAfter := errclass.Classify(err)
+		errClass = d.renewRejectedToken(ctx, errClass, err)
+		if errClass.IsPermanent() {
+			d.status.SetFailed(string(errClass), err, d.numRetry)
+		} else {
+			d.status.SetRetrying(string(errClass), err, d.numRetry)
 		}
 
-		d.refreshPeriodInSecond = leaseUtil.CalculateBackoffTime(d.numRetry, maxBackoff)
+		d.stopTicker()
 
-		if d.ticker != nil {
-			d.ticker.Stop()
+		retryPeriod, retry := errClass.RetryDelay(retryAfter, d.numRetry, maxBackoff)
+		if !retry {
+			d.events.Record(d.gcpLeaseMgr.GetID(), history.Failed, "Failed to ensure GCP key, not retrying", "err", err, "err.class", errClass)
+			log.Logger.Sugar().Errorw(
+				"Failed to ensure GCP service account key, not retrying until the config is fixed.",
+				"err", err,
+				"err.class", errClass,
+				"secrets_path", d.gcpLeaseMgr.secretsPath,
+			)
+			return
 		}
+
+		d.refreshPeriodInSecond = retryPeriod
 		d.ticker = time.NewTicker(d.refreshPeriodInSecond)
+		d.status.SetNextRun(time.Now().Add(d.refreshPeriodInSecond))
+		d.events.Record(
+			d.gcpLeaseMgr.GetID(),
+			history.BackoffScheduled,
+			"Failed to ensure GCP key",
+			"err", err,
+			"err.class", errClass,
+			"retry.num", d.numRetry,
+			"retry.interval", d.refreshPeriodInSecond,
+		)
 
 		log.Logger.Sugar().Errorw(
 			"Failed to ensure GCP service account key.",
 			"err", err,
+			"err.class", errClass,
 			"retry.num", d.numRetry,
 			"retry.interval", d.refreshPeriodInSecond,
 			"retry.next", time.Now().Add(d.refreshPeriodInSecond).Format(time.RFC3339),
@@ -94,23 +263,101 @@ func (d *daemon) ensureServiceAccountKey(isForceNew bool) {
 		return
 	}
 
-	if isForceNew {
-		d.gcpLeaseMgr.NotifyAllNewLease()
+	// A scheduled refresh replaces the key too, the consumers must switch to it
+	if isForceNew || !hadValidKey || d.gcpLeaseMgr.GetKeyID() != previousKeyID {
+		d.gcpLeaseMgr.Publish(leaseMgr.NewLeaseEvent{
+			Cause:   leaseMgr.CauseFrom(ctx),
+			KeyID:   d.gcpLeaseMgr.GetKeyID(),
+			LeaseID: d.gcpLeaseMgr.GetLeaseID(),
+			TTL:     time.Duration(d.gcpLeaseMgr.GetTTL()) * time.Second,
+		})
 	}
 
-	d.numRetry = 0
-	d.refreshPeriodInSecond = time.Duration(d.gcpLeaseMgr.ttl) * time.Second
+	d.events.Record(
+		d.gcpLeaseMgr.GetID(),
+		history.KeyFetched,
+		"GCP key fetched",
+		"private_key_id", d.gcpLeaseMgr.GetKeyID(),
+		"lease_id", d.gcpLeaseMgr.GetLeaseID(),
+		"ttl", time.Duration(d.gcpLeaseMgr.GetTTL())*time.Second,
+	)
+
+	log.Logger.Sugar().Info("GCP service acount key refreshed!")
+	d.scheduleRefresh()
+}
 
-	if d.refreshPeriodInSecond-d.earlyRenewalInMinute > 1*time.Minute {
-		d.refreshPeriodInSecond = d.refreshPeriodInSecond - d.earlyRenewalInMinute
+// renewRejectedToken asks for a new Vault token when Vault rejected the
+// current one, a denial of an expired or revoked token is reclassified as
+// AuthExpired so it is retried with backoff instead of parked
+func (d *daemon) renewRejectedToken(ctx context.Context, errClass errclass.Class, err error) errclass.Class {
+	renewer := d.gcpLeaseMgr.getTokenRenewer()
+	if renewer == nil {
+		return errClass
 	}
 
-	if d.ticker != nil {
-		d.ticker.Stop()
+	if errClass == errclass.PermissionDenied && renewer.TokenRejected(ctx, err) {
+		errClass = errclass.AuthExpired
+	}
+	if errClass != errclass.AuthExpired {
+		return errClass
 	}
-	d.ticker = time.NewTicker(d.refreshPeriodInSecond)
 
-	log.Logger.Sugar().Info("GCP service acount key refreshed!")
+	log.Logger.Sugar().Warnw("Vault rejected the token, requested a Vault token renewal", "err", err)
+	renewer.RequestRenewal()
+	return errClass
+}
+
+// restoreServiceAccountKey reuses the persisted key, it returns false if a
+// new key must be fetched
+func (d *daemon) restoreServiceAccountKey(ctx context.Context) bool {
+	d.waitGroup.Add(1)
+	defer d.waitGroup.Done()
+
+	restored, err := d.gcpLeaseMgr.RestoreLease(ctx)
+	if err != nil {
+		log.Logger.Sugar().Warnw("Failed to restore the persisted GCP lease, fetching a new key", "err", err)
+		return false
+	}
+	if !restored {
+		return false
+	}
+
+	d.gcpLeaseMgr.Publish(leaseMgr.NewLeaseEvent{
+		Cause:   leaseMgr.CauseFrom(ctx),
+		KeyID:   d.gcpLeaseMgr.GetKeyID(),
+		LeaseID: d.gcpLeaseMgr.GetLeaseID(),
+		TTL:     time.Duration(d.gcpLeaseMgr.GetTTL()) * time.Second,
+	})
+	d.events.Record(
+		d.gcpLeaseMgr.GetID(),
+		history.KeyRestored,
+		"GCP key restored from the persisted lease",
+		"private_key_id", d.gcpLeaseMgr.GetKeyID(),
+		"lease_id", d.gcpLeaseMgr.GetLeaseID(),
+		"ttl", time.Duration(d.gcpLeaseMgr.GetTTL())*time.Second,
+	)
+
+	d.scheduleRefresh()
+	return true
+}
+
+// scheduleRefresh schedules the refresh of the current key according to the
+// renewal policy, and drops the key once it is no longer usable
+func (d *daemon) scheduleRefresh() {
+	d.status.SetHealthy()
+	d.numRetry = 0
+	ttl := time.Duration(d.gcpLeaseMgr.GetTTL()) * time.Second
+
+	d.stopExpiryTimer()
+	if expiresAt := d.gcpLeaseMgr.GetExpiresAt(); !expiresAt.IsZero() {
+		d.expiryTimer = time.NewTimer(time.Until(expiresAt) - d.policy.MinRemaining)
+	}
+
+	d.refreshPeriodInSecond = d.schedules.Plan(d.gcpLeaseMgr.GetID(), ttl, d.policy)
+
+	d.stopTicker()
+	d.ticker = time.NewTicker(d.refreshPeriodInSecond)
+	d.status.SetNextRun(time.Now().Add(d.refreshPeriodInSecond))
 
 	gcpRefreshTime := time.Now().Add(d.refreshPeriodInSecond)
 	log.Logger.Sugar().Infow("Next GCP service account key refresh", "refresh_time", gcpRefreshTime.Format(time.RFC3339))
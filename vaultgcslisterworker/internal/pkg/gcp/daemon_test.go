@@ -0,0 +1,164 @@
+package gcp
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/health"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/history"
+	leaseMgr "github.com/mikeadityas/vault-gcs-lister/internal/pkg/leasemanager"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/schedule"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/util/errclass"
+)
+
+// fakeReader serves the keys of keyIDs in turn, repeating the last one
+type fakeReader struct {
+	t      testing.TB
+	mutex  sync.Mutex
+	keyIDs []string
+	reads  int
+}
+
+func (fr *fakeReader) Get(ctx context.Context, path string) (*api.Secret, error) {
+	fr.mutex.Lock()
+	defer fr.mutex.Unlock()
+
+	keyID := fr.keyIDs[len(fr.keyIDs)-1]
+	if fr.reads < len(fr.keyIDs) {
+		keyID = fr.keyIDs[fr.reads]
+	}
+	fr.reads++
+
+	return &api.Secret{
+		LeaseID:       "gcp/key/test/" + keyID,
+		LeaseDuration: 3600,
+		Data: map[string]interface{}{
+			"private_key_data": base64.StdEncoding.EncodeToString(testKeyJSON(fr.t, keyID)),
+		},
+	}, nil
+}
+
+func (fr *fakeReader) LookupLease(ctx context.Context, leaseID string) (*api.Secret, error) {
+	return &api.Secret{Data: map[string]interface{}{"ttl": json.Number("3600")}}, nil
+}
+
+func nextEvent(t *testing.T, events <-chan leaseMgr.Event) leaseMgr.Event {
+	t.Helper()
+
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event published")
+		return nil
+	}
+}
+
+func TestScheduledRefreshPublishesRotatedKey(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reader := &fakeReader{t: t, keyIDs: []string{"key-1", "key-2"}}
+	glm := NewGCPLeaseManager("gcp-test", "gcp/key/test", KeyExpectation{}, reader)
+	subscription := glm.bus.Subscribe("credfile")
+	defer glm.bus.Unsubscribe("credfile")
+
+	d := glm.Daemonize(ctx, cancel, 0, schedule.Policy{}, health.NewRegistry(), schedule.NewRegistry(), history.NewBuffer(history.DefaultCapacity)).(*daemon)
+	defer d.stopExpiryTimer()
+	defer d.stopTicker()
+
+	d.ensureServiceAccountKey(ctx, "start", false)
+	if event, ok := nextEvent(t, subscription.Events()).(leaseMgr.NewLeaseEvent); !ok || event.KeyID != "key-1" {
+		t.Fatalf("expected the new lease of key-1, got %#v", event)
+	}
+
+	// The scheduled refresh is neither forced nor replacing an invalid key
+	d.ensureServiceAccountKey(ctx, "schedule", false)
+	if event, ok := nextEvent(t, subscription.Events()).(leaseMgr.NewLeaseEvent); !ok || event.KeyID != "key-2" {
+		t.Fatalf("expected the new lease of key-2, got %#v", event)
+	}
+	if keyID := glm.GetKeyID(); keyID != "key-2" {
+		t.Fatalf("expected key-2 as current key, got %s", keyID)
+	}
+
+	// The same key again is not a new lease
+	d.ensureServiceAccountKey(ctx, "schedule", false)
+	select {
+	case event := <-subscription.Events():
+		t.Fatalf("unexpected event %#v for an unchanged key", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// deniedReader answers every read with the 403 of Vault
+type deniedReader struct{}
+
+func (deniedReader) Get(ctx context.Context, path string) (*api.Secret, error) {
+	return nil, &api.ResponseError{StatusCode: http.StatusForbidden, Errors: []string{"permission denied"}}
+}
+
+func (deniedReader) LookupLease(ctx context.Context, leaseID string) (*api.Secret, error) {
+	return nil, &api.ResponseError{StatusCode: http.StatusForbidden, Errors: []string{"permission denied"}}
+}
+
+// fakeRenewer tells whether the token is rejected and counts the renewals
+type fakeRenewer struct {
+	rejected bool
+	renewals int
+}
+
+func (fr *fakeRenewer) TokenRejected(ctx context.Context, err error) bool {
+	return fr.rejected
+}
+
+func (fr *fakeRenewer) RequestRenewal() {
+	fr.renewals++
+}
+
+func TestPermissionDeniedOfRejectedToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		rejected bool
+		class    errclass.Class
+		renewals int
+	}{
+		{name: "expired token", rejected: true, class: errclass.AuthExpired, renewals: 1},
+		{name: "denying policy", rejected: false, class: errclass.PermissionDenied, renewals: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			renewer := &fakeRenewer{rejected: tt.rejected}
+			glm := NewGCPLeaseManager("gcp-test", "gcp/key/test", KeyExpectation{}, deniedReader{})
+			glm.SetTokenRenewer(renewer)
+
+			registry := health.NewRegistry()
+			d := glm.Daemonize(ctx, cancel, 0, schedule.Policy{}, registry, schedule.NewRegistry(), history.NewBuffer(history.DefaultCapacity)).(*daemon)
+			defer d.stopExpiryTimer()
+			defer d.stopTicker()
+
+			d.ensureServiceAccountKey(ctx, "start", false)
+
+			snapshot, _ := registry.Lookup("gcp-test")
+			if snapshot.ErrClass != string(tt.class) {
+				t.Errorf("expected the class %s, got %s", tt.class, snapshot.ErrClass)
+			}
+			if renewer.renewals != tt.renewals {
+				t.Errorf("expected %d Vault token renewals, got %d", tt.renewals, renewer.renewals)
+			}
+			if tt.class == errclass.AuthExpired && d.refreshPeriodInSecond >= errclass.PermanentRetryInterval {
+				t.Errorf("expected a retry with backoff, got %v", d.refreshPeriodInSecond)
+			}
+		})
+	}
+}
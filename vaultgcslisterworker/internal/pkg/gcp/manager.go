@@ -2,90 +2,350 @@ package gcp
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/hashicorp/vault/api"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
 
-	"github.com/cermati/devops-toolkit/common-libs/toolkit-go/pkg/cvault"
-	"github.com/cermati/devops-toolkit/common-libs/toolkit-go/pkg/log"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/health"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/history"
 	leaseMgr "github.com/mikeadityas/vault-gcs-lister/internal/pkg/leasemanager"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/leasestore"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/log"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/schedule"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/tracing"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/util/errclass"
+	leaseUtil "github.com/mikeadityas/vault-gcs-lister/internal/pkg/util/lease"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/util/secret"
 )
 
+const (
+	minRotationInterval time.Duration = 1 * time.Minute
+	maxRotationInterval time.Duration = 30 * time.Minute
+)
+
+// SecretReader reads the GCP secrets from Vault and looks up their leases, it
+// is implemented by every vault.VaultClient
+type SecretReader interface {
+	Get(ctx context.Context, path string) (*api.Secret, error)
+	LookupLease(ctx context.Context, leaseID string) (*api.Secret, error)
+}
+
+// TokenRenewer renews the Vault token the secrets are read with, it is
+// implemented by vault.VaultLeaseManager
+type TokenRenewer interface {
+	// TokenRejected reports whether Vault denied err because the token expired
+	// or was revoked rather than by policy
+	TokenRejected(ctx context.Context, err error) bool
+	RequestRenewal()
+}
+
 type GCPLeaseManager struct {
-	id                string
-	client            cvault.CVault
-	secretsPath       string
-	serviceAccountKey []byte
+	id          string
+	client      SecretReader
+	secretsPath string
+	expected    KeyExpectation
+
+	mutex             sync.RWMutex
+	serviceAccountKey *secret.Bytes
+	keyInfo           ServiceAccountKey
+	leaseID           string
 	ttl               int
-	forceNewCh        chan bool
-	forceStopCh       chan bool
-	services          []leaseMgr.Observer
+	expiresAt         time.Time
+	degraded          bool
+	minRemaining      time.Duration
+
+	store        *leasestore.Store
+	tokenRenewer TokenRenewer
+
+	bus     *leaseMgr.Bus
+	parent  *leaseMgr.Subscription
+	waiters uint64
+
+	rotateCh      chan rotationRequest
+	rotateLimiter *leaseUtil.BackoffLimiter
+}
+
+// rotationRequest asks the daemon for a new key, the cause is the span of the
+// work that found the current key unusable
+type rotationRequest struct {
+	leaseMgr.Cause
+	reason string
 }
 
+// ServiceAccountKey is the non-secret part of a service account key
 type ServiceAccountKey struct {
+	Type         string `json:"type"`
+	ProjectID    string `json:"project_id"`
 	PrivateKeyID string `json:"private_key_id"`
+	ClientEmail  string `json:"client_email"`
+	ClientID     string `json:"client_id"`
+	TokenURI     string `json:"token_uri"`
 }
 
-func NewGCPLeaseManager(id, secretsPath string, client cvault.CVault) *GCPLeaseManager {
+func NewGCPLeaseManager(id, secretsPath string, expected KeyExpectation, client SecretReader) *GCPLeaseManager {
 	return &GCPLeaseManager{
-		id:          id,
-		secretsPath: secretsPath,
-		client:      client,
-		forceNewCh:  make(chan bool, 1),
-		forceStopCh: make(chan bool, 1),
+		id:            id,
+		secretsPath:   secretsPath,
+		expected:      expected,
+		client:        client,
+		bus:           leaseMgr.NewBus(),
+		rotateCh:      make(chan rotationRequest, 1),
+		rotateLimiter: leaseUtil.NewBackoffLimiter(minRotationInterval, maxRotationInterval),
 	}
 }
 
-func (glm *GCPLeaseManager) GetNewLease() error {
+func (glm *GCPLeaseManager) GetNewLease(ctx context.Context) (err error) {
+	ctx, span := tracing.Start(
+		ctx,
+		"gcp.fetch_key",
+		attribute.String("lease.id", glm.id),
+		attribute.String("vault.path", glm.secretsPath),
+	)
+	defer func() { tracing.End(span, err) }()
+
 	// client request new GCP credentials
-	secrets, err := glm.client.Get(glm.secretsPath)
+	fetchedAt := time.Now()
+	secrets, err := glm.client.Get(ctx, glm.secretsPath)
 	if err != nil {
-		glm.serviceAccountKey = []byte("")
 		return err
 	}
 
+	// Vault answers a read of a nonexistent path with no secret at all
 	if secrets == nil {
-		return errors.New("Vault secret returns nil")
+		return errclass.New(errclass.Misconfiguration, errors.Errorf("Vault secret %s returns nil", glm.secretsPath))
+	}
+
+	privateKeyDataBytes, sak, err := ParseSecret(secrets.Data)
+	if err != nil {
+		return errclass.New(errclass.MalformedSecret, err)
 	}
 
-	if secrets.Data == nil {
-		return errors.New("Vault secret data is nil")
+	// A key of another service account means the secrets path points to the
+	// wrong roleset, fetching again does not help
+	if err := glm.expected.Check(sak); err != nil {
+		return errclass.New(errclass.Misconfiguration, err)
+	}
+
+	// Vault caps the lease at the TTL of the token, a renewed token gets a
+	// longer lease on the next fetch
+	if err := glm.checkLifetime(secrets.LeaseDuration); err != nil {
+		return errclass.New(errclass.Transient, err)
+	}
+
+	log.Logger.Sugar().Infow("Retrieved service account key", "private_key_id", sak.PrivateKeyID)
+	span.SetAttributes(
+		attribute.String("gcp.private_key_id", sak.PrivateKeyID),
+		attribute.Int("vault.lease_duration", secrets.LeaseDuration),
+	)
+
+	glm.setLease(secrets.LeaseID, secrets.LeaseDuration, privateKeyDataBytes, sak, fetchedAt)
+	glm.persist()
+	return nil
+}
+
+// SetMinRemaining makes the lease manager hand out only keys with at least
+// minRemaining of lifetime left
+func (glm *GCPLeaseManager) SetMinRemaining(minRemaining time.Duration) {
+	glm.mutex.Lock()
+	defer glm.mutex.Unlock()
+
+	glm.minRemaining = minRemaining
+}
+
+// SetTokenRenewer makes the lease manager renew the Vault token with renewer
+// when Vault rejects it, instead of retrying with the same token
+func (glm *GCPLeaseManager) SetTokenRenewer(renewer TokenRenewer) {
+	glm.mutex.Lock()
+	defer glm.mutex.Unlock()
+
+	glm.tokenRenewer = renewer
+}
+
+func (glm *GCPLeaseManager) getTokenRenewer() TokenRenewer {
+	glm.mutex.RLock()
+	defer glm.mutex.RUnlock()
+
+	return glm.tokenRenewer
+}
+
+// Persist makes the lease manager save its leases to store, so that
+// RestoreLease can reuse them after a restart
+func (glm *GCPLeaseManager) Persist(store *leasestore.Store) {
+	glm.store = store
+}
+
+// RestoreLease reuses the persisted lease if Vault confirms it is still
+// alive, it returns false without a persisted lease. A persisted lease that
+// can not be reused is discarded.
+func (glm *GCPLeaseManager) RestoreLease(ctx context.Context) (restored bool, err error) {
+	if glm.store == nil {
+		return false, nil
 	}
 
-	glm.ttl = secrets.LeaseDuration
+	ctx, span := tracing.Start(ctx, "gcp.restore_key", attribute.String("lease.id", glm.id))
+	defer func() { tracing.End(span, err) }()
 
-	privateKeyDataIfc, ok := secrets.Data["private_key_data"]
-	if !ok {
-		return errors.New("Vault secret data is missing private_key_data")
+	lease, err := glm.store.Load(glm.id)
+	if err != nil || lease == nil {
+		return false, err
 	}
+	keep := false
+	defer func() {
+		if restored {
+			return
+		}
+		secret.Zero(lease.Key)
+		if !keep {
+			glm.discardPersisted()
+		}
+	}()
 
-	privateKeyDataB64Str := privateKeyDataIfc.(string)
+	if !lease.ExpiresAt.IsZero() && !time.Now().Before(lease.ExpiresAt) {
+		return false, errors.Errorf("persisted lease expired at %s", lease.ExpiresAt.Format(time.RFC3339))
+	}
 
-	privateKeyDataBytes, err := base64.StdEncoding.DecodeString(privateKeyDataB64Str)
+	sak, err := parseServiceAccountKey(lease.Key)
 	if err != nil {
-		return err
+		return false, err
+	}
+	if err := glm.expected.Check(sak); err != nil {
+		return false, err
 	}
 
-	sak := ServiceAccountKey{}
-	if err := json.Unmarshal(privateKeyDataBytes, &sak); err != nil {
-		return errors.Wrap(err, "failed to parse private key data from Vault")
+	lookedUpAt := time.Now()
+	lookup, err := glm.client.LookupLease(ctx, lease.LeaseID)
+	if err != nil {
+		// The lease may still be alive if Vault is only unavailable
+		if errClass, _ := errclass.Classify(err); errClass == errclass.Transient || errClass == errclass.RateLimited {
+			keep = true
+		}
+		return false, errors.Wrap(err, "Vault does not confirm the persisted lease")
+	}
+	ttl, err := leaseTTL(lookup.Data)
+	if err != nil {
+		return false, err
+	}
+	if ttl <= 0 {
+		return false, errors.New("the persisted lease has no TTL left")
+	}
+	if err := glm.checkLifetime(ttl); err != nil {
+		return false, err
 	}
-	log.Logger.Sugar().Infow("Retrieved service account key", "private_key_id", sak.PrivateKeyID)
 
-	glm.serviceAccountKey = privateKeyDataBytes
-	return nil
+	span.SetAttributes(
+		attribute.String("gcp.private_key_id", sak.PrivateKeyID),
+		attribute.Int("vault.lease_duration", ttl),
+	)
+	log.Logger.Sugar().Infow("Restored persisted service account key", "private_key_id", sak.PrivateKeyID, "ttl", ttl)
+
+	glm.setLease(lease.LeaseID, ttl, lease.Key, sak, lookedUpAt)
+	return true, nil
+}
+
+// setLease replaces the current key, it takes ownership of key
+func (glm *GCPLeaseManager) setLease(leaseID string, ttl int, key []byte, sak ServiceAccountKey, fetchedAt time.Time) {
+	glm.mutex.Lock()
+	defer glm.mutex.Unlock()
+
+	glm.ttl = ttl
+	glm.leaseID = leaseID
+	// The replaced key is wiped, every consumer holds its own copy
+	glm.serviceAccountKey.Wipe()
+	glm.serviceAccountKey = secret.NewBytes(key)
+	glm.keyInfo = sak
+	glm.expiresAt = time.Time{}
+	if ttl > 0 {
+		glm.expiresAt = fetchedAt.Add(time.Duration(ttl) * time.Second)
+	}
+	glm.degraded = false
+}
+
+// persist saves the current lease, a failure only costs a new key on restart
+func (glm *GCPLeaseManager) persist() {
+	if glm.store == nil {
+		return
+	}
+
+	glm.mutex.RLock()
+	lease := &leasestore.Lease{
+		LeaseID:   glm.leaseID,
+		Key:       glm.serviceAccountKey.Copy(),
+		ExpiresAt: glm.expiresAt,
+	}
+	glm.mutex.RUnlock()
+	defer secret.Zero(lease.Key)
+
+	if err := glm.store.Save(glm.id, lease); err != nil {
+		log.Logger.Sugar().Warnw("Failed to persist GCP lease", "lease_id", glm.id, "err", err)
+	}
+}
+
+// discardPersisted removes the persisted lease once it can not be reused
+func (glm *GCPLeaseManager) discardPersisted() {
+	if glm.store == nil {
+		return
+	}
+	if err := glm.store.Remove(glm.id); err != nil {
+		log.Logger.Sugar().Warnw("Failed to remove persisted GCP lease", "lease_id", glm.id, "err", err)
+	}
 }
 
-func (glm *GCPLeaseManager) NotifyNewLease() {
-	glm.forceNewCh <- true
+// leaseTTL reads the ttl in seconds of a sys/leases/lookup response
+func leaseTTL(data map[string]interface{}) (int, error) {
+	switch ttl := data["ttl"].(type) {
+	case json.Number:
+		seconds, err := ttl.Int64()
+		return int(seconds), err
+	case float64:
+		return int(ttl), nil
+	case string:
+		return strconv.Atoi(ttl)
+	default:
+		return 0, errors.Errorf("Vault lease lookup returns a %T ttl", ttl)
+	}
+}
+
+// RequestRotation asks the daemon for a new key, e.g. because GCS rejects the
+// current one. Requests are rate limited with a growing interval so a broken
+// roleset does not hammer Vault, it returns false if the request is dropped.
+func (glm *GCPLeaseManager) RequestRotation(ctx context.Context, reason string) bool {
+	if !glm.rotateLimiter.Allow() {
+		return false
+	}
+
+	glm.ForceRotation(ctx, reason)
+	return true
+}
+
+// ForceRotation asks the daemon for a new key right away, bypassing the rate
+// limit of RequestRotation
+func (glm *GCPLeaseManager) ForceRotation(ctx context.Context, reason string) {
+	select {
+	case glm.rotateCh <- rotationRequest{Cause: leaseMgr.CauseFrom(ctx), reason: reason}:
+	default:
+	}
 }
 
-func (glm *GCPLeaseManager) NotifyStaleLease() {
-	glm.serviceAccountKey = []byte("")
-	glm.forceStopCh <- true
+// NextRotation returns when RequestRotation is allowed again
+func (glm *GCPLeaseManager) NextRotation() time.Time {
+	return glm.rotateLimiter.Next()
+}
+
+// ConfirmKey reports the current key works, lifting the growing rate limit
+// of RequestRotation
+func (glm *GCPLeaseManager) ConfirmKey() {
+	glm.rotateLimiter.Reset()
+}
+
+// Follow makes the GCP lease manager react to the events of the Vault lease
+func (glm *GCPLeaseManager) Follow(parent *leaseMgr.Subscription) {
+	glm.parent = parent
 }
 
 func (glm *GCPLeaseManager) GetID() string {
@@ -93,47 +353,187 @@ func (glm *GCPLeaseManager) GetID() string {
 }
 
 func (glm *GCPLeaseManager) GetTTL() int {
+	glm.mutex.RLock()
+	defer glm.mutex.RUnlock()
+
 	return glm.ttl
 }
 
+// GetKeyID returns the private key ID of the current service account key
+func (glm *GCPLeaseManager) GetKeyID() string {
+	glm.mutex.RLock()
+	defer glm.mutex.RUnlock()
+
+	return glm.keyInfo.PrivateKeyID
+}
+
+// GetKeyInfo returns the non-secret metadata of the current service account key
+func (glm *GCPLeaseManager) GetKeyInfo() ServiceAccountKey {
+	glm.mutex.RLock()
+	defer glm.mutex.RUnlock()
+
+	return glm.keyInfo
+}
+
+// GetLeaseID returns the Vault lease ID of the current service account key
+func (glm *GCPLeaseManager) GetLeaseID() string {
+	glm.mutex.RLock()
+	defer glm.mutex.RUnlock()
+
+	return glm.leaseID
+}
+
+// GetServiceAccountKey returns a copy of the current service account key
+// owned by the caller, it is empty once the key has expired, has less than the
+// minimum remaining lifetime left, or has been invalidated
 func (glm *GCPLeaseManager) GetServiceAccountKey() []byte {
-	return glm.serviceAccountKey
+	glm.mutex.RLock()
+	defer glm.mutex.RUnlock()
+
+	if !glm.hasValidKey() {
+		return []byte("")
+	}
+	return glm.serviceAccountKey.Copy()
+}
+
+// CurrentKey returns a copy of the current service account key owned by the
+// caller together with its private key ID and expiry, the key is empty if
+// there is no valid key
+func (glm *GCPLeaseManager) CurrentKey() ([]byte, string, time.Time) {
+	glm.mutex.RLock()
+	defer glm.mutex.RUnlock()
+
+	if !glm.hasValidKey() {
+		return []byte(""), "", time.Time{}
+	}
+	return glm.serviceAccountKey.Copy(), glm.keyInfo.PrivateKeyID, glm.expiresAt
+}
+
+// WaitKey blocks until there is a valid key or ctx is done, it follows the
+// lease events instead of polling
+func (glm *GCPLeaseManager) WaitKey(ctx context.Context) error {
+	// Every waiter has its own subscription, a subscription with the same ID
+	// would replace it
+	id := glm.id + "-wait-" + strconv.FormatUint(atomic.AddUint64(&glm.waiters, 1), 10)
+	subscription := glm.bus.Subscribe(id)
+	defer glm.bus.Unsubscribe(id)
+
+	// Checked once subscribed, a key fetched in between is not missed
+	for !glm.HasValidKey() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case _, ok := <-subscription.Events():
+			if !ok {
+				return errors.New("lease events closed")
+			}
+		}
+	}
+	return nil
+}
+
+// GetExpiresAt returns when the current service account key lease expires, it
+// is zero for a lease without TTL
+func (glm *GCPLeaseManager) GetExpiresAt() time.Time {
+	glm.mutex.RLock()
+	defer glm.mutex.RUnlock()
+
+	return glm.expiresAt
+}
+
+// HasValidKey reports whether the current service account key can still be
+// used, even if degraded
+func (glm *GCPLeaseManager) HasValidKey() bool {
+	glm.mutex.RLock()
+	defer glm.mutex.RUnlock()
+
+	return glm.hasValidKey()
+}
+
+// IsDegraded reports whether the current service account key is still valid
+// but its renewal, or the renewal of the Vault token, is in progress or failing
+func (glm *GCPLeaseManager) IsDegraded() bool {
+	glm.mutex.RLock()
+	defer glm.mutex.RUnlock()
+
+	return glm.degraded
+}
+
+// hasValidKey reports whether the current key has at least the minimum
+// remaining lifetime left
+func (glm *GCPLeaseManager) hasValidKey() bool {
+	if glm.serviceAccountKey.Len() == 0 {
+		return false
+	}
+	return glm.expiresAt.IsZero() || time.Now().Before(glm.expiresAt.Add(-glm.minRemaining))
+}
+
+// checkLifetime rejects a lease too short to be handed out
+func (glm *GCPLeaseManager) checkLifetime(ttl int) error {
+	glm.mutex.RLock()
+	defer glm.mutex.RUnlock()
+
+	if lifetime := time.Duration(ttl) * time.Second; ttl > 0 && lifetime < glm.minRemaining {
+		return errors.Errorf("the lease lasts %s, less than the minimum remaining lifetime %s", lifetime, glm.minRemaining)
+	}
+	return nil
+}
+
+func (glm *GCPLeaseManager) setDegraded(degraded bool) {
+	glm.mutex.Lock()
+	defer glm.mutex.Unlock()
+
+	glm.degraded = degraded
+}
+
+// invalidate wipes the current key and its persisted lease
+func (glm *GCPLeaseManager) invalidate() {
+	glm.wipeKey()
+	glm.discardPersisted()
+}
+
+// wipeKey wipes the current key, its persisted lease is kept for a restart
+func (glm *GCPLeaseManager) wipeKey() {
+	glm.mutex.Lock()
+	defer glm.mutex.Unlock()
+
+	glm.serviceAccountKey.Wipe()
+	glm.serviceAccountKey = nil
+	glm.degraded = false
 }
 
 func (glm *GCPLeaseManager) Daemonize(
 	ctx context.Context,
 	ctxCancelFunc context.CancelFunc,
 	refreshPeriodInSecond time.Duration,
-	earlyRenewalInMinute time.Duration,
+	policy schedule.Policy,
+	registry *health.Registry,
+	schedules *schedule.Registry,
+	events *history.Buffer,
 ) Daemon {
 	return &daemon{
 		gcpLeaseMgr:           glm,
 		refreshPeriodInSecond: refreshPeriodInSecond,
-		earlyRenewalInMinute:  earlyRenewalInMinute,
+		policy:                policy,
 		ctx:                   ctx,
 		ctxCancelFunc:         ctxCancelFunc,
 		waitGroup:             sync.WaitGroup{},
+		status:                registry.Register(glm.id),
+		schedules:             schedules,
+		events:                events,
 		numRetry:              0,
 		stopCh:                make(chan bool),
 	}
 }
 
-func (glm *GCPLeaseManager) Register(service leaseMgr.Observer) {
-	glm.services = append(glm.services, service)
+func (glm *GCPLeaseManager) Register(childLease leaseMgr.Observer) {
+	childLease.Follow(glm.bus.Subscribe(childLease.GetID()))
 }
 
 func (glm *GCPLeaseManager) Deregister(childLease leaseMgr.Observer) {
-	glm.services = leaseMgr.RemoveObserver(glm.services, childLease)
+	glm.bus.Unsubscribe(childLease.GetID())
 }
 
-func (glm *GCPLeaseManager) NotifyAllNewLease() {
-	for _, childLease := range glm.services {
-		childLease.NotifyNewLease()
-	}
-}
-
-func (glm *GCPLeaseManager) NotifyAllStaleLease() {
-	for _, childLease := range glm.services {
-		childLease.NotifyStaleLease()
-	}
+func (glm *GCPLeaseManager) Publish(event leaseMgr.Event) {
+	glm.bus.Publish(event)
 }
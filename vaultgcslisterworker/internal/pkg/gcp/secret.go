@@ -0,0 +1,159 @@
+package gcp
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+const serviceAccountKeyType = "service_account"
+
+// KeyExpectation is the service account a leased key must belong to, empty
+// fields are not checked
+type KeyExpectation struct {
+	ClientEmail string
+	ProjectID   string
+}
+
+// SecretError is returned for a Vault GCP secret that can not be used as a
+// service account key
+type SecretError struct {
+	Field  string
+	Reason string
+}
+
+func (e *SecretError) Error() string {
+	return fmt.Sprintf("invalid %s in Vault GCP secret: %s", e.Field, e.Reason)
+}
+
+// MismatchError is returned for a service account key that does not belong to
+// the expected service account
+type MismatchError struct {
+	Field    string
+	Expected string
+	Actual   string
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("service account key %s is %q, expected %q", e.Field, e.Actual, e.Expected)
+}
+
+type serviceAccountKeyJSON struct {
+	ServiceAccountKey
+	PrivateKey string `json:"private_key"`
+}
+
+// ParseSecret extracts the service account key from the data of a Vault GCP
+// secret. It returns the decoded key JSON with its non-secret metadata, or a
+// *SecretError if the secret is malformed.
+func ParseSecret(data map[string]interface{}) ([]byte, ServiceAccountKey, error) {
+	if data == nil {
+		return nil, ServiceAccountKey{}, &SecretError{Field: "data", Reason: "is empty"}
+	}
+
+	privateKeyDataIfc, ok := data["private_key_data"]
+	if !ok {
+		return nil, ServiceAccountKey{}, &SecretError{Field: "private_key_data", Reason: "is missing"}
+	}
+
+	privateKeyDataB64Str, ok := privateKeyDataIfc.(string)
+	if !ok {
+		return nil, ServiceAccountKey{}, &SecretError{
+			Field:  "private_key_data",
+			Reason: fmt.Sprintf("is a %T instead of a string", privateKeyDataIfc),
+		}
+	}
+
+	privateKeyDataBytes, err := base64.StdEncoding.DecodeString(privateKeyDataB64Str)
+	if err != nil {
+		return nil, ServiceAccountKey{}, &SecretError{Field: "private_key_data", Reason: "is not base64: " + err.Error()}
+	}
+
+	sak, err := parseServiceAccountKey(privateKeyDataBytes)
+	if err != nil {
+		return nil, ServiceAccountKey{}, err
+	}
+	return privateKeyDataBytes, sak, nil
+}
+
+func parseServiceAccountKey(keyJSON []byte) (ServiceAccountKey, error) {
+	parsed := serviceAccountKeyJSON{}
+	if err := json.Unmarshal(keyJSON, &parsed); err != nil {
+		return ServiceAccountKey{}, &SecretError{Field: "private_key_data", Reason: "is not a JSON object: " + err.Error()}
+	}
+
+	if parsed.Type != serviceAccountKeyType {
+		return ServiceAccountKey{}, &SecretError{Field: "type", Reason: fmt.Sprintf("is %q instead of %q", parsed.Type, serviceAccountKeyType)}
+	}
+
+	required := []struct {
+		field string
+		value string
+	}{
+		{"project_id", parsed.ProjectID},
+		{"private_key_id", parsed.PrivateKeyID},
+		{"client_email", parsed.ClientEmail},
+		{"private_key", parsed.PrivateKey},
+		{"token_uri", parsed.TokenURI},
+	}
+	for _, r := range required {
+		if r.value == "" {
+			return ServiceAccountKey{}, &SecretError{Field: r.field, Reason: "is missing"}
+		}
+	}
+
+	if tokenURL, err := url.Parse(parsed.TokenURI); err != nil || !tokenURL.IsAbs() {
+		return ServiceAccountKey{}, &SecretError{Field: "token_uri", Reason: "is not an absolute URL"}
+	}
+
+	if err := validatePrivateKey(parsed.PrivateKey); err != nil {
+		return ServiceAccountKey{}, &SecretError{Field: "private_key", Reason: err.Error()}
+	}
+
+	return parsed.ServiceAccountKey, nil
+}
+
+// validatePrivateKey checks privateKeyPEM holds an RSA private key, the only
+// kind of key GCP issues for service accounts
+func validatePrivateKey(privateKeyPEM string) error {
+	block, _ := pem.Decode([]byte(privateKeyPEM))
+	if block == nil {
+		return errors.New("is not PEM encoded")
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return errors.Wrap(err, "is not a PKCS#8 key")
+		}
+		if _, ok := key.(*rsa.PrivateKey); !ok {
+			return errors.Errorf("is a %T instead of an RSA key", key)
+		}
+	case "RSA PRIVATE KEY":
+		if _, err := x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return errors.Wrap(err, "is not a PKCS#1 key")
+		}
+	default:
+		return errors.Errorf("is a PEM %q block instead of a private key", block.Type)
+	}
+	return nil
+}
+
+// Check returns a *MismatchError if sak does not belong to the expected
+// service account
+func (expected KeyExpectation) Check(sak ServiceAccountKey) error {
+	if expected.ClientEmail != "" && sak.ClientEmail != expected.ClientEmail {
+		return &MismatchError{Field: "client_email", Expected: expected.ClientEmail, Actual: sak.ClientEmail}
+	}
+	if expected.ProjectID != "" && sak.ProjectID != expected.ProjectID {
+		return &MismatchError{Field: "project_id", Expected: expected.ProjectID, Actual: sak.ProjectID}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package gcs
+
+import (
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	defaultPageSize int = 100
+)
+
+// Bucket is the structured metadata collected for every listed bucket
+type Bucket struct {
+	Name                     string            `json:"name"`
+	Location                 string            `json:"location"`
+	LocationType             string            `json:"location_type,omitempty"`
+	StorageClass             string            `json:"storage_class"`
+	Labels                   map[string]string `json:"labels,omitempty"`
+	VersioningEnabled        bool              `json:"versioning_enabled"`
+	RetentionPolicy          *RetentionPolicy  `json:"retention_policy,omitempty"`
+	UniformBucketLevelAccess bool              `json:"uniform_bucket_level_access"`
+	Created                  time.Time         `json:"created"`
+}
+
+// RetentionPolicy is the retention policy of a bucket
+type RetentionPolicy struct {
+	RetentionPeriod time.Duration `json:"retention_period"`
+	EffectiveTime   time.Time     `json:"effective_time"`
+	IsLocked        bool          `json:"is_locked"`
+}
+
+// ListOptions controls how the buckets are listed
+type ListOptions struct {
+	// Prefix restricts the listing to buckets whose names begin with it
+	Prefix string
+	// PageSize is the number of buckets requested per page, defaults to defaultPageSize
+	PageSize int
+}
+
+func newBucket(attrs *storage.BucketAttrs) Bucket {
+	bucket := Bucket{
+		Name:                     attrs.Name,
+		Location:                 attrs.Location,
+		LocationType:             attrs.LocationType,
+		StorageClass:             attrs.StorageClass,
+		Labels:                   attrs.Labels,
+		VersioningEnabled:        attrs.VersioningEnabled,
+		UniformBucketLevelAccess: attrs.UniformBucketLevelAccess.Enabled,
+		Created:                  attrs.Created,
+	}
+
+	if attrs.RetentionPolicy != nil {
+		bucket.RetentionPolicy = &RetentionPolicy{
+			RetentionPeriod: attrs.RetentionPolicy.RetentionPeriod,
+			EffectiveTime:   attrs.RetentionPolicy.EffectiveTime,
+			IsLocked:        attrs.RetentionPolicy.IsLocked,
+		}
+	}
+
+	return bucket
+}
+
+// BucketNames returns the names of the given buckets
+func BucketNames(buckets []Bucket) []string {
+	names := make([]string, 0, len(buckets))
+	for _, bucket := range buckets {
+		names = append(names, bucket.Name)
+	}
+	return names
+}
@@ -6,9 +6,14 @@ import (
 	"sync"
 	"time"
 
-	"github.com/cermati/devops-toolkit/common-libs/toolkit-go/pkg/log"
-
-	leaseUtil "github.com/mikeadityas/vault-gcs-lister/internal/pkg/util/lease"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/health"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/history"
+	leaseMgr "github.com/mikeadityas/vault-gcs-lister/internal/pkg/leasemanager"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/log"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/tracing"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/util/errclass"
 )
 
 const (
@@ -28,26 +33,32 @@ type daemon struct {
 	ctxCancelFunc                context.CancelFunc
 	waitGroup                    sync.WaitGroup
 	ticker                       *time.Ticker
+	status                       *health.Status
+	events                       *history.Buffer
 	numRetry                     int
 	stopCh                       chan bool
 }
 
 func (d *daemon) Start() error {
-	d.listBucket()
+	d.scheduledListBucket(d.ctx, "start")
 	go func() {
+		parentEvents := d.bucketListerSvc.parent.Events()
 		for {
 			select {
 			case <-d.ctx.Done():
 				d.stopCh <- true
 				return
-			case <-d.bucketListerSvc.forceStopCh:
-				log.Logger.Sugar().Warn("GCS daemon received force stop notification")
-				d.ticker.Stop()
-			case <-d.bucketListerSvc.forceNewCh:
-				log.Logger.Sugar().Info("GCS daemon received force new notification")
-				d.listBucket()
-			case <-d.ticker.C:
-				d.listBucket()
+			case event, ok := <-parentEvents:
+				if !ok {
+					parentEvents = nil
+					continue
+				}
+				d.handleParentEvent(event)
+			case <-d.bucketListerSvc.listCh:
+				log.Logger.Sugar().Info("GCS daemon received listing request")
+				d.listBucket(d.ctx, "request")
+			case <-d.tickerCh():
+				d.scheduledListBucket(d.ctx, "schedule")
 			}
 		}
 	}()
@@ -64,24 +75,107 @@ func (d *daemon) Stop() error {
 	return nil
 }
 
-func (d *daemon) listBucket() {
+func (d *daemon) handleParentEvent(event leaseMgr.Event) {
+	switch e := event.(type) {
+	case leaseMgr.ExpiringEvent:
+		log.Logger.Sugar().Infow(
+			"GCS daemon received expiring lease notification, listing with the degraded key",
+			"key_expires_at", e.ExpiresAt.Format(time.RFC3339),
+		)
+	case leaseMgr.StaleLeaseEvent:
+		log.Logger.Sugar().Warnw("GCS daemon received stale lease notification", "reason", e.Reason)
+		d.stopTicker()
+	case leaseMgr.RevokedEvent:
+		log.Logger.Sugar().Warnw("GCS daemon received revoked lease notification", "reason", e.Reason)
+		d.stopTicker()
+	case leaseMgr.NewLeaseEvent:
+		log.Logger.Sugar().Infow("GCS daemon received new lease notification", "private_key_id", e.KeyID)
+		d.scheduledListBucket(leaseMgr.ContextWithCause(d.ctx, event), "new_lease")
+	}
+}
+
+// scheduledListBucket lists the buckets unless the lister is paused, the
+// ticker keeps running while paused
+func (d *daemon) scheduledListBucket(ctx context.Context, trigger string) {
+	if d.bucketListerSvc.IsPaused() {
+		log.Logger.Sugar().Infow("GCS lister is paused, skipping listing", "project_id", d.bucketListerSvc.projectID)
+		return
+	}
+	d.listBucket(ctx, trigger)
+}
+
+// listBucket lists the buckets, trigger names what asked for it in the trace
+func (d *daemon) listBucket(ctx context.Context, trigger string) {
 	d.waitGroup.Add(1)
 	defer d.waitGroup.Done()
 
-	log.Logger.Sugar().Infow("Listing GCS buckets", "project_id", d.bucketListerSvc.projectID)
-	buckets, err := d.bucketListerSvc.ListBucket()
+	ctx, span := tracing.Start(
+		ctx,
+		"gcs.list_buckets",
+		attribute.String("lister.id", d.bucketListerSvc.id),
+		attribute.String("gcp.project_id", d.bucketListerSvc.projectID),
+		attribute.String("trigger", trigger),
+	)
+	var err error
+	defer func() { tracing.End(span, err) }()
+
+	log.Logger.Sugar().Infow(
+		"Listing GCS buckets",
+		"project_id", d.bucketListerSvc.projectID,
+		"degraded", d.bucketListerSvc.gcpLeaseMgr.IsDegraded(),
+	)
+	buckets, err := d.bucketListerSvc.ListBucket(ctx)
 	if err != nil {
-		d.currentRefreshPeriodInSecond = leaseUtil.CalculateBackoffTime(d.numRetry, maxBackoff)
+		errClass, retryAfter := errclass.Classify(err)
+		d.events.Record(
+			d.bucketListerSvc.id,
+			history.ListingFailed,
+			"Failed to list GCS buckets",
+			"project_id", d.bucketListerSvc.projectID,
+			"private_key_id", d.bucketListerSvc.gcpLeaseMgr.GetKeyID(),
+			"err", err,
+			"err.class", errClass,
+		)
+		if errClass == errclass.AuthExpired {
+			d.requestRotation(ctx, err)
+		}
 
-		if d.ticker != nil {
-			d.ticker.Stop()
+		if errClass.IsPermanent() {
+			d.status.SetFailed(string(errClass), err, d.numRetry)
+		} else {
+			d.status.SetRetrying(string(errClass), err, d.numRetry)
 		}
+
+		d.stopTicker()
+
+		retryPeriod, retry := errClass.RetryDelay(retryAfter, d.numRetry, maxBackoff)
+		if !retry {
+			d.events.Record(d.bucketListerSvc.id, history.Failed, "Failed to list GCS buckets, not retrying", "err.class", errClass)
+			log.Logger.Sugar().Errorw(
+				"Failed to list GCS buckets, not retrying until the config is fixed.",
+				"project_id", d.bucketListerSvc.projectID,
+				"err", err,
+				"err.class", errClass,
+			)
+			return
+		}
+
+		d.currentRefreshPeriodInSecond = retryPeriod
 		d.ticker = time.NewTicker(d.currentRefreshPeriodInSecond)
+		d.status.SetNextRun(time.Now().Add(d.currentRefreshPeriodInSecond))
+		d.events.Record(
+			d.bucketListerSvc.id,
+			history.BackoffScheduled,
+			"GCS listing retry scheduled",
+			"retry.num", d.numRetry,
+			"retry.interval", d.currentRefreshPeriodInSecond,
+		)
 
 		log.Logger.Sugar().Errorw(
 			"Failed to list GCS buckets.",
 			"project_id", d.bucketListerSvc.projectID,
 			"err", err,
+			"err.class", errClass,
 			"retry.num", d.numRetry,
 			"retry.interval", d.currentRefreshPeriodInSecond,
 			"retry.next", time.Now().Add(d.currentRefreshPeriodInSecond).Format(time.RFC3339),
@@ -91,15 +185,64 @@ func (d *daemon) listBucket() {
 		return
 	}
 
-	log.Logger.Sugar().Infof("Buckets in %s: %s", d.bucketListerSvc.projectID, strings.Join(buckets, ", "))
+	log.Logger.Sugar().Infof("Buckets in %s: %s", d.bucketListerSvc.projectID, strings.Join(BucketNames(buckets), ", "))
+	d.bucketListerSvc.publish(&Listing{
+		ListerID:  d.bucketListerSvc.id,
+		ProjectID: d.bucketListerSvc.projectID,
+		ListedAt:  time.Now(),
+		Buckets:   buckets,
+	})
+	d.bucketListerSvc.gcpLeaseMgr.ConfirmKey()
+	d.events.Record(
+		d.bucketListerSvc.id,
+		history.ListingSucceeded,
+		"GCS buckets listed",
+		"project_id", d.bucketListerSvc.projectID,
+		"private_key_id", d.bucketListerSvc.gcpLeaseMgr.GetKeyID(),
+		"buckets", len(buckets),
+	)
+	d.status.SetHealthy()
 	d.numRetry = 0
 	d.currentRefreshPeriodInSecond = time.Duration(d.desiredRefreshPeriodInSecond)
 
-	if d.ticker != nil {
-		d.ticker.Stop()
-	}
+	d.stopTicker()
 	d.ticker = time.NewTicker(d.currentRefreshPeriodInSecond)
+	d.status.SetNextRun(time.Now().Add(d.currentRefreshPeriodInSecond))
 
 	gcsNextListing := time.Now().Add(d.currentRefreshPeriodInSecond)
 	log.Logger.Sugar().Infow("Next GCS listing", "listing_time", gcsNextListing.Format(time.RFC3339))
 }
+
+func (d *daemon) tickerCh() <-chan time.Time {
+	if d.ticker == nil {
+		return nil
+	}
+	return d.ticker.C
+}
+
+func (d *daemon) stopTicker() {
+	if d.ticker != nil {
+		d.ticker.Stop()
+		d.ticker = nil
+	}
+	d.status.SetNextRun(time.Time{})
+}
+
+// requestRotation asks the GCP lease manager for a new key after GCS rejected
+// the current one
+func (d *daemon) requestRotation(ctx context.Context, err error) {
+	gcpLeaseMgr := d.bucketListerSvc.gcpLeaseMgr
+	if gcpLeaseMgr.RequestRotation(ctx, "GCS rejected the key: "+err.Error()) {
+		log.Logger.Sugar().Warnw(
+			"GCS rejected the GCP service account key, requested a new key",
+			"private_key_id", gcpLeaseMgr.GetKeyID(),
+		)
+		return
+	}
+
+	log.Logger.Sugar().Warnw(
+		"GCS rejected the GCP service account key, key rotation is rate limited",
+		"private_key_id", gcpLeaseMgr.GetKeyID(),
+		"rotation.next", gcpLeaseMgr.NextRotation().Format(time.RFC3339),
+	)
+}
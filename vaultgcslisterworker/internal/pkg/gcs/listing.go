@@ -0,0 +1,39 @@
+package gcs
+
+import (
+	"time"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/log"
+)
+
+// Listing is the result of a successful bucket listing
+type Listing struct {
+	ListerID  string    `json:"lister_id"`
+	ProjectID string    `json:"project_id"`
+	ListedAt  time.Time `json:"listed_at"`
+	Buckets   []Bucket  `json:"buckets"`
+}
+
+// Sink is the interface for the destinations of the listing results
+type Sink interface {
+	Write(listing *Listing) error
+	Close() error
+}
+
+func (bls *BucketListerService) RegisterSink(sink Sink) {
+	bls.sinks = append(bls.sinks, sink)
+}
+
+// publish writes the listing to every registered sink. A failing sink is only
+// logged so it never affects the lease chain.
+func (bls *BucketListerService) publish(listing *Listing) {
+	for _, sink := range bls.sinks {
+		if err := sink.Write(listing); err != nil {
+			log.Logger.Sugar().Errorw(
+				"Failed to write GCS listing to sink",
+				"lister_id", bls.id,
+				"err", err,
+			)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package gcs
+
+import (
+	"errors"
+	"testing"
+)
+
+// recordingSink keeps the listings written to it, failing every write with
+// err if set
+type recordingSink struct {
+	err      error
+	listings []*Listing
+}
+
+func (rs *recordingSink) Write(listing *Listing) error {
+	rs.listings = append(rs.listings, listing)
+	return rs.err
+}
+
+func (rs *recordingSink) Close() error {
+	return nil
+}
+
+func TestPublishIgnoresFailingSink(t *testing.T) {
+	failing := &recordingSink{err: errors.New("webhook returned 502 Bad Gateway")}
+	healthy := &recordingSink{}
+
+	bls := &BucketListerService{id: "gcs-infra", projectID: "infra"}
+	bls.RegisterSink(failing)
+	bls.RegisterSink(healthy)
+
+	listing := &Listing{ListerID: "gcs-infra", ProjectID: "infra"}
+	bls.publish(listing)
+	bls.publish(listing)
+
+	if len(failing.listings) != 2 {
+		t.Fatalf("expected the failing sink to get every listing, got %d", len(failing.listings))
+	}
+	if len(healthy.listings) != 2 {
+		t.Fatalf("expected a failing sink not to affect the next one, got %d listings", len(healthy.listings))
+	}
+}
@@ -6,10 +6,17 @@ import (
 	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 
 	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/gcp"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/health"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/history"
+	leaseMgr "github.com/mikeadityas/vault-gcs-lister/internal/pkg/leasemanager"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/tracing"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/util/secret"
 )
 
 type BucketListerService struct {
@@ -17,9 +24,14 @@ type BucketListerService struct {
 	ctxCancelFunc context.CancelFunc
 	id            string
 	projectID     string
-	forceNewCh    chan bool
-	forceStopCh   chan bool
 	gcpLeaseMgr   *gcp.GCPLeaseManager
+	parent        *leaseMgr.Subscription
+	listOpts      ListOptions
+	sinks         []Sink
+
+	listCh chan struct{}
+	mutex  sync.RWMutex
+	paused bool
 }
 
 func NewBucketListerService(
@@ -27,57 +39,120 @@ func NewBucketListerService(
 	ctxCancelFunc context.CancelFunc,
 	id, projectID string,
 	gcpLeaseMgr *gcp.GCPLeaseManager,
+	listOpts ListOptions,
 ) *BucketListerService {
 	return &BucketListerService{
 		ctx:           ctx,
 		ctxCancelFunc: ctxCancelFunc,
 		id:            id,
 		projectID:     projectID,
-		forceNewCh:    make(chan bool, 1),
-		forceStopCh:   make(chan bool, 1),
 		gcpLeaseMgr:   gcpLeaseMgr,
+		listOpts:      listOpts,
+		listCh:        make(chan struct{}, 1),
 	}
 }
 
-func (bls *BucketListerService) ListBucket() ([]string, error) {
-	client, err := storage.NewClient(
-		bls.ctx,
-		option.WithCredentialsJSON(bls.gcpLeaseMgr.GetServiceAccountKey()),
-	)
+func (bls *BucketListerService) ListBucket(ctx context.Context) ([]Bucket, error) {
+	serviceAccountKey := bls.gcpLeaseMgr.GetServiceAccountKey()
+	if len(serviceAccountKey) == 0 {
+		return nil, errors.New("no valid GCP service account key")
+	}
+	// Deferred first so it runs after the client holding the key is closed
+	defer secret.Zero(serviceAccountKey)
+
+	client, err := bls.newStorageClient(ctx, serviceAccountKey)
 	if err != nil {
 		return nil, err
 	}
+	defer client.Close()
 
-	var buckets []string
-	bucketIter := client.Buckets(bls.ctx, bls.projectID)
-	for {
-		bucketAttributes, err := bucketIter.Next()
-		if err == iterator.Done {
-			break
-		}
+	bucketIter := client.Buckets(ctx, bls.projectID)
+	bucketIter.Prefix = bls.listOpts.Prefix
+
+	pageSize := bls.listOpts.PageSize
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
 
+	var buckets []Bucket
+	pager := iterator.NewPager(bucketIter, pageSize, "")
+	for pageNum := 0; ; pageNum++ {
+		page, nextPageToken, err := nextPage(ctx, pager, pageNum)
 		if err != nil {
 			return nil, err
 		}
-		buckets = append(buckets, bucketAttributes.Name)
+
+		for _, bucketAttributes := range page {
+			buckets = append(buckets, newBucket(bucketAttributes))
+		}
+
+		if nextPageToken == "" {
+			break
+		}
 	}
 
 	return buckets, nil
 }
 
-func (bls *BucketListerService) NotifyNewLease() {
-	bls.forceNewCh <- true
+func (bls *BucketListerService) newStorageClient(ctx context.Context, serviceAccountKey []byte) (client *storage.Client, err error) {
+	ctx, span := tracing.Start(ctx, "gcs.new_client", attribute.String("gcp.private_key_id", bls.gcpLeaseMgr.GetKeyID()))
+	defer func() { tracing.End(span, err) }()
+
+	return storage.NewClient(ctx, option.WithCredentialsJSON(serviceAccountKey))
+}
+
+// nextPage fetches a page of buckets, each page is a span of the listing
+func nextPage(ctx context.Context, pager *iterator.Pager, pageNum int) (page []*storage.BucketAttrs, nextPageToken string, err error) {
+	_, span := tracing.Start(ctx, "gcs.list_page", attribute.Int("page", pageNum))
+	defer func() { tracing.End(span, err) }()
+
+	nextPageToken, err = pager.NextPage(&page)
+	span.SetAttributes(attribute.Int("buckets", len(page)))
+	return page, nextPageToken, err
 }
 
-func (bls *BucketListerService) NotifyStaleLease() {
-	bls.forceStopCh <- true
+// Follow makes the lister react to the events of the GCP lease
+func (bls *BucketListerService) Follow(parent *leaseMgr.Subscription) {
+	bls.parent = parent
 }
 
 func (bls *BucketListerService) GetID() string {
 	return bls.id
 }
 
-func (bls *BucketListerService) Daemonize(refreshPeriodInSecond time.Duration) Daemon {
+// RequestListing asks the daemon to list the buckets now, even if paused
+func (bls *BucketListerService) RequestListing() {
+	select {
+	case bls.listCh <- struct{}{}:
+	default:
+	}
+}
+
+// Pause skips the scheduled listings until Resume
+func (bls *BucketListerService) Pause() {
+	bls.mutex.Lock()
+	defer bls.mutex.Unlock()
+
+	bls.paused = true
+}
+
+// Resume resumes the scheduled listings, listing the buckets right away
+func (bls *BucketListerService) Resume() {
+	bls.mutex.Lock()
+	bls.paused = false
+	bls.mutex.Unlock()
+
+	bls.RequestListing()
+}
+
+func (bls *BucketListerService) IsPaused() bool {
+	bls.mutex.RLock()
+	defer bls.mutex.RUnlock()
+
+	return bls.paused
+}
+
+func (bls *BucketListerService) Daemonize(refreshPeriodInSecond time.Duration, registry *health.Registry, events *history.Buffer) Daemon {
 	return &daemon{
 		bucketListerSvc:              bls,
 		desiredRefreshPeriodInSecond: refreshPeriodInSecond,
@@ -85,6 +160,8 @@ func (bls *BucketListerService) Daemonize(refreshPeriodInSecond time.Duration) D
 		ctx:                          bls.ctx,
 		ctxCancelFunc:                bls.ctxCancelFunc,
 		waitGroup:                    sync.WaitGroup{},
+		status:                       registry.Register(bls.id),
+		events:                       events,
 		numRetry:                     0,
 		stopCh:                       make(chan bool),
 	}
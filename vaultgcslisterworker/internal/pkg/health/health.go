@@ -0,0 +1,199 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// State is the state of a component of the lease chain
+type State string
+
+const (
+	StateStarting State = "starting"
+	StateHealthy  State = "healthy"
+	StateDegraded State = "degraded"
+	StateRetrying State = "retrying"
+	StateFailed   State = "failed"
+)
+
+// Status is the health of a single component, updated by its daemon
+type Status struct {
+	mutex     sync.RWMutex
+	component string
+	state     State
+	errClass  string
+	lastErr   string
+	numRetry  int
+	updatedAt time.Time
+
+	lastSuccessAt time.Time
+	nextRunAt     time.Time
+}
+
+// Snapshot is a point in time copy of a Status
+type Snapshot struct {
+	Component string    `json:"component"`
+	State     State     `json:"state"`
+	ErrClass  string    `json:"err_class,omitempty"`
+	LastErr   string    `json:"last_err,omitempty"`
+	NumRetry  int       `json:"num_retry"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// LastSuccessAt and NextRunAt are zero if the component never succeeded
+	// or has nothing scheduled
+	LastSuccessAt time.Time `json:"last_success_at"`
+	NextRunAt     time.Time `json:"next_run_at"`
+}
+
+func (s *Status) SetHealthy() {
+	s.set(StateHealthy, "", nil, 0)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lastSuccessAt = s.updatedAt
+}
+
+// SetNextRun records when the component runs next, zero if nothing is
+// scheduled
+func (s *Status) SetNextRun(nextRunAt time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.nextRunAt = nextRunAt
+}
+
+// SetDegraded marks the component as working with a credential whose renewal
+// is in progress or failing
+func (s *Status) SetDegraded(reason string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.state = StateDegraded
+	s.lastErr = reason
+	s.updatedAt = time.Now()
+}
+
+func (s *Status) SetRetrying(errClass string, err error, numRetry int) {
+	s.set(StateRetrying, errClass, err, numRetry)
+}
+
+// SetFailed marks the component as failed with an error that retrying does
+// not fix
+func (s *Status) SetFailed(errClass string, err error, numRetry int) {
+	s.set(StateFailed, errClass, err, numRetry)
+}
+
+func (s *Status) set(state State, errClass string, err error, numRetry int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.state = state
+	s.errClass = errClass
+	s.lastErr = ""
+	if err != nil {
+		s.lastErr = err.Error()
+	}
+	s.numRetry = numRetry
+	s.updatedAt = time.Now()
+}
+
+func (s *Status) Snapshot() Snapshot {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return Snapshot{
+		Component: s.component,
+		State:     s.state,
+		ErrClass:  s.errClass,
+		LastErr:   s.lastErr,
+		NumRetry:  s.numRetry,
+		UpdatedAt: s.updatedAt,
+
+		LastSuccessAt: s.lastSuccessAt,
+		NextRunAt:     s.nextRunAt,
+	}
+}
+
+// Registry holds the status of every component of a lease chain
+type Registry struct {
+	mutex    sync.RWMutex
+	statuses map[string]*Status
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		statuses: map[string]*Status{},
+	}
+}
+
+// Register returns the status of the component, creating it if needed
+func (r *Registry) Register(component string) *Status {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if status, ok := r.statuses[component]; ok {
+		return status
+	}
+
+	status := &Status{
+		component: component,
+		state:     StateStarting,
+		updatedAt: time.Now(),
+	}
+	r.statuses[component] = status
+	return status
+}
+
+// Lookup returns the status of the component, it is false if the component
+// is not registered
+func (r *Registry) Lookup(component string) (Snapshot, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	status, ok := r.statuses[component]
+	if !ok {
+		return Snapshot{}, false
+	}
+	return status.Snapshot(), true
+}
+
+func (r *Registry) Snapshots() []Snapshot {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	snapshots := make([]Snapshot, 0, len(r.statuses))
+	for _, status := range r.statuses {
+		snapshots = append(snapshots, status.Snapshot())
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Component < snapshots[j].Component })
+	return snapshots
+}
+
+// Handler serves /healthz, which answers 200 as long as the process runs, and
+// /readyz, which answers 503 once any component has failed. Both return the
+// status of every component as JSON.
+func (r *Registry) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		r.writeSnapshots(w, http.StatusOK)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		statusCode := http.StatusOK
+		for _, snapshot := range r.Snapshots() {
+			if snapshot.State == StateFailed {
+				statusCode = http.StatusServiceUnavailable
+			}
+		}
+		r.writeSnapshots(w, statusCode)
+	})
+	return mux
+}
+
+func (r *Registry) writeSnapshots(w http.ResponseWriter, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(r.Snapshots())
+}
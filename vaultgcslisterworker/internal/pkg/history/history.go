@@ -0,0 +1,236 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/log"
+)
+
+// DefaultCapacity is the number of events kept by a buffer created without
+// capacity
+const DefaultCapacity = 1000
+
+// Kind is the kind of a lease lifecycle event
+type Kind string
+
+const (
+	TokenRenewed     Kind = "token_renewed"
+	KeyFetched       Kind = "key_fetched"
+	KeyRestored      Kind = "key_restored"
+	Expiring         Kind = "expiring"
+	StaleLease       Kind = "stale_lease"
+	Revoked          Kind = "revoked"
+	ForceNew         Kind = "force_new"
+	ListingSucceeded Kind = "listing_succeeded"
+	ListingFailed    Kind = "listing_failed"
+	BackoffScheduled Kind = "backoff_scheduled"
+	Failed           Kind = "failed"
+	LeaderElected    Kind = "leader_elected"
+	LeaderLost       Kind = "leader_lost"
+)
+
+// Event is a lease lifecycle event of a component
+type Event struct {
+	Time      time.Time         `json:"time"`
+	Component string            `json:"component"`
+	Kind      Kind              `json:"kind"`
+	Message   string            `json:"message,omitempty"`
+	Fields    map[string]string `json:"fields,omitempty"`
+}
+
+// Filter selects events, empty fields select every event
+type Filter struct {
+	Components []string
+	Kinds      []Kind
+	Since      time.Time
+	Until      time.Time
+	// Limit keeps only the most recent events
+	Limit int
+}
+
+// Buffer keeps the most recent events of a lease chain, older events are
+// overwritten once it is full
+type Buffer struct {
+	mutex  sync.RWMutex
+	events []Event
+	next   int
+	full   bool
+}
+
+func NewBuffer(capacity int) *Buffer {
+	if capacity <= 0 {
+		capacity = DefaultCapacity
+	}
+	return &Buffer{
+		events: make([]Event, capacity),
+	}
+}
+
+// Record records an event of the component, keysAndValues are alternating
+// field names and values like the ones of the sugared logger
+func (b *Buffer) Record(component string, kind Kind, message string, keysAndValues ...interface{}) {
+	event := Event{
+		Time:      time.Now(),
+		Component: component,
+		Kind:      kind,
+		Message:   message,
+	}
+	if len(keysAndValues) > 0 {
+		event.Fields = map[string]string{}
+		for idx := 0; idx+1 < len(keysAndValues); idx += 2 {
+			event.Fields[fmt.Sprint(keysAndValues[idx])] = fmt.Sprint(keysAndValues[idx+1])
+		}
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.events[b.next] = event
+	b.next = (b.next + 1) % len(b.events)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// Events returns the events selected by filter, oldest first
+func (b *Buffer) Events(filter Filter) []Event {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	ordered := b.events[:b.next]
+	if b.full {
+		ordered = append(append([]Event{}, b.events[b.next:]...), b.events[:b.next]...)
+	}
+
+	events := []Event{}
+	for _, event := range ordered {
+		if filter.matches(event) {
+			events = append(events, event)
+		}
+	}
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[len(events)-filter.Limit:]
+	}
+	return events
+}
+
+// Handler serves /debug/events, which returns the events as JSON. The
+// component and kind queries take comma separated values, since and until
+// take an RFC3339 time or a duration before now such as 15m, and limit keeps
+// only the most recent events.
+func (b *Buffer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/events", func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseFilter(r, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b.Events(filter))
+	})
+	return mux
+}
+
+// Dump logs every event, so the history survives in the logs once the
+// process stops
+func (b *Buffer) Dump() {
+	events := b.Events(Filter{})
+	log.Logger.Sugar().Infow("Dumping event history", "events", len(events))
+	for _, event := range events {
+		log.Logger.Sugar().Infow(
+			"Event history",
+			"event.time", event.Time.Format(time.RFC3339Nano),
+			"event.component", event.Component,
+			"event.kind", event.Kind,
+			"event.message", event.Message,
+			"event.fields", event.Fields,
+		)
+	}
+}
+
+func (f Filter) matches(event Event) bool {
+	if len(f.Components) > 0 && !contains(f.Components, event.Component) {
+		return false
+	}
+	if len(f.Kinds) > 0 {
+		kinds := make([]string, 0, len(f.Kinds))
+		for _, kind := range f.Kinds {
+			kinds = append(kinds, string(kind))
+		}
+		if !contains(kinds, string(event.Kind)) {
+			return false
+		}
+	}
+	if !f.Since.IsZero() && event.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && event.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+func parseFilter(r *http.Request, now time.Time) (Filter, error) {
+	query := r.URL.Query()
+	filter := Filter{
+		Components: splitQuery(query.Get("component")),
+	}
+	for _, kind := range splitQuery(query.Get("kind")) {
+		filter.Kinds = append(filter.Kinds, Kind(kind))
+	}
+
+	var err error
+	if filter.Since, err = parseTime(query.Get("since"), now); err != nil {
+		return Filter{}, errors.Wrap(err, "invalid since")
+	}
+	if filter.Until, err = parseTime(query.Get("until"), now); err != nil {
+		return Filter{}, errors.Wrap(err, "invalid until")
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit < 0 {
+			return Filter{}, errors.Errorf("invalid limit %q", limit)
+		}
+	}
+	return filter, nil
+}
+
+// parseTime parses an RFC3339 time or a duration before now
+func parseTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if ago, err := time.ParseDuration(value); err == nil {
+		return now.Add(-ago), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func splitQuery(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
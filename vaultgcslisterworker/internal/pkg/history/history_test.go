@@ -0,0 +1,116 @@
+package history
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func messages(events []Event) []string {
+	var messages []string
+	for _, event := range events {
+		messages = append(messages, event.Message)
+	}
+	return messages
+}
+
+func TestBufferWrapAround(t *testing.T) {
+	buffer := NewBuffer(3)
+	if events := buffer.Events(Filter{}); len(events) != 0 {
+		t.Fatalf("expected no events, got %+v", events)
+	}
+
+	buffer.Record("vault", TokenRenewed, "1")
+	buffer.Record("vault", TokenRenewed, "2")
+	if got := messages(buffer.Events(Filter{})); !reflect.DeepEqual(got, []string{"1", "2"}) {
+		t.Fatalf("unexpected events %v", got)
+	}
+
+	// Filling the buffer exactly keeps every event
+	buffer.Record("vault", TokenRenewed, "3")
+	if got := messages(buffer.Events(Filter{})); !reflect.DeepEqual(got, []string{"1", "2", "3"}) {
+		t.Fatalf("unexpected events %v", got)
+	}
+
+	// The oldest events are overwritten, the rest stays oldest first
+	for i := 4; i <= 7; i++ {
+		buffer.Record("vault", TokenRenewed, strconv.Itoa(i))
+	}
+	if got := messages(buffer.Events(Filter{})); !reflect.DeepEqual(got, []string{"5", "6", "7"}) {
+		t.Fatalf("unexpected events %v", got)
+	}
+	if got := messages(buffer.Events(Filter{Limit: 2})); !reflect.DeepEqual(got, []string{"6", "7"}) {
+		t.Fatalf("expected the most recent events, got %v", got)
+	}
+}
+
+func TestBufferFilter(t *testing.T) {
+	buffer := NewBuffer(10)
+	buffer.Record("vault", TokenRenewed, "renewed")
+	buffer.Record("gcp-infra", KeyFetched, "fetched", "private_key_id", "key-1", "retry.num", 2)
+	buffer.Record("gcp-data", StaleLease, "stale")
+
+	events := buffer.Events(Filter{Components: []string{"gcp-infra"}})
+	if len(events) != 1 || events[0].Kind != KeyFetched {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	if expected := map[string]string{"private_key_id": "key-1", "retry.num": "2"}; !reflect.DeepEqual(events[0].Fields, expected) {
+		t.Fatalf("expected the fields %v, got %v", expected, events[0].Fields)
+	}
+
+	if got := messages(buffer.Events(Filter{Kinds: []Kind{TokenRenewed, StaleLease}})); !reflect.DeepEqual(got, []string{"renewed", "stale"}) {
+		t.Fatalf("unexpected events %v", got)
+	}
+	if events := buffer.Events(Filter{Since: time.Now().Add(time.Minute)}); len(events) != 0 {
+		t.Fatalf("expected no events in the future, got %+v", events)
+	}
+	if events := buffer.Events(Filter{Until: time.Now().Add(-time.Minute)}); len(events) != 0 {
+		t.Fatalf("expected no events a minute ago, got %+v", events)
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	now := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+
+	tests := []struct {
+		query    string
+		expected Filter
+		invalid  bool
+	}{
+		{query: "", expected: Filter{}},
+		{
+			query:    "component=vault,+gcp-infra+,&kind=key_fetched,stale_lease",
+			expected: Filter{Components: []string{"vault", "gcp-infra"}, Kinds: []Kind{KeyFetched, StaleLease}},
+		},
+		{query: "since=15m", expected: Filter{Since: now.Add(-15 * time.Minute)}},
+		{
+			query:    "since=2024-05-06T06:00:00Z&until=1h",
+			expected: Filter{Since: time.Date(2024, 5, 6, 6, 0, 0, 0, time.UTC), Until: now.Add(-time.Hour)},
+		},
+		{query: "limit=20", expected: Filter{Limit: 20}},
+		{query: "since=yesterday", invalid: true},
+		{query: "until=2024-05-06", invalid: true},
+		{query: "limit=-1", invalid: true},
+		{query: "limit=many", invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			filter, err := parseFilter(httptest.NewRequest("GET", "/debug/events?"+tt.query, nil), now)
+			if tt.invalid {
+				if err == nil {
+					t.Fatalf("expected %q to be rejected, got %+v", tt.query, filter)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !reflect.DeepEqual(filter, tt.expected) {
+				t.Fatalf("expected %+v, got %+v", tt.expected, filter)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package leasemanager
+
+import (
+	"sync"
+)
+
+// Bus delivers lease events to its subscriptions. Publishing never blocks:
+// every subscription buffers its pending events and coalesces the redundant
+// ones, so a slow consumer only ever sees the latest lease state.
+type Bus struct {
+	mutex         sync.Mutex
+	subscriptions map[string]*Subscription
+}
+
+func NewBus() *Bus {
+	return &Bus{
+		subscriptions: map[string]*Subscription{},
+	}
+}
+
+// Subscribe creates the subscription of id, replacing its previous one
+func (b *Bus) Subscribe(id string) *Subscription {
+	subscription := newSubscription(id)
+
+	b.mutex.Lock()
+	previous := b.subscriptions[id]
+	b.subscriptions[id] = subscription
+	b.mutex.Unlock()
+
+	if previous != nil {
+		previous.close()
+	}
+	return subscription
+}
+
+// Unsubscribe closes the subscription of id
+func (b *Bus) Unsubscribe(id string) {
+	b.mutex.Lock()
+	subscription := b.subscriptions[id]
+	delete(b.subscriptions, id)
+	b.mutex.Unlock()
+
+	if subscription != nil {
+		subscription.close()
+	}
+}
+
+// Publish queues the event to every subscription without blocking
+func (b *Bus) Publish(event Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, subscription := range b.subscriptions {
+		subscription.push(event)
+	}
+}
+
+// Subscription is the event stream of a single consumer
+type Subscription struct {
+	id string
+
+	mutex    sync.Mutex
+	pending  []Event
+	closed   bool
+	notifyCh chan bool
+	eventCh  chan Event
+	doneCh   chan bool
+}
+
+func newSubscription(id string) *Subscription {
+	subscription := &Subscription{
+		id:       id,
+		notifyCh: make(chan bool, 1),
+		eventCh:  make(chan Event),
+		doneCh:   make(chan bool),
+	}
+	go subscription.run()
+	return subscription
+}
+
+// Events returns the channel the events are delivered on, it is closed once
+// unsubscribed. A nil subscription never delivers any event.
+func (s *Subscription) Events() <-chan Event {
+	if s == nil {
+		return nil
+	}
+	return s.eventCh
+}
+
+func (s *Subscription) GetID() string {
+	return s.id
+}
+
+func (s *Subscription) push(event Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	kept := s.pending[:0]
+	for _, pending := range s.pending {
+		if !event.Kind().supersedes(pending.Kind()) {
+			kept = append(kept, pending)
+		}
+	}
+	s.pending = append(kept, event)
+
+	select {
+	case s.notifyCh <- true:
+	default:
+	}
+}
+
+func (s *Subscription) pop() (Event, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.pending) == 0 {
+		return nil, false
+	}
+
+	event := s.pending[0]
+	s.pending = s.pending[1:]
+	return event, true
+}
+
+// run forwards the pending events to the consumer one at a time
+func (s *Subscription) run() {
+	defer close(s.eventCh)
+
+	for {
+		select {
+		case <-s.doneCh:
+			return
+		case <-s.notifyCh:
+		}
+
+		for {
+			event, ok := s.pop()
+			if !ok {
+				break
+			}
+
+			select {
+			case <-s.doneCh:
+				return
+			case s.eventCh <- event:
+			}
+		}
+	}
+}
+
+func (s *Subscription) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.pending = nil
+	close(s.doneCh)
+}
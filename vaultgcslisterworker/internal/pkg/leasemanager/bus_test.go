@@ -0,0 +1,233 @@
+package leasemanager
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const eventTimeout = time.Second
+
+func receive(t *testing.T, subscription *Subscription) Event {
+	t.Helper()
+
+	select {
+	case event, ok := <-subscription.Events():
+		if !ok {
+			t.Fatal("events closed")
+		}
+		return event
+	case <-time.After(eventTimeout):
+		t.Fatal("no event delivered")
+		return nil
+	}
+}
+
+func expectNoEvent(t *testing.T, subscription *Subscription) {
+	t.Helper()
+
+	select {
+	case event := <-subscription.Events():
+		t.Fatalf("unexpected event %#v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func expectClosed(t *testing.T, subscription *Subscription) {
+	t.Helper()
+
+	select {
+	case event, ok := <-subscription.Events():
+		if ok {
+			t.Fatalf("unexpected event %#v", event)
+		}
+	case <-time.After(eventTimeout):
+		t.Fatal("events not closed")
+	}
+}
+
+// holdDelivery publishes an event the consumer does not read yet and waits
+// until the subscription is blocked delivering it, so the next events stay
+// pending
+func holdDelivery(t *testing.T, bus *Bus, subscription *Subscription) {
+	t.Helper()
+
+	bus.Publish(ExpiringEvent{})
+	deadline := time.Now().Add(eventTimeout)
+	for {
+		subscription.mutex.Lock()
+		pending := len(subscription.pending)
+		subscription.mutex.Unlock()
+
+		if pending == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("event not picked up for delivery")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPublishDoesNotBlockOnSlowSubscriber(t *testing.T) {
+	bus := NewBus()
+	bus.Subscribe("slow")
+	fast := bus.Subscribe("fast")
+	defer bus.Unsubscribe("slow")
+	defer bus.Unsubscribe("fast")
+
+	published := make(chan bool)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			bus.Publish(NewLeaseEvent{KeyID: strconv.Itoa(i)})
+		}
+		close(published)
+	}()
+
+	select {
+	case <-published:
+	case <-time.After(eventTimeout):
+		t.Fatal("Publish blocked on a subscriber not reading its events")
+	}
+
+	// The fast subscriber still gets the latest lease
+	var latest Event
+	for latest == nil || latest.(NewLeaseEvent).KeyID != "999" {
+		latest = receive(t, fast)
+	}
+}
+
+func TestPendingEventsCoalesce(t *testing.T) {
+	testCases := []struct {
+		name      string
+		published []Event
+		delivered []Event
+	}{
+		{
+			name:      "latest lease state wins",
+			published: []Event{NewLeaseEvent{KeyID: "1"}, StaleLeaseEvent{Reason: "expired"}, NewLeaseEvent{KeyID: "2"}},
+			delivered: []Event{NewLeaseEvent{KeyID: "2"}},
+		},
+		{
+			name:      "new lease replaces expiring",
+			published: []Event{ExpiringEvent{}, NewLeaseEvent{KeyID: "1"}},
+			delivered: []Event{NewLeaseEvent{KeyID: "1"}},
+		},
+		{
+			name:      "repeated expiring",
+			published: []Event{ExpiringEvent{ExpiresAt: time.Unix(1, 0)}, ExpiringEvent{ExpiresAt: time.Unix(2, 0)}},
+			delivered: []Event{ExpiringEvent{ExpiresAt: time.Unix(2, 0)}},
+		},
+		{
+			name:      "revoked replaces everything",
+			published: []Event{NewLeaseEvent{KeyID: "1"}, ExpiringEvent{}, RevokedEvent{Reason: "revoked"}},
+			delivered: []Event{RevokedEvent{Reason: "revoked"}},
+		},
+		{
+			name:      "revoked is kept before a new lease",
+			published: []Event{RevokedEvent{Reason: "revoked"}, NewLeaseEvent{KeyID: "1"}},
+			delivered: []Event{RevokedEvent{Reason: "revoked"}, NewLeaseEvent{KeyID: "1"}},
+		},
+		{
+			name:      "expiring after a new lease",
+			published: []Event{NewLeaseEvent{KeyID: "1"}, ExpiringEvent{}},
+			delivered: []Event{NewLeaseEvent{KeyID: "1"}, ExpiringEvent{}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			bus := NewBus()
+			subscription := bus.Subscribe("consumer")
+			defer bus.Unsubscribe("consumer")
+
+			holdDelivery(t, bus, subscription)
+			for _, event := range tc.published {
+				bus.Publish(event)
+			}
+
+			if event := receive(t, subscription); event.Kind() != KindExpiring {
+				t.Fatalf("expected the held event first, got %#v", event)
+			}
+			for _, expected := range tc.delivered {
+				if event := receive(t, subscription); !reflect.DeepEqual(event, expected) {
+					t.Fatalf("expected %#v, got %#v", expected, event)
+				}
+			}
+			expectNoEvent(t, subscription)
+		})
+	}
+}
+
+func TestEventsAreDeliveredInOrder(t *testing.T) {
+	bus := NewBus()
+	first := bus.Subscribe("first")
+	second := bus.Subscribe("second")
+	defer bus.Unsubscribe("first")
+	defer bus.Unsubscribe("second")
+
+	const count = 500
+	go func() {
+		for i := 1; i <= count; i++ {
+			bus.Publish(NewLeaseEvent{KeyID: strconv.Itoa(i)})
+		}
+	}()
+
+	// Coalescing may skip leases, never reorder them
+	for _, subscription := range []*Subscription{first, second} {
+		last := 0
+		for last < count {
+			keyID, err := strconv.Atoi(receive(t, subscription).(NewLeaseEvent).KeyID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keyID <= last {
+				t.Fatalf("%s got lease %d after %d", subscription.GetID(), keyID, last)
+			}
+			last = keyID
+		}
+	}
+}
+
+func TestUnsubscribeClosesEvents(t *testing.T) {
+	bus := NewBus()
+	subscription := bus.Subscribe("consumer")
+
+	holdDelivery(t, bus, subscription)
+	bus.Publish(NewLeaseEvent{KeyID: "1"})
+	bus.Unsubscribe("consumer")
+
+	// The pending events are dropped, only the one being delivered may still
+	// come through
+	for event := range subscription.Events() {
+		if event.Kind() != KindExpiring {
+			t.Fatalf("unexpected event %#v after unsubscribing", event)
+		}
+	}
+
+	// Publishing to a closed subscription or unsubscribing twice is a no-op
+	bus.Publish(NewLeaseEvent{KeyID: "2"})
+	bus.Unsubscribe("consumer")
+}
+
+func TestSubscribeReplacesPreviousSubscription(t *testing.T) {
+	bus := NewBus()
+	previous := bus.Subscribe("consumer")
+	current := bus.Subscribe("consumer")
+	defer bus.Unsubscribe("consumer")
+
+	expectClosed(t, previous)
+
+	bus.Publish(NewLeaseEvent{KeyID: "1"})
+	if event := receive(t, current); !reflect.DeepEqual(event, NewLeaseEvent{KeyID: "1"}) {
+		t.Fatalf("unexpected event %#v", event)
+	}
+}
+
+func TestNilSubscriptionHasNoEvents(t *testing.T) {
+	var subscription *Subscription
+	if subscription.Events() != nil {
+		t.Fatal("expected no events channel")
+	}
+}
@@ -0,0 +1,116 @@
+package leasemanager
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Kind identifies the type of a lease event
+type Kind int
+
+const (
+	KindNewLease Kind = iota
+	KindStaleLease
+	KindRevoked
+	KindExpiring
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindNewLease:
+		return "new_lease"
+	case KindStaleLease:
+		return "stale_lease"
+	case KindRevoked:
+		return "revoked"
+	case KindExpiring:
+		return "expiring"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is a lease lifecycle event published by a Subject
+type Event interface {
+	Kind() Kind
+}
+
+// Cause is the span of the work that published an event, the work triggered
+// by the event is traced as its child
+type Cause struct {
+	SpanContext trace.SpanContext
+}
+
+// NewLeaseEvent is published after the lease has been renewed or replaced
+type NewLeaseEvent struct {
+	Cause
+	KeyID   string
+	LeaseID string
+	TTL     time.Duration
+}
+
+// StaleLeaseEvent is published when the lease can no longer be used
+type StaleLeaseEvent struct {
+	Cause
+	Reason string
+}
+
+// RevokedEvent is published when the lease has been revoked for good
+type RevokedEvent struct {
+	Cause
+	Reason string
+}
+
+// ExpiringEvent is published when the lease is about to expire
+type ExpiringEvent struct {
+	Cause
+	ExpiresAt time.Time
+}
+
+// CauseFrom returns the cause of an event published by the work traced in ctx
+func CauseFrom(ctx context.Context) Cause {
+	return Cause{SpanContext: trace.SpanContextFromContext(ctx)}
+}
+
+// ContextWithCause returns ctx with the cause of event as its parent span, so
+// the work the event triggers joins the trace that published it
+func ContextWithCause(ctx context.Context, event Event) context.Context {
+	caused, ok := event.(interface{ cause() Cause })
+	if !ok {
+		return ctx
+	}
+	return caused.cause().Context(ctx)
+}
+
+// Context returns ctx with the cause as its parent span, ctx is returned as
+// is without cause
+func (c Cause) Context(ctx context.Context) context.Context {
+	if !c.SpanContext.IsValid() {
+		return ctx
+	}
+	return trace.ContextWithSpanContext(ctx, c.SpanContext)
+}
+
+func (c Cause) cause() Cause { return c }
+
+func (NewLeaseEvent) Kind() Kind   { return KindNewLease }
+func (StaleLeaseEvent) Kind() Kind { return KindStaleLease }
+func (RevokedEvent) Kind() Kind    { return KindRevoked }
+func (ExpiringEvent) Kind() Kind   { return KindExpiring }
+
+// supersedes reports whether a pending event of kind pending is made
+// redundant by a newer event of kind k. The latest lease state wins: a new,
+// stale or revoked lease replaces any pending lease state, and a revocation
+// replaces everything.
+func (k Kind) supersedes(pending Kind) bool {
+	switch k {
+	case KindRevoked:
+		return true
+	case KindNewLease, KindStaleLease:
+		return pending != KindRevoked
+	default:
+		return pending == k
+	}
+}
@@ -1,25 +1,16 @@
 package leasemanager
 
+// Subject is a lease whose lifecycle events are published to the observers
+// registered to it
 type Subject interface {
 	Register(Observer)
 	Deregister(Observer)
-	NotifyAllNewLease()
-	NotifyAllStaleLease()
+	Publish(Event)
 }
 
+// Observer is a lease consumer following the events of its parent lease
 type Observer interface {
-	NotifyNewLease()
-	NotifyStaleLease()
+	// Follow hands the observer its subscription to the parent events
+	Follow(*Subscription)
 	GetID() string
 }
-
-func RemoveObserver(observers []Observer, observerToRemove Observer) []Observer {
-	observersLen := len(observers)
-	for idx, observer := range observers {
-		if observerToRemove.GetID() == observer.GetID() {
-			observers[observersLen-1], observers[idx] = observers[idx], observers[observersLen-1]
-			return observers[:observersLen-1]
-		}
-	}
-	return observers
-}
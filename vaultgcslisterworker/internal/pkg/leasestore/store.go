@@ -0,0 +1,233 @@
+package leasestore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/util/secret"
+)
+
+const (
+	envelopeVersion = 1
+	saltSize        = 16
+
+	// scrypt parameters recommended for interactive logins, a lease is only
+	// encrypted once per key
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+)
+
+// Lease is a persisted GCP lease
+type Lease struct {
+	LeaseID string `json:"lease_id"`
+	// Key is the JSON of the service account key
+	Key       []byte    `json:"key"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// envelope is the file format, the lease JSON is sealed with AES-256-GCM under
+// a key derived from the passphrase and the salt with scrypt
+type envelope struct {
+	Version    int    `json:"version"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// Store keeps the current lease of each GCP lease manager in an encrypted
+// file, so a restarted worker can reuse its key instead of fetching a new one
+type Store struct {
+	dir        string
+	passphrase *secret.Bytes
+}
+
+// NewStore creates the store in dir, it takes ownership of passphrase, which
+// is either a configured passphrase or the PEM of the TLS client key
+func NewStore(dir string, passphrase []byte) (*Store, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("the lease store passphrase is empty")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create lease store directory")
+	}
+
+	return &Store{
+		dir:        dir,
+		passphrase: secret.NewBytes(passphrase),
+	}, nil
+}
+
+// Save replaces the persisted lease of id
+func (s *Store) Save(id string, lease *Lease) error {
+	plaintext, err := json.Marshal(lease)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode lease")
+	}
+	defer secret.Zero(plaintext)
+
+	sealed, err := s.seal(id, plaintext)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(sealed)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode lease file")
+	}
+	return s.write(id, body)
+}
+
+// Load returns the persisted lease of id, it is nil if there is none. The
+// caller owns the returned key and should zero it once done.
+func (s *Store) Load(id string) (*Lease, error) {
+	body, err := ioutil.ReadFile(s.path(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read lease file")
+	}
+
+	sealed := envelope{}
+	if err := json.Unmarshal(body, &sealed); err != nil {
+		return nil, errors.Wrap(err, "invalid lease file")
+	}
+	if sealed.Version != envelopeVersion {
+		return nil, errors.Errorf("unsupported lease file version %d", sealed.Version)
+	}
+
+	plaintext, err := s.open(id, &sealed)
+	if err != nil {
+		return nil, err
+	}
+	defer secret.Zero(plaintext)
+
+	lease := &Lease{}
+	if err := json.Unmarshal(plaintext, lease); err != nil {
+		return nil, errors.Wrap(err, "invalid lease")
+	}
+	return lease, nil
+}
+
+// Remove removes the persisted lease of id, a missing lease is not an error
+func (s *Store) Remove(id string) error {
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove lease file")
+	}
+	return nil
+}
+
+// Close wipes the passphrase, the store can not be used afterwards
+func (s *Store) Close() {
+	s.passphrase.Wipe()
+}
+
+func (s *Store) path(id string) string {
+	return filepath.Join(s.dir, id+".lease")
+}
+
+// seal encrypts plaintext, id is authenticated so the file of one lease
+// manager can not be passed off as another's
+func (s *Store) seal(id string, plaintext []byte) (*envelope, error) {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, errors.Wrap(err, "failed to generate salt")
+	}
+
+	aead, err := s.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "failed to generate nonce")
+	}
+
+	return &envelope{
+		Version:    envelopeVersion,
+		Salt:       salt,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plaintext, []byte(id)),
+	}, nil
+}
+
+func (s *Store) open(id string, sealed *envelope) ([]byte, error) {
+	aead, err := s.aead(sealed.Salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed.Nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid lease file nonce")
+	}
+
+	plaintext, err := aead.Open(nil, sealed.Nonce, sealed.Ciphertext, []byte(id))
+	if err != nil {
+		return nil, errors.New("failed to decrypt lease file, the passphrase or TLS key changed")
+	}
+	return plaintext, nil
+}
+
+func (s *Store) aead(salt []byte) (cipher.AEAD, error) {
+	passphrase := s.passphrase.Copy()
+	defer secret.Zero(passphrase)
+	if len(passphrase) == 0 {
+		return nil, errors.New("the lease store is closed")
+	}
+
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to derive lease file key")
+	}
+	defer secret.Zero(key)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create lease file cipher")
+	}
+	return cipher.NewGCM(block)
+}
+
+// write replaces the lease file atomically, readable only by the worker
+func (s *Store) write(id string, body []byte) error {
+	path := s.path(id)
+	tempFile, err := ioutil.TempFile(s.dir, "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temp lease file")
+	}
+	tempPath := tempFile.Name()
+	defer os.Remove(tempPath)
+
+	if err := tempFile.Chmod(0600); err != nil {
+		tempFile.Close()
+		return errors.Wrap(err, "failed to chmod temp lease file")
+	}
+	if _, err := tempFile.Write(body); err != nil {
+		tempFile.Close()
+		return errors.Wrap(err, "failed to write temp lease file")
+	}
+	if err := tempFile.Sync(); err != nil {
+		tempFile.Close()
+		return errors.Wrap(err, "failed to sync temp lease file")
+	}
+	if err := tempFile.Close(); err != nil {
+		return errors.Wrap(err, "failed to close temp lease file")
+	}
+
+	if err := os.Rename(tempPath, path); err != nil {
+		return errors.Wrap(err, "failed to replace lease file")
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package leasestore
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T, dir, passphrase string) *Store {
+	t.Helper()
+
+	store, err := NewStore(dir, []byte(passphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(store.Close)
+	return store
+}
+
+func testLease() *Lease {
+	return &Lease{
+		LeaseID:   "gcp/key/infra/abc",
+		Key:       []byte(`{"type": "service_account"}`),
+		ExpiresAt: time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestStore(t, dir, "passphrase")
+
+	if lease, err := store.Load("infra"); err != nil || lease != nil {
+		t.Fatalf("expected no lease before a save, got %+v %v", lease, err)
+	}
+
+	expected := testLease()
+	if err := store.Save("infra", expected); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(store.path("infra"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the lease file to be readable only by the worker, got %v", info.Mode().Perm())
+	}
+	body, err := ioutil.ReadFile(store.path("infra"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(body, []byte("service_account")) {
+		t.Error("the lease file must not contain the key in the clear")
+	}
+
+	// A restarted worker reads the lease with the same passphrase
+	lease, err := newTestStore(t, dir, "passphrase").Load("infra")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.LeaseID != expected.LeaseID || !bytes.Equal(lease.Key, expected.Key) || !lease.ExpiresAt.Equal(expected.ExpiresAt) {
+		t.Fatalf("expected %+v, got %+v", expected, lease)
+	}
+
+	if err := store.Remove("infra"); err != nil {
+		t.Fatal(err)
+	}
+	if lease, err := store.Load("infra"); err != nil || lease != nil {
+		t.Fatalf("expected no lease after a remove, got %+v %v", lease, err)
+	}
+	if err := store.Remove("infra"); err != nil {
+		t.Fatalf("removing a missing lease must not fail, got %v", err)
+	}
+}
+
+func TestLoadWrongPassphrase(t *testing.T) {
+	dir := t.TempDir()
+	if err := newTestStore(t, dir, "passphrase").Save("infra", testLease()); err != nil {
+		t.Fatal(err)
+	}
+
+	if lease, err := newTestStore(t, dir, "other passphrase").Load("infra"); err == nil {
+		t.Fatalf("expected the lease to be rejected, got %+v", lease)
+	}
+}
+
+func TestLoadOfAnotherID(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestStore(t, dir, "passphrase")
+	if err := store.Save("infra", testLease()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file of infra is passed off as the lease of data
+	if err := os.Rename(store.path("infra"), store.path("data")); err != nil {
+		t.Fatal(err)
+	}
+	if lease, err := store.Load("data"); err == nil {
+		t.Fatalf("expected the lease of another ID to be rejected, got %+v", lease)
+	}
+}
+
+func TestLoadVersionMismatch(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestStore(t, dir, "passphrase")
+	if err := store.Save("infra", testLease()); err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadFile(store.path("infra"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := envelope{}
+	if err := json.Unmarshal(body, &sealed); err != nil {
+		t.Fatal(err)
+	}
+	sealed.Version = envelopeVersion + 1
+	if body, err = json.Marshal(sealed); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(store.path("infra"), body, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if lease, err := store.Load("infra"); err == nil {
+		t.Fatalf("expected a lease file of another version to be rejected, got %+v", lease)
+	}
+}
+
+func TestClosedStore(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestStore(t, dir, "passphrase")
+	if err := store.Save("infra", testLease()); err != nil {
+		t.Fatal(err)
+	}
+
+	store.Close()
+	if lease, err := store.Load("infra"); err == nil {
+		t.Fatalf("expected a closed store not to load, got %+v", lease)
+	}
+	if err := store.Save("data", testLease()); err == nil {
+		t.Fatal("expected a closed store not to save")
+	}
+}
+
+func TestNewStoreEmptyPassphrase(t *testing.T) {
+	if _, err := NewStore(t.TempDir(), nil); err == nil {
+		t.Fatal("expected an empty passphrase to be rejected")
+	}
+}
@@ -0,0 +1,95 @@
+package log
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	zaplogfmt "github.com/jsternberg/zap-logfmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Logger is the process wide logger, it discards everything until initialized.
+// Once initialized it redacts the secret fields of every entry.
+var Logger = zap.NewNop()
+
+// InitLogger makes Logger write JSON lines to stderr
+func InitLogger(level string) {
+	initLogger(newJSONCore(zapcore.Lock(os.Stderr), parseLevel(level)))
+}
+
+// InitLogfmtLogger makes Logger write logfmt lines to stderr
+func InitLogfmtLogger(level string) {
+	initLogger(newLogfmtCore(zapcore.Lock(os.Stderr), parseLevel(level)))
+}
+
+func initLogger(core zapcore.Core) {
+	Logger = zap.New(NewScrubCore(core), zap.AddCaller())
+}
+
+func newJSONCore(ws zapcore.WriteSyncer, level zapcore.LevelEnabler) zapcore.Core {
+	return zapcore.NewCore(zapcore.NewJSONEncoder(encoderConfig()), ws, level)
+}
+
+func newLogfmtCore(ws zapcore.WriteSyncer, level zapcore.LevelEnabler) zapcore.Core {
+	return &reflectedCore{Core: zapcore.NewCore(zaplogfmt.NewEncoder(encoderConfig()), ws, level)}
+}
+
+// reflectedCore writes the maps, structs and slices of every entry as JSON
+// strings. The logfmt encoder rejects them, and panics on a slice.
+type reflectedCore struct {
+	zapcore.Core
+}
+
+func (c *reflectedCore) With(fields []zapcore.Field) zapcore.Core {
+	return &reflectedCore{Core: c.Core.With(reflectedAsJSON(fields))}
+}
+
+func (c *reflectedCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *reflectedCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	return c.Core.Write(entry, reflectedAsJSON(fields))
+}
+
+func reflectedAsJSON(fields []zapcore.Field) []zapcore.Field {
+	converted := make([]zapcore.Field, len(fields))
+	for idx, field := range fields {
+		converted[idx] = field
+		if field.Type != zapcore.ReflectType || field.Interface == nil {
+			continue
+		}
+		if encoded, err := json.Marshal(field.Interface); err == nil {
+			converted[idx] = zap.ByteString(field.Key, encoded)
+		}
+	}
+	return converted
+}
+
+func encoderConfig() zapcore.EncoderConfig {
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.TimeKey = "ts"
+	encoderConfig.EncodeTime = func(t time.Time, enc zapcore.PrimitiveArrayEncoder) {
+		enc.AppendString(t.UTC().Format(time.RFC3339Nano))
+	}
+	return encoderConfig
+}
+
+// parseLevel parses the log.level values of the config, info by default
+func parseLevel(level string) zapcore.Level {
+	switch level {
+	case "debug":
+		return zapcore.DebugLevel
+	case "warning":
+		return zapcore.WarnLevel
+	case "error":
+		return zapcore.ErrorLevel
+	default:
+		return zapcore.InfoLevel
+	}
+}
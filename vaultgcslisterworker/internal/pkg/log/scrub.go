@@ -0,0 +1,105 @@
+package log
+
+import (
+	"encoding/json"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/util/secret"
+)
+
+// secretFields are the names of the fields which hold a secret wherever they
+// appear, in Vault responses or in service account keys
+var secretFields = map[string]bool{
+	"private_key":      true,
+	"private_key_data": true,
+	"token":            true,
+	"client_token":     true,
+}
+
+// scrubCore redacts the secret fields of every entry before the wrapped core
+// encodes it, including the ones nested in logged maps and structs
+type scrubCore struct {
+	zapcore.Core
+}
+
+// NewScrubCore wraps core so that no secret field reaches its output
+func NewScrubCore(core zapcore.Core) zapcore.Core {
+	return &scrubCore{Core: core}
+}
+
+func (c *scrubCore) With(fields []zapcore.Field) zapcore.Core {
+	return &scrubCore{Core: c.Core.With(scrubFields(fields))}
+}
+
+// Check adds the scrubbing core itself, the wrapped core would otherwise
+// write the entry directly
+func (c *scrubCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *scrubCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	return c.Core.Write(entry, scrubFields(fields))
+}
+
+func scrubFields(fields []zapcore.Field) []zapcore.Field {
+	scrubbed := make([]zapcore.Field, len(fields))
+	for idx, field := range fields {
+		scrubbed[idx] = scrubField(field)
+	}
+	return scrubbed
+}
+
+func scrubField(field zapcore.Field) zapcore.Field {
+	if isSecretField(field.Key) {
+		return zap.String(field.Key, secret.Redacted)
+	}
+	if field.Type != zapcore.ReflectType || field.Interface == nil {
+		return field
+	}
+
+	// Maps and structs are scrubbed through their JSON form, which is also
+	// how the encoder writes them
+	encoded, err := json.Marshal(field.Interface)
+	if err != nil {
+		return field
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		return field
+	}
+	return zap.Reflect(field.Key, scrubValue(decoded))
+}
+
+func scrubValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, nested := range v {
+			if isSecretField(key) {
+				v[key] = secret.Redacted
+				continue
+			}
+			v[key] = scrubValue(nested)
+		}
+	case []interface{}:
+		for idx, nested := range v {
+			v[idx] = scrubValue(nested)
+		}
+	}
+	return value
+}
+
+// isSecretField matches the name of a secret field, also as the last part of
+// a dotted name such as auth.client_token
+func isSecretField(key string) bool {
+	key = strings.ToLower(key)
+	if idx := strings.LastIndex(key, "."); idx >= 0 {
+		key = key[idx+1:]
+	}
+	return secretFields[key]
+}
@@ -0,0 +1,257 @@
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/log"
+	"golang.org/x/oauth2"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/gcp"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/util/secret"
+	"github.com/mikeadityas/vault-gcs-lister/pkg/credentials"
+	"github.com/mikeadityas/vault-gcs-lister/pkg/leasechain"
+)
+
+const (
+	flavorHeader = "Metadata-Flavor"
+	flavorGoogle = "Google"
+
+	serviceAccountsPath = "/computeMetadata/v1/instance/service-accounts/"
+
+	defaultScope = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+// Server emulates the GCE metadata server for the service account key of a
+// target, so processes using Application Default Credentials can point
+// GCE_METADATA_HOST to it
+type Server struct {
+	id      string
+	address string
+	keys    credentials.KeySource
+
+	mutex        sync.Mutex
+	tokenSources map[string]oauth2.TokenSource
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	TokenType   string `json:"token_type"`
+}
+
+type serviceAccountResponse struct {
+	Aliases []string `json:"aliases"`
+	Email   string   `json:"email"`
+	Scopes  []string `json:"scopes"`
+}
+
+func NewServer(id, address string) *Server {
+	return &Server{
+		id:           id,
+		address:      address,
+		tokenSources: map[string]oauth2.TokenSource{},
+	}
+}
+
+func (s *Server) GetID() string {
+	return s.id
+}
+
+// Consume serves the key of keys until ctx is done. The key is read on every
+// request, so the lease events are only drained.
+func (s *Server) Consume(ctx context.Context, keys credentials.KeySource, events <-chan leasechain.Event) {
+	s.keys = keys
+
+	httpServer := &http.Server{
+		Addr:    s.address,
+		Handler: s.Handler(),
+	}
+
+	go func() {
+		log.Logger.Sugar().Infow("Serving GCE metadata server", "address", s.address)
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Logger.Sugar().Errorw("The GCE metadata server stopped", "err", err)
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			httpServer.Shutdown(context.Background())
+			return
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+			}
+		}
+	}
+}
+
+// Handler returns the handler serving the emulated metadata endpoints
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleRoot)
+	mux.HandleFunc("/computeMetadata/v1/project/project-id", s.handleProjectID)
+	mux.HandleFunc(serviceAccountsPath, s.handleServiceAccounts)
+	return s.checkFlavor(mux)
+}
+
+// checkFlavor rejects requests without the Metadata-Flavor header like GCE
+// does, it protects the credentials from being read through a forwarding proxy
+func (s *Server) checkFlavor(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(flavorHeader, flavorGoogle)
+
+		if r.Header.Get(flavorHeader) != flavorGoogle || r.Header.Get("X-Forwarded-For") != "" {
+			http.Error(w, "Missing Metadata-Flavor:Google header", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleRoot answers the probe of metadata.OnGCE and its equivalents
+func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" && r.URL.Path != "/computeMetadata/v1/" {
+		http.NotFound(w, r)
+		return
+	}
+	fmt.Fprintln(w, "computeMetadata/")
+}
+
+// handleProjectID answers the project of the current key, which follows the
+// key rotations like the service account endpoints
+func (s *Server) handleProjectID(w http.ResponseWriter, r *http.Request) {
+	keyInfo, ok := s.currentKeyInfo()
+	if !ok {
+		http.Error(w, "No valid service account key", http.StatusServiceUnavailable)
+		return
+	}
+	if keyInfo.ProjectID == "" {
+		http.NotFound(w, r)
+		return
+	}
+	fmt.Fprint(w, keyInfo.ProjectID)
+}
+
+func (s *Server) handleServiceAccounts(w http.ResponseWriter, r *http.Request) {
+	keyInfo, ok := s.currentKeyInfo()
+	if !ok {
+		http.Error(w, "No valid service account key", http.StatusServiceUnavailable)
+		return
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, serviceAccountsPath)
+	if rest == "" {
+		fmt.Fprintf(w, "default/\n%s/\n", keyInfo.ClientEmail)
+		return
+	}
+
+	account, endpoint := rest, ""
+	if idx := strings.Index(rest, "/"); idx >= 0 {
+		account, endpoint = rest[:idx], rest[idx+1:]
+	}
+	if account != "default" && account != keyInfo.ClientEmail {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch endpoint {
+	case "":
+		if r.URL.Query().Get("recursive") != "true" {
+			fmt.Fprintln(w, "aliases\nemail\nscopes\ntoken")
+			return
+		}
+		writeJSON(w, serviceAccountResponse{
+			Aliases: []string{"default"},
+			Email:   keyInfo.ClientEmail,
+			Scopes:  []string{defaultScope},
+		})
+	case "email":
+		fmt.Fprint(w, keyInfo.ClientEmail)
+	case "scopes":
+		fmt.Fprintln(w, defaultScope)
+	case "token":
+		s.handleToken(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	scopes := parseScopes(r.URL.Query().Get("scopes"))
+
+	token, err := s.tokenSource(scopes).Token()
+	if err != nil {
+		log.Logger.Sugar().Errorw("Failed to mint access token", "err", err)
+		http.Error(w, "Failed to mint access token", http.StatusServiceUnavailable)
+		return
+	}
+
+	writeJSON(w, tokenResponse{
+		AccessToken: token.AccessToken,
+		ExpiresIn:   int(time.Until(token.Expiry).Seconds()),
+		TokenType:   "Bearer",
+	})
+}
+
+// currentKeyInfo returns the non-secret metadata of the current key, it is
+// false if there is no valid key
+func (s *Server) currentKeyInfo() (gcp.ServiceAccountKey, bool) {
+	keyInfo := gcp.ServiceAccountKey{}
+
+	serviceAccountKey, _, _ := s.keys.CurrentKey()
+	if len(serviceAccountKey) == 0 {
+		return keyInfo, false
+	}
+	defer secret.Zero(serviceAccountKey)
+	if err := json.Unmarshal(serviceAccountKey, &keyInfo); err != nil {
+		return keyInfo, false
+	}
+	return keyInfo, true
+}
+
+// tokenSource returns the cached token source of scopes, it follows the key
+// rotations of the key source
+func (s *Server) tokenSource(scopes []string) oauth2.TokenSource {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	scopesKey := strings.Join(scopes, " ")
+	if tokenSource, ok := s.tokenSources[scopesKey]; ok {
+		return tokenSource
+	}
+
+	tokenSource := credentials.TokenSource(s.keys, credentials.WithScopes(scopes...))
+	s.tokenSources[scopesKey] = tokenSource
+	return tokenSource
+}
+
+// parseScopes parses the comma separated scopes query of the token endpoint
+func parseScopes(query string) []string {
+	var scopes []string
+	for _, scope := range strings.Split(query, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return []string{defaultScope}
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Logger.Sugar().Errorw("Failed to write metadata response", "err", err)
+	}
+}
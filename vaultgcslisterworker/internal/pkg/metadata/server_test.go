@@ -0,0 +1,81 @@
+package metadata
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rotatingKeys is a key source whose key is replaced by the test
+type rotatingKeys struct {
+	mutex sync.Mutex
+	key   string
+}
+
+func (rk *rotatingKeys) CurrentKey() ([]byte, string, time.Time) {
+	rk.mutex.Lock()
+	defer rk.mutex.Unlock()
+
+	return []byte(rk.key), "key-1", time.Now().Add(time.Hour)
+}
+
+func (rk *rotatingKeys) WaitKey(ctx context.Context) error {
+	return nil
+}
+
+func (rk *rotatingKeys) set(key string) {
+	rk.mutex.Lock()
+	defer rk.mutex.Unlock()
+
+	rk.key = key
+}
+
+func get(handler http.Handler, path string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodGet, path, nil)
+	request.Header.Set(flavorHeader, flavorGoogle)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestProjectIDFollowsKey(t *testing.T) {
+	keys := &rotatingKeys{}
+	server := NewServer("metadata-infra", "")
+	server.keys = keys
+	handler := server.Handler()
+
+	const path = "/computeMetadata/v1/project/project-id"
+	if resp := get(handler, path); resp.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 without a key, got %d", resp.Code)
+	}
+
+	keys.set(`{"project_id": "infra", "client_email": "lister@infra.iam.gserviceaccount.com"}`)
+	if resp := get(handler, path); resp.Code != http.StatusOK || resp.Body.String() != "infra" {
+		t.Fatalf("expected the project of the key, got %d %q", resp.Code, resp.Body.String())
+	}
+
+	keys.set(`{"project_id": "data", "client_email": "lister@data.iam.gserviceaccount.com"}`)
+	if resp := get(handler, path); resp.Code != http.StatusOK || resp.Body.String() != "data" {
+		t.Fatalf("expected the project of the rotated key, got %d %q", resp.Code, resp.Body.String())
+	}
+
+	keys.set(`{"client_email": "lister@data.iam.gserviceaccount.com"}`)
+	if resp := get(handler, path); resp.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a key without project, got %d", resp.Code)
+	}
+}
+
+func TestRequiresFlavor(t *testing.T) {
+	server := NewServer("metadata-infra", "")
+	server.keys = &rotatingKeys{key: `{"project_id": "infra"}`}
+
+	request := httptest.NewRequest(http.MethodGet, "/computeMetadata/v1/project/project-id", nil)
+	recorder := httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 without the Metadata-Flavor header, got %d", recorder.Code)
+	}
+}
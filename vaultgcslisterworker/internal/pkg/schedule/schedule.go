@@ -0,0 +1,203 @@
+// Package schedule staggers the renewals of replicas started together, and
+// reports when each lease of this replica is renewed so the spread across
+// replicas can be checked
+package schedule
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/log"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/util/lease"
+)
+
+// Window is the part of the TTL of a lease it is renewed in, as fractions of
+// the TTL. The zero Window renews at a fixed point instead.
+type Window struct {
+	From float64 `json:"from"`
+	To   float64 `json:"to"`
+}
+
+func (w Window) IsZero() bool {
+	return w.From == 0 && w.To == 0
+}
+
+// Width returns the span of the window for ttl, the most the renewals of two
+// replicas can be apart
+func (w Window) Width(ttl time.Duration) time.Duration {
+	return time.Duration((w.To - w.From) * float64(ttl))
+}
+
+// NoTTLPeriod is how often a lease without TTL is renewed
+const NoTTLPeriod = 1 * time.Hour
+
+// Policy decides when a lease is renewed
+type Policy struct {
+	// Window renews at a random point of the TTL, it takes precedence over
+	// EarlyRenewal
+	Window       Window
+	EarlyRenewal lease.EarlyRenewal
+	// MinRemaining is the lifetime a lease must have left to be used, it is
+	// renewed before it drops below
+	MinRemaining time.Duration
+}
+
+// RenewAfter returns when a lease valid for ttl is renewed, given the random
+// position offset in the window
+func (p Policy) RenewAfter(ttl time.Duration, offset float64) time.Duration {
+	if ttl <= 0 {
+		return NoTTLPeriod
+	}
+
+	var after time.Duration
+	if !p.Window.IsZero() {
+		after = time.Duration((p.Window.From + offset*(p.Window.To-p.Window.From)) * float64(ttl))
+	} else {
+		after = ttl - p.EarlyRenewal.Before(ttl)
+	}
+
+	if p.MinRemaining > 0 && after > ttl-p.MinRemaining {
+		after = ttl - p.MinRemaining
+	}
+	// A lease too short for the policy is renewed halfway through, not only
+	// once it expired
+	if after <= 0 {
+		after = ttl / 2
+	}
+	return after
+}
+
+// Renewal is the next renewal of the lease of a component
+type Renewal struct {
+	Component   string    `json:"component"`
+	ScheduledAt time.Time `json:"scheduled_at"`
+	RenewAt     time.Time `json:"renew_at"`
+	TTL         string    `json:"ttl"`
+	Window      Window    `json:"window"`
+	// Fraction is the part of the TTL elapsed at the renewal
+	Fraction float64 `json:"fraction"`
+	// Offset is the position of the renewal in the window, from 0 at its
+	// start to 1 at its end. Across replicas it shows how staggered they are.
+	Offset float64 `json:"window_offset"`
+}
+
+// Report is the schedule of this replica served at /debug/schedule
+type Report struct {
+	Hostname      string    `json:"hostname"`
+	StartupJitter string    `json:"startup_jitter"`
+	Renewals      []Renewal `json:"renewals"`
+}
+
+// Registry keeps the next renewal of every component of a lease chain
+type Registry struct {
+	mutex         sync.RWMutex
+	startupJitter time.Duration
+	renewals      map[string]Renewal
+}
+
+// random is seeded per process, replicas started together must not draw the
+// same renewal points
+var (
+	randomMutex sync.Mutex
+	random      = rand.New(rand.NewSource(time.Now().UnixNano() ^ int64(os.Getpid())))
+)
+
+func NewRegistry() *Registry {
+	return &Registry{
+		renewals: map[string]Renewal{},
+	}
+}
+
+// Jitter returns a random duration up to max
+func Jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	randomMutex.Lock()
+	defer randomMutex.Unlock()
+
+	return time.Duration(random.Int63n(int64(max)))
+}
+
+func randomFraction() float64 {
+	randomMutex.Lock()
+	defer randomMutex.Unlock()
+
+	return random.Float64()
+}
+
+func (r *Registry) SetStartupJitter(jitter time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.startupJitter = jitter
+}
+
+// Plan returns when the lease of component, valid for ttl, is renewed
+// according to policy, and records it
+func (r *Registry) Plan(component string, ttl time.Duration, policy Policy) time.Duration {
+	renewal := Renewal{
+		Component:   component,
+		ScheduledAt: time.Now(),
+		TTL:         ttl.String(),
+		Window:      policy.Window,
+	}
+	if !policy.Window.IsZero() {
+		renewal.Offset = randomFraction()
+	}
+
+	after := policy.RenewAfter(ttl, renewal.Offset)
+	if ttl > 0 {
+		renewal.Fraction = float64(after) / float64(ttl)
+	}
+	renewal.RenewAt = renewal.ScheduledAt.Add(after)
+
+	r.mutex.Lock()
+	r.renewals[component] = renewal
+	r.mutex.Unlock()
+
+	log.Logger.Sugar().Infow(
+		"Renewal scheduled",
+		"component", component,
+		"renew_time", renewal.RenewAt.Format(time.RFC3339),
+		"ttl", ttl,
+		"renewal.fraction", renewal.Fraction,
+		"renewal.window_offset", renewal.Offset,
+		"renewal.window_width", policy.Window.Width(ttl),
+	)
+	return after
+}
+
+func (r *Registry) Snapshot() Report {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	hostname, _ := os.Hostname()
+	report := Report{
+		Hostname:      hostname,
+		StartupJitter: r.startupJitter.String(),
+		Renewals:      make([]Renewal, 0, len(r.renewals)),
+	}
+	for _, renewal := range r.renewals {
+		report.Renewals = append(report.Renewals, renewal)
+	}
+	sort.Slice(report.Renewals, func(i, j int) bool {
+		return report.Renewals[i].Component < report.Renewals[j].Component
+	})
+	return report
+}
+
+// Handler serves /debug/schedule, which returns the report as JSON
+func (r *Registry) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/schedule", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.Snapshot())
+	})
+	return mux
+}
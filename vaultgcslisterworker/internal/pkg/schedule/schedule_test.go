@@ -0,0 +1,138 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/util/lease"
+)
+
+func TestRenewAfter(t *testing.T) {
+	window := Window{From: 0.5, To: 0.8}
+
+	tests := []struct {
+		name   string
+		policy Policy
+		ttl    time.Duration
+		offset float64
+		after  time.Duration
+	}{
+		{
+			name:  "no policy renews at expiry",
+			ttl:   time.Hour,
+			after: time.Hour,
+		},
+		{
+			name:   "window start",
+			policy: Policy{Window: window},
+			ttl:    time.Hour,
+			offset: 0,
+			after:  30 * time.Minute,
+		},
+		{
+			name:   "window middle",
+			policy: Policy{Window: window},
+			ttl:    time.Hour,
+			offset: 0.5,
+			after:  39 * time.Minute,
+		},
+		{
+			name:   "window end",
+			policy: Policy{Window: window},
+			ttl:    time.Hour,
+			offset: 1,
+			after:  48 * time.Minute,
+		},
+		{
+			name:   "window takes precedence over early renewal",
+			policy: Policy{Window: window, EarlyRenewal: lease.EarlyRenewal{Duration: 50 * time.Minute}},
+			ttl:    time.Hour,
+			offset: 1,
+			after:  48 * time.Minute,
+		},
+		{
+			name:   "early renewal duration",
+			policy: Policy{EarlyRenewal: lease.EarlyRenewal{Duration: 10 * time.Minute}},
+			ttl:    time.Hour,
+			after:  50 * time.Minute,
+		},
+		{
+			name:   "early renewal percent",
+			policy: Policy{EarlyRenewal: lease.EarlyRenewal{Percent: 25}},
+			ttl:    time.Hour,
+			after:  45 * time.Minute,
+		},
+		{
+			name:   "minimum remaining clamps the window",
+			policy: Policy{Window: window, MinRemaining: 20 * time.Minute},
+			ttl:    time.Hour,
+			offset: 1,
+			after:  40 * time.Minute,
+		},
+		{
+			name:   "minimum remaining clamps the early renewal",
+			policy: Policy{EarlyRenewal: lease.EarlyRenewal{Duration: 10 * time.Minute}, MinRemaining: 15 * time.Minute},
+			ttl:    time.Hour,
+			after:  45 * time.Minute,
+		},
+		{
+			name:   "minimum remaining within the window",
+			policy: Policy{Window: window, MinRemaining: 5 * time.Minute},
+			ttl:    time.Hour,
+			offset: 1,
+			after:  48 * time.Minute,
+		},
+		{
+			name:   "minimum remaining past the TTL falls back to half the TTL",
+			policy: Policy{MinRemaining: 2 * time.Hour},
+			ttl:    time.Hour,
+			after:  30 * time.Minute,
+		},
+		{
+			name:   "early renewal of the whole TTL falls back to half the TTL",
+			policy: Policy{EarlyRenewal: lease.EarlyRenewal{Duration: time.Hour}},
+			ttl:    time.Hour,
+			after:  30 * time.Minute,
+		},
+		{
+			name:  "zero TTL",
+			ttl:   0,
+			after: NoTTLPeriod,
+		},
+		{
+			name:   "negative TTL",
+			policy: Policy{Window: window},
+			ttl:    -time.Second,
+			offset: 0.5,
+			after:  NoTTLPeriod,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if after := tt.policy.RenewAfter(tt.ttl, tt.offset); after != tt.after {
+				t.Fatalf("expected a renewal after %v, got %v", tt.after, after)
+			}
+		})
+	}
+}
+
+func TestPlanWithinWindow(t *testing.T) {
+	registry := NewRegistry()
+	policy := Policy{Window: Window{From: 0.5, To: 0.8}}
+
+	for i := 0; i < 100; i++ {
+		after := registry.Plan("vault", time.Hour, policy)
+		if after < 30*time.Minute || after > 48*time.Minute {
+			t.Fatalf("renewal after %v is outside of the window", after)
+		}
+	}
+
+	report := registry.Snapshot()
+	if len(report.Renewals) != 1 || report.Renewals[0].Component != "vault" {
+		t.Fatalf("expected the last renewal of vault, got %+v", report.Renewals)
+	}
+	if renewal := report.Renewals[0]; renewal.Fraction < 0.5 || renewal.Fraction > 0.8 {
+		t.Errorf("fraction %v is outside of the window", renewal.Fraction)
+	}
+}
@@ -0,0 +1,126 @@
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/config"
+	"github.com/mikeadityas/vault-gcs-lister/pkg/leasechain"
+)
+
+const (
+	defaultMaxSizeMB  int = 100
+	defaultMaxBackups int = 3
+)
+
+// FileSink writes every listing as a JSON line to a local file, rotating it
+// once it grows beyond the max size
+type FileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+func NewFileSink(path string, maxSizeMB, maxBackups int) (*FileSink, error) {
+	expandedPath, err := config.ExpandPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxSizeMB <= 0 {
+		maxSizeMB = defaultMaxSizeMB
+	}
+	if maxBackups <= 0 {
+		maxBackups = defaultMaxBackups
+	}
+
+	fs := &FileSink{
+		path:       expandedPath,
+		maxSize:    int64(maxSizeMB) * 1024 * 1024,
+		maxBackups: maxBackups,
+	}
+	if err := fs.open(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *FileSink) Write(listing *leasechain.Listing) error {
+	line, err := json.Marshal(listing)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal listing")
+	}
+	line = append(line, '\n')
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.size > 0 && fs.size+int64(len(line)) > fs.maxSize {
+		if err := fs.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := fs.file.Write(line)
+	fs.size += int64(n)
+	if err != nil {
+		return errors.Wrapf(err, "failed to write to %s", fs.path)
+	}
+	return nil
+}
+
+func (fs *FileSink) Close() error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	return fs.file.Close()
+}
+
+func (fs *FileSink) open() error {
+	file, err := os.OpenFile(fs.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s", fs.path)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrapf(err, "failed to stat %s", fs.path)
+	}
+
+	fs.file = file
+	fs.size = info.Size()
+	return nil
+}
+
+// rotate shifts path.N to path.N+1, dropping the oldest backup, moves the
+// current file to path.1 and opens a fresh file
+func (fs *FileSink) rotate() error {
+	if err := fs.file.Close(); err != nil {
+		return errors.Wrapf(err, "failed to close %s", fs.path)
+	}
+
+	for idx := fs.maxBackups - 1; idx > 0; idx-- {
+		oldPath := fmt.Sprintf("%s.%d", fs.path, idx)
+		if _, err := os.Stat(oldPath); err != nil {
+			continue
+		}
+		if err := os.Rename(oldPath, fmt.Sprintf("%s.%d", fs.path, idx+1)); err != nil {
+			return errors.Wrapf(err, "failed to rotate %s", oldPath)
+		}
+	}
+
+	if err := os.Rename(fs.path, fs.path+".1"); err != nil {
+		return errors.Wrapf(err, "failed to rotate %s", fs.path)
+	}
+
+	return fs.open()
+}
@@ -0,0 +1,94 @@
+package sink
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/config"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/log"
+	"github.com/mikeadityas/vault-gcs-lister/pkg/leasechain"
+)
+
+const (
+	defaultQueueSize int = 16
+)
+
+// New creates the sink described by the config. The returned sink writes
+// asynchronously so a slow or failing destination never blocks the lister.
+func New(id string, sinkConf *config.SinkConfig) (leasechain.Sink, error) {
+	var (
+		sink leasechain.Sink
+		err  error
+	)
+
+	switch sinkConf.Type {
+	case "file":
+		sink, err = NewFileSink(sinkConf.Path, sinkConf.MaxSizeMB, sinkConf.MaxBackups)
+	case "stdout":
+		sink = NewStdoutSink(os.Stdout)
+	case "webhook":
+		sink, err = NewWebhookSink(
+			sinkConf.URL,
+			os.ExpandEnv(sinkConf.Secret),
+			sinkConf.MaxRetries,
+			sinkConf.Timeout,
+		)
+	default:
+		return nil, errors.Errorf("unknown sink type %q", sinkConf.Type)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create %s sink", sinkConf.Type)
+	}
+
+	return newAsyncSink(id, sink, defaultQueueSize), nil
+}
+
+type asyncSink struct {
+	id     string
+	sink   leasechain.Sink
+	queue  chan *leasechain.Listing
+	doneCh chan bool
+}
+
+func newAsyncSink(id string, sink leasechain.Sink, queueSize int) *asyncSink {
+	as := &asyncSink{
+		id:     id,
+		sink:   sink,
+		queue:  make(chan *leasechain.Listing, queueSize),
+		doneCh: make(chan bool),
+	}
+	go as.run()
+	return as
+}
+
+func (as *asyncSink) run() {
+	for listing := range as.queue {
+		if err := as.sink.Write(listing); err != nil {
+			log.Logger.Sugar().Errorw(
+				"Failed to write GCS listing to sink",
+				"sink_id", as.id,
+				"err", err,
+			)
+		}
+	}
+	as.doneCh <- true
+}
+
+// Write enqueues the listing, it drops the listing instead of blocking when
+// the queue is full
+func (as *asyncSink) Write(listing *leasechain.Listing) error {
+	select {
+	case as.queue <- listing:
+		return nil
+	default:
+		return errors.Errorf("sink %s queue is full, dropping listing", as.id)
+	}
+}
+
+// Close flushes the queued listings and closes the underlying sink
+func (as *asyncSink) Close() error {
+	close(as.queue)
+	<-as.doneCh
+	return as.sink.Close()
+}
@@ -0,0 +1,261 @@
+package sink
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mikeadityas/vault-gcs-lister/pkg/leasechain"
+)
+
+func testListing(projectID string) *leasechain.Listing {
+	return &leasechain.Listing{
+		ListerID:  "gcs-" + projectID,
+		ProjectID: projectID,
+		ListedAt:  time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC),
+		Buckets: []leasechain.Bucket{
+			{Name: projectID + "-logs", Location: "ASIA-SOUTHEAST2", StorageClass: "STANDARD"},
+		},
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	const secret = "webhook-secret"
+
+	var received *leasechain.Listing
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(r.Header.Get(SignatureHeader)), []byte(expected)) {
+			t.Errorf("signature %q does not verify", r.Header.Get(SignatureHeader))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		received = &leasechain.Listing{}
+		if err := json.Unmarshal(body, received); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	webhookSink, err := NewWebhookSink(server.URL, secret, 1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := webhookSink.Write(testListing("infra")); err != nil {
+		t.Fatal(err)
+	}
+	if received == nil || received.ProjectID != "infra" || len(received.Buckets) != 1 {
+		t.Fatalf("unexpected listing %+v", received)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	var (
+		mutex    sync.Mutex
+		attempts []time.Time
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		attempts = append(attempts, time.Now())
+		if len(attempts) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	webhookSink, err := NewWebhookSink(server.URL, "", 1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := webhookSink.Write(testListing("infra")); err != nil {
+		t.Fatalf("expected the retry to succeed, got %v", err)
+	}
+	if len(attempts) != 2 {
+		t.Fatalf("expected a retry after the 5xx, got %d attempts", len(attempts))
+	}
+	if backoff := attempts[1].Sub(attempts[0]); backoff < time.Second {
+		t.Errorf("expected the retry to back off for at least a second, got %v", backoff)
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	webhookSink, err := NewWebhookSink(server.URL, "", 1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = webhookSink.Write(testListing("infra"))
+	if err == nil || !strings.Contains(err.Error(), "giving up after 1 retries") {
+		t.Fatalf("expected the sink to give up, got %v", err)
+	}
+	if attempts != 2 {
+		t.Fatalf("expected 2 attempts, got %d", attempts)
+	}
+}
+
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "listings.jsonl")
+	fileSink, err := NewFileSink(path, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileSink.Close()
+	// A line per file, the max size is only configurable in MB
+	fileSink.maxSize = 10
+
+	for _, projectID := range []string{"first", "second", "third", "fourth"} {
+		if err := fileSink.Write(testListing(projectID)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The oldest listing is dropped with the backups beyond max backups
+	expected := map[string]string{
+		path:        "fourth",
+		path + ".1": "third",
+		path + ".2": "second",
+	}
+	for filePath, projectID := range expected {
+		lines := readLines(t, filePath)
+		if len(lines) != 1 {
+			t.Fatalf("expected a listing in %s, got %d", filePath, len(lines))
+		}
+		listing := leasechain.Listing{}
+		if err := json.Unmarshal([]byte(lines[0]), &listing); err != nil {
+			t.Fatal(err)
+		}
+		if listing.ProjectID != projectID {
+			t.Errorf("expected the listing of %s in %s, got %s", projectID, filePath, listing.ProjectID)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected no third backup, got %v", err)
+	}
+}
+
+func TestFileSinkAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "listings.jsonl")
+	for _, projectID := range []string{"first", "second"} {
+		fileSink, err := NewFileSink(path, 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fileSink.Write(testListing(projectID)); err != nil {
+			t.Fatal(err)
+		}
+		fileSink.Close()
+	}
+
+	if lines := readLines(t, path); len(lines) != 2 {
+		t.Fatalf("expected a restarted sink to append, got %d lines", len(lines))
+	}
+}
+
+// blockingSink blocks every write until released, failing it afterwards
+type blockingSink struct {
+	release chan struct{}
+
+	mutex   sync.Mutex
+	written []*leasechain.Listing
+	closed  bool
+}
+
+func (bs *blockingSink) Write(listing *leasechain.Listing) error {
+	<-bs.release
+
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	bs.written = append(bs.written, listing)
+	return errors.New("destination unavailable")
+}
+
+func (bs *blockingSink) Close() error {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	bs.closed = true
+	return nil
+}
+
+func TestAsyncSinkDropsWhenFull(t *testing.T) {
+	destination := &blockingSink{release: make(chan struct{})}
+	sink := newAsyncSink("webhook-infra", destination, 2)
+
+	// The first listing is taken by the writer, the next two fill the queue
+	var dropped int
+	for i := 0; i < 6; i++ {
+		done := make(chan error, 1)
+		go func() { done <- sink.Write(testListing("infra")) }()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				dropped++
+			}
+		case <-time.After(time.Second):
+			t.Fatal("a slow sink must not block the lister")
+		}
+		// Let the writer take the first listing off the queue
+		time.Sleep(10 * time.Millisecond)
+	}
+	if dropped != 3 {
+		t.Fatalf("expected 3 dropped listings, got %d", dropped)
+	}
+
+	// The failing writes are only logged, the queue is flushed on close
+	close(destination.release)
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(destination.written) != 3 || !destination.closed {
+		t.Fatalf("expected the 3 queued listings to be flushed and the sink closed, got %d %v", len(destination.written), destination.closed)
+	}
+}
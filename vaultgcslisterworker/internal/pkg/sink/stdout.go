@@ -0,0 +1,81 @@
+package sink
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mikeadityas/vault-gcs-lister/pkg/leasechain"
+)
+
+// StdoutSink pretty prints every listing as a table
+type StdoutSink struct {
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+func NewStdoutSink(out io.Writer) *StdoutSink {
+	return &StdoutSink{
+		out: out,
+	}
+}
+
+func (ss *StdoutSink) Write(listing *leasechain.Listing) error {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	fmt.Fprintf(
+		ss.out,
+		"Buckets in %s (%s, %d buckets)\n",
+		listing.ProjectID,
+		listing.ListedAt.Format(time.RFC3339),
+		len(listing.Buckets),
+	)
+
+	tw := tabwriter.NewWriter(ss.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tLOCATION\tSTORAGE CLASS\tVERSIONING\tUNIFORM ACCESS\tRETENTION\tCREATED\tLABELS")
+	for _, bucket := range listing.Buckets {
+		retention := "-"
+		if bucket.RetentionPolicy != nil {
+			retention = bucket.RetentionPolicy.RetentionPeriod.String()
+			if bucket.RetentionPolicy.IsLocked {
+				retention += " (locked)"
+			}
+		}
+
+		fmt.Fprintf(
+			tw,
+			"%s\t%s\t%s\t%t\t%t\t%s\t%s\t%s\n",
+			bucket.Name,
+			bucket.Location,
+			bucket.StorageClass,
+			bucket.VersioningEnabled,
+			bucket.UniformBucketLevelAccess,
+			retention,
+			bucket.Created.Format(time.RFC3339),
+			formatLabels(bucket.Labels),
+		)
+	}
+	return tw.Flush()
+}
+
+func (ss *StdoutSink) Close() error {
+	return nil
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return "-"
+	}
+
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
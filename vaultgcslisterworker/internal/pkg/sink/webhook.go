@@ -0,0 +1,101 @@
+package sink
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+
+	leaseUtil "github.com/mikeadityas/vault-gcs-lister/internal/pkg/util/lease"
+	"github.com/mikeadityas/vault-gcs-lister/pkg/leasechain"
+)
+
+const (
+	// SignatureHeader carries the hex encoded HMAC-SHA256 of the request body
+	SignatureHeader string = "X-Vault-GCS-Lister-Signature"
+
+	defaultMaxRetries int           = 3
+	defaultTimeout    time.Duration = 10 * time.Second
+	maxBackoff        time.Duration = 16 * time.Second
+)
+
+// WebhookSink POSTs every listing as JSON to a webhook
+type WebhookSink struct {
+	url        string
+	secret     []byte
+	maxRetries int
+	httpClient *http.Client
+}
+
+func NewWebhookSink(url, secret string, maxRetries int, timeout time.Duration) (*WebhookSink, error) {
+	if url == "" {
+		return nil, errors.New("webhook url is empty")
+	}
+
+	if maxRetries <= 0 {
+		maxRetries = defaultMaxRetries
+	}
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	return &WebhookSink{
+		url:        url,
+		secret:     []byte(secret),
+		maxRetries: maxRetries,
+		httpClient: &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (ws *WebhookSink) Write(listing *leasechain.Listing) error {
+	body, err := json.Marshal(listing)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal listing")
+	}
+
+	for numRetry := 0; ; numRetry++ {
+		err = ws.post(body)
+		if err == nil {
+			return nil
+		}
+
+		if numRetry >= ws.maxRetries {
+			return errors.Wrapf(err, "giving up after %d retries", numRetry)
+		}
+		time.Sleep(leaseUtil.CalculateBackoffTime(numRetry, maxBackoff))
+	}
+}
+
+func (ws *WebhookSink) Close() error {
+	return nil
+}
+
+func (ws *WebhookSink) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, ws.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to create webhook request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if len(ws.secret) > 0 {
+		mac := hmac.New(sha256.New, ws.secret)
+		mac.Write(body)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := ws.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to call webhook")
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package stress
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/log"
+)
+
+// Client is a simulated consumer of the GCP secrets engine, such as a
+// GCPLeaseManager
+type Client interface {
+	GetNewLease(ctx context.Context) error
+	GetKeyID() string
+	GetID() string
+}
+
+// Config controls the load generated against the GCP secrets engine
+type Config struct {
+	// Rate is the maximum number of requests per second across all clients
+	Rate float64
+	// RampUp is the period over which the clients are started one by one
+	RampUp time.Duration
+	// Duration is how long the load is generated, including the ramp-up
+	Duration time.Duration
+	// TTL is how long a client holds a key before requesting a new one, 0
+	// makes the clients request as fast as the rate allows
+	TTL time.Duration
+	// TTLJitter randomizes TTL by up to this fraction in both directions
+	TTLJitter float64
+}
+
+type result struct {
+	clientID string
+	latency  time.Duration
+	keyID    string
+	err      error
+}
+
+// Run generates load with the clients until the duration passes or the
+// context is done, and summarizes every request made
+func Run(ctx context.Context, stressConf Config, clients []Client) *Summary {
+	ctx, cancel := context.WithTimeout(ctx, stressConf.Duration)
+	defer cancel()
+
+	tokenCh := make(chan bool)
+	go generateTokens(ctx, stressConf.Rate, tokenCh)
+
+	var (
+		mutex     sync.Mutex
+		results   []result
+		waitGroup sync.WaitGroup
+	)
+
+	started := time.Now()
+	for idx, client := range clients {
+		startDelay := time.Duration(0)
+		if len(clients) > 1 {
+			startDelay = stressConf.RampUp * time.Duration(idx) / time.Duration(len(clients)-1)
+		}
+
+		waitGroup.Add(1)
+		go func(client Client, startDelay time.Duration) {
+			defer waitGroup.Done()
+
+			if !sleep(ctx, startDelay) {
+				return
+			}
+			log.Logger.Sugar().Debugw("Stress client started", "client_id", client.GetID())
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-tokenCh:
+				}
+
+				res := fetch(ctx, client)
+
+				mutex.Lock()
+				results = append(results, res)
+				mutex.Unlock()
+
+				if res.err == nil && !sleep(ctx, jitter(stressConf.TTL, stressConf.TTLJitter)) {
+					return
+				}
+			}
+		}(client, startDelay)
+	}
+
+	waitGroup.Wait()
+
+	return summarize(results, len(clients), time.Since(started))
+}
+
+func fetch(ctx context.Context, client Client) result {
+	start := time.Now()
+	err := client.GetNewLease(ctx)
+	res := result{
+		clientID: client.GetID(),
+		latency:  time.Since(start),
+		err:      err,
+	}
+
+	if err != nil {
+		log.Logger.Sugar().Debugw("Stress request failed", "client_id", res.clientID, "err", err)
+		return res
+	}
+
+	res.keyID = client.GetKeyID()
+	return res
+}
+
+// generateTokens releases one request every 1/rate seconds
+func generateTokens(ctx context.Context, rate float64, tokenCh chan<- bool) {
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			select {
+			case tokenCh <- true:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func jitter(ttl time.Duration, fraction float64) time.Duration {
+	if ttl <= 0 || fraction <= 0 {
+		return ttl
+	}
+	return ttl + time.Duration((rand.Float64()*2-1)*fraction*float64(ttl))
+}
+
+// sleep waits for the duration, it returns false if the context is done first
+func sleep(ctx context.Context, duration time.Duration) bool {
+	if duration <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
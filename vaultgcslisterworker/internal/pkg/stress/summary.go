@@ -0,0 +1,112 @@
+package stress
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// Summary is the outcome of a stress run
+type Summary struct {
+	Clients      int           `json:"clients"`
+	Elapsed      time.Duration `json:"elapsed"`
+	Requests     int           `json:"requests"`
+	Errors       int           `json:"errors"`
+	ErrorRate    float64       `json:"error_rate"`
+	P50          time.Duration `json:"p50"`
+	P95          time.Duration `json:"p95"`
+	P99          time.Duration `json:"p99"`
+	Max          time.Duration `json:"max"`
+	DistinctKeys int           `json:"distinct_keys"`
+	KeyLimit     int           `json:"key_limit"`
+	// KeyRequests is the number of successful requests that returned each key
+	KeyRequests map[string]int `json:"key_requests"`
+	// ErrorCounts is the number of failed requests per error message
+	ErrorCounts map[string]int `json:"error_counts,omitempty"`
+}
+
+func summarize(results []result, clients int, elapsed time.Duration) *Summary {
+	summary := &Summary{
+		Clients:     clients,
+		Elapsed:     elapsed,
+		Requests:    len(results),
+		KeyRequests: map[string]int{},
+		ErrorCounts: map[string]int{},
+	}
+
+	latencies := make([]time.Duration, 0, len(results))
+	for _, res := range results {
+		latencies = append(latencies, res.latency)
+
+		if res.err != nil {
+			summary.Errors++
+			summary.ErrorCounts[res.err.Error()]++
+			continue
+		}
+		summary.KeyRequests[res.keyID]++
+	}
+
+	summary.DistinctKeys = len(summary.KeyRequests)
+	if summary.Requests > 0 {
+		summary.ErrorRate = float64(summary.Errors) / float64(summary.Requests)
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	summary.P50 = percentile(latencies, 50)
+	summary.P95 = percentile(latencies, 95)
+	summary.P99 = percentile(latencies, 99)
+	if len(latencies) > 0 {
+		summary.Max = latencies[len(latencies)-1]
+	}
+
+	return summary
+}
+
+// percentile returns the nearest-rank percentile of the sorted latencies
+func percentile(sortedLatencies []time.Duration, p int) time.Duration {
+	if len(sortedLatencies) == 0 {
+		return 0
+	}
+
+	rank := (p*len(sortedLatencies) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sortedLatencies[rank-1]
+}
+
+// Print writes a human readable summary, comparing the keys issued against
+// the key limit of the roleset
+func (s *Summary) Print(out io.Writer) {
+	fmt.Fprintf(out, "Clients:        %d\n", s.Clients)
+	fmt.Fprintf(out, "Elapsed:        %s\n", s.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(out, "Requests:       %d\n", s.Requests)
+	fmt.Fprintf(out, "Errors:         %d (%.2f%%)\n", s.Errors, s.ErrorRate*100)
+	fmt.Fprintf(out, "Latency p50:    %s\n", s.P50.Round(time.Millisecond))
+	fmt.Fprintf(out, "Latency p95:    %s\n", s.P95.Round(time.Millisecond))
+	fmt.Fprintf(out, "Latency p99:    %s\n", s.P99.Round(time.Millisecond))
+	fmt.Fprintf(out, "Latency max:    %s\n", s.Max.Round(time.Millisecond))
+
+	verdict := "within limit"
+	if s.DistinctKeys > s.KeyLimit {
+		verdict = "LIMIT EXCEEDED"
+	}
+	fmt.Fprintf(out, "Keys issued:    %d / %d (%s)\n", s.DistinctKeys, s.KeyLimit, verdict)
+
+	keyIDs := make([]string, 0, len(s.KeyRequests))
+	for keyID := range s.KeyRequests {
+		keyIDs = append(keyIDs, keyID)
+	}
+	sort.Strings(keyIDs)
+	for _, keyID := range keyIDs {
+		fmt.Fprintf(out, "  %s: %d requests\n", keyID, s.KeyRequests[keyID])
+	}
+
+	if len(s.ErrorCounts) > 0 {
+		fmt.Fprintln(out, "Errors by message:")
+		for message, count := range s.ErrorCounts {
+			fmt.Fprintf(out, "  %d x %s\n", count, message)
+		}
+	}
+}
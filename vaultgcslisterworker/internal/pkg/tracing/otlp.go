@@ -0,0 +1,338 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const otlpTimeout = 10 * time.Second
+
+// The spans are exported with the JSON encoding of OTLP/HTTP: hex trace and
+// span IDs, 64 bit integers as strings and the enum numbers of OTLP. The
+// official otlptracehttp exporter encodes protobuf, and its protobuf and gRPC
+// dependencies would upgrade the Google API client the GCS lister is pinned
+// to. The OpenTelemetry collector accepts JSON, receivers that only accept
+// binary protobuf do not.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Links             []otlpLink     `json:"links,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string         `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpLink struct {
+	TraceID    string         `json:"traceId"`
+	SpanID     string         `json:"spanId"`
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string         `json:"stringValue,omitempty"`
+	BoolValue   *bool           `json:"boolValue,omitempty"`
+	IntValue    *string         `json:"intValue,omitempty"`
+	DoubleValue *float64        `json:"doubleValue,omitempty"`
+	ArrayValue  *otlpArrayValue `json:"arrayValue,omitempty"`
+}
+
+type otlpArrayValue struct {
+	Values []otlpAnyValue `json:"values"`
+}
+
+// OTLPExporter exports spans to an OTLP/HTTP receiver
+type OTLPExporter struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func NewOTLPExporter(endpoint string, headers map[string]string) *OTLPExporter {
+	return &OTLPExporter{
+		url:     strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		headers: headers,
+		client:  &http.Client{Timeout: otlpTimeout},
+	}
+}
+
+func (oe *OTLPExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	body, err := encodeSpans(spans)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, oe.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "invalid OTLP endpoint")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range oe.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := oe.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to export spans")
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("failed to export spans, the OTLP receiver answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (oe *OTLPExporter) Shutdown(ctx context.Context) error {
+	oe.client.CloseIdleConnections()
+	return nil
+}
+
+// FileExporter appends spans to a file as OTLP JSON lines, the format read by
+// the otlpjsonfile receiver of the OpenTelemetry collector
+type FileExporter struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func NewFileExporter(path string) (*FileExporter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, errors.Wrap(err, "failed to create trace file directory")
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open trace file")
+	}
+	return &FileExporter{file: file}, nil
+}
+
+func (fe *FileExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	body, err := encodeSpans(spans)
+	if err != nil {
+		return err
+	}
+
+	fe.mutex.Lock()
+	defer fe.mutex.Unlock()
+
+	if _, err := fe.file.Write(append(body, '\n')); err != nil {
+		return errors.Wrap(err, "failed to write spans")
+	}
+	return nil
+}
+
+func (fe *FileExporter) Shutdown(ctx context.Context) error {
+	fe.mutex.Lock()
+	defer fe.mutex.Unlock()
+
+	return fe.file.Close()
+}
+
+// encodeSpans encodes spans as an OTLP export request, grouped by resource
+// and instrumentation scope
+func encodeSpans(spans []sdktrace.ReadOnlySpan) ([]byte, error) {
+	request := otlpRequest{ResourceSpans: []otlpResourceSpans{}}
+	resourceIdx := map[string]int{}
+	scopeIdx := map[string]int{}
+
+	for _, span := range spans {
+		resourceKey := ""
+		var resourceAttrs []attribute.KeyValue
+		if span.Resource() != nil {
+			resourceKey = span.Resource().Encoded(attribute.DefaultEncoder())
+			resourceAttrs = span.Resource().Attributes()
+		}
+
+		rIdx, ok := resourceIdx[resourceKey]
+		if !ok {
+			rIdx = len(request.ResourceSpans)
+			resourceIdx[resourceKey] = rIdx
+			request.ResourceSpans = append(request.ResourceSpans, otlpResourceSpans{
+				Resource: otlpResource{Attributes: encodeAttributes(resourceAttrs)},
+			})
+		}
+		resourceSpans := &request.ResourceSpans[rIdx]
+
+		scope := span.InstrumentationScope()
+		scopeKey := resourceKey + "\x00" + scope.Name + "\x00" + scope.Version
+		sIdx, ok := scopeIdx[scopeKey]
+		if !ok {
+			sIdx = len(resourceSpans.ScopeSpans)
+			scopeIdx[scopeKey] = sIdx
+			resourceSpans.ScopeSpans = append(resourceSpans.ScopeSpans, otlpScopeSpans{
+				Scope: otlpScope{Name: scope.Name, Version: scope.Version},
+			})
+		}
+		scopeSpans := &resourceSpans.ScopeSpans[sIdx]
+		scopeSpans.Spans = append(scopeSpans.Spans, encodeSpan(span))
+	}
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode spans")
+	}
+	return body, nil
+}
+
+func encodeSpan(span sdktrace.ReadOnlySpan) otlpSpan {
+	encoded := otlpSpan{
+		TraceID:           span.SpanContext().TraceID().String(),
+		SpanID:            span.SpanContext().SpanID().String(),
+		Name:              span.Name(),
+		Kind:              int(span.SpanKind()),
+		StartTimeUnixNano: unixNano(span.StartTime()),
+		EndTimeUnixNano:   unixNano(span.EndTime()),
+		Attributes:        encodeAttributes(span.Attributes()),
+		Status:            encodeStatus(span.Status()),
+	}
+	if span.Parent().HasSpanID() {
+		encoded.ParentSpanID = span.Parent().SpanID().String()
+	}
+	if encoded.Kind == int(trace.SpanKindUnspecified) {
+		encoded.Kind = int(trace.SpanKindInternal)
+	}
+
+	for _, event := range span.Events() {
+		encoded.Events = append(encoded.Events, otlpEvent{
+			TimeUnixNano: unixNano(event.Time),
+			Name:         event.Name,
+			Attributes:   encodeAttributes(event.Attributes),
+		})
+	}
+	for _, link := range span.Links() {
+		encoded.Links = append(encoded.Links, otlpLink{
+			TraceID:    link.SpanContext.TraceID().String(),
+			SpanID:     link.SpanContext.SpanID().String(),
+			Attributes: encodeAttributes(link.Attributes),
+		})
+	}
+	return encoded
+}
+
+// encodeStatus maps the status codes of the SDK to the ones of OTLP, where
+// Ok and Error are swapped
+func encodeStatus(status sdktrace.Status) otlpStatus {
+	switch status.Code {
+	case codes.Ok:
+		return otlpStatus{Code: 1}
+	case codes.Error:
+		return otlpStatus{Code: 2, Message: status.Description}
+	default:
+		return otlpStatus{}
+	}
+}
+
+func encodeAttributes(attrs []attribute.KeyValue) []otlpKeyValue {
+	encoded := make([]otlpKeyValue, 0, len(attrs))
+	for _, attr := range attrs {
+		encoded = append(encoded, otlpKeyValue{Key: string(attr.Key), Value: encodeValue(attr.Value)})
+	}
+	return encoded
+}
+
+func encodeValue(value attribute.Value) otlpAnyValue {
+	switch value.Type() {
+	case attribute.BOOL:
+		v := value.AsBool()
+		return otlpAnyValue{BoolValue: &v}
+	case attribute.INT64:
+		v := strconv.FormatInt(value.AsInt64(), 10)
+		return otlpAnyValue{IntValue: &v}
+	case attribute.FLOAT64:
+		v := value.AsFloat64()
+		return otlpAnyValue{DoubleValue: &v}
+	case attribute.BOOLSLICE:
+		array := &otlpArrayValue{Values: []otlpAnyValue{}}
+		for _, v := range value.AsBoolSlice() {
+			array.Values = append(array.Values, encodeValue(attribute.BoolValue(v)))
+		}
+		return otlpAnyValue{ArrayValue: array}
+	case attribute.INT64SLICE:
+		array := &otlpArrayValue{Values: []otlpAnyValue{}}
+		for _, v := range value.AsInt64Slice() {
+			array.Values = append(array.Values, encodeValue(attribute.Int64Value(v)))
+		}
+		return otlpAnyValue{ArrayValue: array}
+	case attribute.FLOAT64SLICE:
+		array := &otlpArrayValue{Values: []otlpAnyValue{}}
+		for _, v := range value.AsFloat64Slice() {
+			array.Values = append(array.Values, encodeValue(attribute.Float64Value(v)))
+		}
+		return otlpAnyValue{ArrayValue: array}
+	case attribute.STRINGSLICE:
+		array := &otlpArrayValue{Values: []otlpAnyValue{}}
+		for _, v := range value.AsStringSlice() {
+			array.Values = append(array.Values, encodeValue(attribute.StringValue(v)))
+		}
+		return otlpAnyValue{ArrayValue: array}
+	default:
+		v := value.Emit()
+		return otlpAnyValue{StringValue: &v}
+	}
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
@@ -0,0 +1,186 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	testTraceID = trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36}
+	testSpanID  = trace.SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7}
+	testParent  = trace.SpanID{0x53, 0x99, 0x5c, 0x3f, 0x42, 0xcd, 0x8a, 0xd8}
+)
+
+// testSpans returns a child span with every attribute type, an event, a link
+// and an error status, and a root span of another scope
+func testSpans() []sdktrace.ReadOnlySpan {
+	start := time.Unix(1700000000, 5)
+	res := resource.NewSchemaless(attribute.String("service.name", "vault-gcs-lister"))
+
+	return tracetest.SpanStubs{
+		{
+			Name: "gcp.refresh",
+			SpanContext: trace.NewSpanContext(trace.SpanContextConfig{
+				TraceID: testTraceID,
+				SpanID:  testSpanID,
+			}),
+			Parent: trace.NewSpanContext(trace.SpanContextConfig{
+				TraceID: testTraceID,
+				SpanID:  testParent,
+			}),
+			StartTime: start,
+			EndTime:   start.Add(time.Second),
+			Attributes: []attribute.KeyValue{
+				attribute.String("target", "infra"),
+				attribute.Int64("ttl", 3600),
+				attribute.Bool("forced", true),
+				attribute.Float64("ratio", 0.5),
+				attribute.StringSlice("buckets", []string{"a", "b"}),
+				attribute.Int64Slice("sizes", []int64{1, 2}),
+			},
+			Events: []sdktrace.Event{
+				{Name: "rotated", Time: start.Add(time.Millisecond), Attributes: []attribute.KeyValue{attribute.String("key_id", "key-1")}},
+			},
+			Links: []sdktrace.Link{
+				{SpanContext: trace.NewSpanContext(trace.SpanContextConfig{TraceID: testTraceID, SpanID: testParent})},
+			},
+			Status:                 sdktrace.Status{Code: codes.Error, Description: "permission denied"},
+			Resource:               res,
+			InstrumentationLibrary: instrumentation.Library{Name: instrumentationName, Version: "v1"},
+		},
+		{
+			Name: "vault.renew",
+			SpanContext: trace.NewSpanContext(trace.SpanContextConfig{
+				TraceID: testTraceID,
+				SpanID:  testParent,
+			}),
+			SpanKind:               trace.SpanKindClient,
+			StartTime:              start,
+			EndTime:                start.Add(2 * time.Second),
+			Status:                 sdktrace.Status{Code: codes.Ok},
+			Resource:               res,
+			InstrumentationLibrary: instrumentation.Library{Name: "other"},
+		},
+	}.Snapshots()
+}
+
+// expectedOTLP is testSpans in the OTLP/JSON encoding: hex IDs, integers as
+// strings, the kind and status codes of OTLP
+const expectedOTLP = `{
+  "resourceSpans": [{
+    "resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "vault-gcs-lister"}}]},
+    "scopeSpans": [
+      {
+        "scope": {"name": "github.com/mikeadityas/vault-gcs-lister", "version": "v1"},
+        "spans": [{
+          "traceId": "4bf92f3577b34da6a3ce929d0e0e4736",
+          "spanId": "00f067aa0ba902b7",
+          "parentSpanId": "53995c3f42cd8ad8",
+          "name": "gcp.refresh",
+          "kind": 1,
+          "startTimeUnixNano": "1700000000000000005",
+          "endTimeUnixNano": "1700000001000000005",
+          "attributes": [
+            {"key": "target", "value": {"stringValue": "infra"}},
+            {"key": "ttl", "value": {"intValue": "3600"}},
+            {"key": "forced", "value": {"boolValue": true}},
+            {"key": "ratio", "value": {"doubleValue": 0.5}},
+            {"key": "buckets", "value": {"arrayValue": {"values": [{"stringValue": "a"}, {"stringValue": "b"}]}}},
+            {"key": "sizes", "value": {"arrayValue": {"values": [{"intValue": "1"}, {"intValue": "2"}]}}}
+          ],
+          "events": [{
+            "timeUnixNano": "1700000000001000005",
+            "name": "rotated",
+            "attributes": [{"key": "key_id", "value": {"stringValue": "key-1"}}]
+          }],
+          "links": [{"traceId": "4bf92f3577b34da6a3ce929d0e0e4736", "spanId": "53995c3f42cd8ad8"}],
+          "status": {"code": 2, "message": "permission denied"}
+        }]
+      },
+      {
+        "scope": {"name": "other"},
+        "spans": [{
+          "traceId": "4bf92f3577b34da6a3ce929d0e0e4736",
+          "spanId": "53995c3f42cd8ad8",
+          "name": "vault.renew",
+          "kind": 3,
+          "startTimeUnixNano": "1700000000000000005",
+          "endTimeUnixNano": "1700000002000000005",
+          "status": {"code": 1}
+        }]
+      }
+    ]
+  }]
+}`
+
+func assertOTLP(t *testing.T, body []byte) {
+	t.Helper()
+
+	var got, expected interface{}
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("invalid JSON %s: %v", body, err)
+	}
+	if err := json.Unmarshal([]byte(expectedOTLP), &expected); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected OTLP encoding\ngot:      %s\nexpected: %s", body, expectedOTLP)
+	}
+}
+
+func TestEncodeSpans(t *testing.T) {
+	body, err := encodeSpans(testSpans())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOTLP(t, body)
+}
+
+func TestOTLPExporterPostsJSON(t *testing.T) {
+	var body []byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Method != http.MethodPost {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("unexpected Content-Type %q", contentType)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer secret" {
+			t.Errorf("unexpected Authorization %q", auth)
+		}
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer receiver.Close()
+
+	exporter := NewOTLPExporter(receiver.URL+"/", map[string]string{"Authorization": "Bearer secret"})
+	if err := exporter.ExportSpans(context.Background(), testSpans()); err != nil {
+		t.Fatal(err)
+	}
+	assertOTLP(t, body)
+}
+
+func TestOTLPExporterRejected(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+	}))
+	defer receiver.Close()
+
+	exporter := NewOTLPExporter(receiver.URL, nil)
+	if err := exporter.ExportSpans(context.Background(), testSpans()); err == nil {
+		t.Fatal("expected an error when the receiver rejects the spans")
+	}
+}
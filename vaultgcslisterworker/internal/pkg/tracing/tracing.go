@@ -0,0 +1,74 @@
+package tracing
+
+import (
+	"context"
+	"os"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/config"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/log"
+)
+
+const instrumentationName = "github.com/mikeadityas/vault-gcs-lister"
+
+// Init installs the global tracer provider exporting to the exporter of
+// tracingConf, the returned func flushes and stops it. Without exporter the
+// global provider stays a no-op.
+func Init(tracingConf *config.TracingConfig) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	switch tracingConf.Exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		headers := map[string]string{}
+		for name, value := range tracingConf.Headers {
+			headers[name] = os.ExpandEnv(value)
+		}
+		exporter = NewOTLPExporter(tracingConf.Endpoint, headers)
+	case "file":
+		fileExporter, err := NewFileExporter(tracingConf.Path)
+		if err != nil {
+			return nil, err
+		}
+		exporter = fileExporter
+	default:
+		return nil, errors.Errorf("unknown trace exporter %q", tracingConf.Exporter)
+	}
+
+	serviceName := tracingConf.ServiceName
+	if serviceName == "" {
+		serviceName = "vault-gcs-lister"
+	}
+
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(tracingConf.SampleRatio))),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Logger.Sugar().Warnw("Failed to export traces", "err", err)
+	}))
+	return tracerProvider.Shutdown, nil
+}
+
+// Start starts a span of the lease chain, a child of the span in ctx if any
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends span, marking it as failed if err is not nil
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
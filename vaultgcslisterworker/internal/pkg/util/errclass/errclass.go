@@ -0,0 +1,186 @@
+package errclass
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+
+	leaseUtil "github.com/mikeadityas/vault-gcs-lister/internal/pkg/util/lease"
+)
+
+// Class tells how a failed operation should be retried
+type Class string
+
+const (
+	// Transient errors, such as network failures or 5xx, are retried with
+	// exponential backoff
+	Transient Class = "transient"
+	// RateLimited errors are retried after the server's Retry-After
+	RateLimited Class = "rate_limited"
+	// AuthExpired means the credential used for the request is no longer
+	// accepted and has to be replaced
+	AuthExpired Class = "auth_expired"
+	// PermissionDenied means the credential is valid but not allowed
+	PermissionDenied Class = "permission_denied"
+	// Misconfiguration means the request provably can never succeed as
+	// configured, such as a nonexistent secrets path
+	Misconfiguration Class = "misconfiguration"
+	// Rejected means the server refused the request as invalid (400 or 404),
+	// which may be a passing state of the server such as a role being
+	// recreated
+	Rejected Class = "rejected"
+	// MalformedSecret means Vault returned a secret that cannot be used
+	MalformedSecret Class = "malformed_secret"
+)
+
+const (
+	// PermanentRetryInterval is how often a permanent error is retried, in
+	// case it is fixed from the outside
+	PermanentRetryInterval time.Duration = 5 * time.Minute
+)
+
+// IsPermanent reports whether retrying without an outside change is futile
+func (c Class) IsPermanent() bool {
+	switch c {
+	case PermissionDenied, Misconfiguration, MalformedSecret, Rejected:
+		return true
+	default:
+		return false
+	}
+}
+
+// RetryDelay returns how long to wait before the next retry, or false if the
+// operation must not be retried at all
+func (c Class) RetryDelay(retryAfter time.Duration, numRetry int, maxBackoff time.Duration) (time.Duration, bool) {
+	switch c {
+	case Misconfiguration:
+		return 0, false
+	case PermissionDenied, MalformedSecret, Rejected:
+		return PermanentRetryInterval, true
+	case RateLimited:
+		if retryAfter > 0 {
+			return retryAfter, true
+		}
+	}
+	return leaseUtil.CalculateBackoffTime(numRetry, maxBackoff), true
+}
+
+// Error is an error with its class attached
+type Error struct {
+	Class      Class
+	RetryAfter time.Duration
+	Err        error
+}
+
+// New attaches the class to err
+func New(class Class, err error) error {
+	return &Error{
+		Class: class,
+		Err:   err,
+	}
+}
+
+// WithRetryAfter classifies err as rate limited for the duration of the
+// Retry-After header, it returns err as is without the header
+func WithRetryAfter(err error, header http.Header) error {
+	retryAfter := parseRetryAfter(header)
+	if retryAfter <= 0 {
+		return err
+	}
+
+	return &Error{
+		Class:      RateLimited,
+		RetryAfter: retryAfter,
+		Err:        err,
+	}
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Cause() error {
+	return e.Err
+}
+
+// Classify returns the class of err and the delay requested by the server,
+// unknown errors are transient
+func Classify(err error) (Class, time.Duration) {
+	for ; err != nil; err = unwrap(err) {
+		switch e := err.(type) {
+		case *Error:
+			return e.Class, e.RetryAfter
+		case *api.ResponseError:
+			return classifyStatus(e.StatusCode, strings.Join(e.Errors, "; ")), 0
+		case *googleapi.Error:
+			return classifyStatus(e.Code, e.Message), parseRetryAfter(e.Header)
+		case *oauth2.RetrieveError:
+			// The token exchange answers invalid_grant or invalid_client with
+			// 400 or 401 when the key no longer exists
+			if e.Response != nil && e.Response.StatusCode < http.StatusInternalServerError {
+				return AuthExpired, 0
+			}
+			return Transient, 0
+		case net.Error:
+			return Transient, 0
+		}
+	}
+	return Transient, 0
+}
+
+func classifyStatus(statusCode int, message string) Class {
+	switch {
+	case statusCode == http.StatusTooManyRequests:
+		return RateLimited
+	case statusCode == http.StatusUnauthorized:
+		return AuthExpired
+	case statusCode == http.StatusForbidden:
+		// Vault answers 403 for both an expired token and a denying policy
+		if strings.Contains(message, "invalid token") || strings.Contains(message, "token expired") {
+			return AuthExpired
+		}
+		return PermissionDenied
+	case statusCode == http.StatusNotFound, statusCode == http.StatusBadRequest:
+		return Rejected
+	default:
+		return Transient
+	}
+}
+
+func parseRetryAfter(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if retryTime, err := http.ParseTime(value); err == nil {
+		return time.Until(retryTime)
+	}
+	return 0
+}
+
+// unwrap supports both the standard Unwrap and pkg/errors Cause
+func unwrap(err error) error {
+	switch e := err.(type) {
+	case interface{ Unwrap() error }:
+		return e.Unwrap()
+	case interface{ Cause() error }:
+		return e.Cause()
+	default:
+		return nil
+	}
+}
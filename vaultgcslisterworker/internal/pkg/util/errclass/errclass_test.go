@@ -0,0 +1,147 @@
+package errclass
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		class      Class
+		retryAfter time.Duration
+	}{
+		{
+			name:  "unknown error",
+			err:   errors.New("boom"),
+			class: Transient,
+		},
+		{
+			name:  "network error",
+			err:   &net.OpError{Op: "dial", Err: errors.New("connection refused")},
+			class: Transient,
+		},
+		{
+			name:  "deadline exceeded",
+			err:   errors.Wrap(context.DeadlineExceeded, "failed to read"),
+			class: Transient,
+		},
+		{
+			name:  "Vault 5xx",
+			err:   &api.ResponseError{StatusCode: http.StatusBadGateway},
+			class: Transient,
+		},
+		{
+			name:  "Vault rate limited",
+			err:   &api.ResponseError{StatusCode: http.StatusTooManyRequests},
+			class: RateLimited,
+		},
+		{
+			name:  "Vault unauthorized",
+			err:   &api.ResponseError{StatusCode: http.StatusUnauthorized},
+			class: AuthExpired,
+		},
+		{
+			name:  "Vault invalid token",
+			err:   &api.ResponseError{StatusCode: http.StatusForbidden, Errors: []string{"permission denied", "invalid token"}},
+			class: AuthExpired,
+		},
+		{
+			name:  "Vault token expired",
+			err:   &api.ResponseError{StatusCode: http.StatusForbidden, Errors: []string{"token expired"}},
+			class: AuthExpired,
+		},
+		{
+			name:  "Vault permission denied",
+			err:   &api.ResponseError{StatusCode: http.StatusForbidden, Errors: []string{"1 error occurred:\n\t* permission denied\n\n"}},
+			class: PermissionDenied,
+		},
+		{
+			name:  "Vault not found",
+			err:   &api.ResponseError{StatusCode: http.StatusNotFound},
+			class: Rejected,
+		},
+		{
+			name:  "Vault bad request",
+			err:   &api.ResponseError{StatusCode: http.StatusBadRequest, Errors: []string{"role not found"}},
+			class: Rejected,
+		},
+		{
+			name:  "wrapped Vault error",
+			err:   errors.Wrap(&api.ResponseError{StatusCode: http.StatusForbidden}, "failed to read"),
+			class: PermissionDenied,
+		},
+		{
+			name:  "GCS forbidden",
+			err:   &googleapi.Error{Code: http.StatusForbidden, Message: "does not have storage.buckets.list access"},
+			class: PermissionDenied,
+		},
+		{
+			name:       "GCS rate limited with Retry-After",
+			err:        &googleapi.Error{Code: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"30"}}},
+			class:      RateLimited,
+			retryAfter: 30 * time.Second,
+		},
+		{
+			name:  "OAuth invalid grant",
+			err:   &oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusBadRequest}},
+			class: AuthExpired,
+		},
+		{
+			name:  "OAuth server error",
+			err:   &oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusServiceUnavailable}},
+			class: Transient,
+		},
+		{
+			name:  "explicit class",
+			err:   errors.Wrap(New(Misconfiguration, errors.New("wrong roleset")), "failed to fetch"),
+			class: Misconfiguration,
+		},
+		{
+			name:       "Retry-After",
+			err:        WithRetryAfter(errors.New("sealed"), http.Header{"Retry-After": {"5"}}),
+			class:      RateLimited,
+			retryAfter: 5 * time.Second,
+		},
+		{
+			name:  "no Retry-After",
+			err:   WithRetryAfter(&api.ResponseError{StatusCode: http.StatusServiceUnavailable}, http.Header{}),
+			class: Transient,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			class, retryAfter := Classify(tt.err)
+			if class != tt.class || retryAfter != tt.retryAfter {
+				t.Fatalf("expected %s after %v, got %s after %v", tt.class, tt.retryAfter, class, retryAfter)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	if _, retry := Misconfiguration.RetryDelay(0, 0, time.Minute); retry {
+		t.Error("a misconfiguration must not be retried")
+	}
+	for _, class := range []Class{PermissionDenied, MalformedSecret, Rejected} {
+		if delay, retry := class.RetryDelay(0, 0, time.Minute); !retry || delay != PermanentRetryInterval {
+			t.Errorf("expected %s to be retried after %v, got %v %v", class, PermanentRetryInterval, delay, retry)
+		}
+	}
+	if delay, _ := RateLimited.RetryDelay(42*time.Second, 0, time.Minute); delay != 42*time.Second {
+		t.Errorf("expected the Retry-After of a rate limited error, got %v", delay)
+	}
+	if delay, retry := AuthExpired.RetryDelay(0, 0, time.Minute); !retry || delay >= PermanentRetryInterval {
+		t.Errorf("expected an expired auth to be retried with backoff, got %v %v", delay, retry)
+	}
+}
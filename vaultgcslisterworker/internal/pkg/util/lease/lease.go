@@ -3,7 +3,12 @@ package lease
 import (
 	"math"
 	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 // CalculateBackoffTime calculates the backoff time for the current retry
@@ -18,3 +23,133 @@ func CalculateBackoffTime(numRetry int, maxBackoff time.Duration) time.Duration
 	}
 	return maxBackoff
 }
+
+// BackoffLimiter allows an action at most once per interval, doubling the
+// interval every time the action is allowed until it is reset
+type BackoffLimiter struct {
+	mutex       sync.Mutex
+	minInterval time.Duration
+	maxInterval time.Duration
+	interval    time.Duration
+	next        time.Time
+}
+
+func NewBackoffLimiter(minInterval, maxInterval time.Duration) *BackoffLimiter {
+	return &BackoffLimiter{
+		minInterval: minInterval,
+		maxInterval: maxInterval,
+		interval:    minInterval,
+	}
+}
+
+// Allow reports whether the action may happen now
+func (bl *BackoffLimiter) Allow() bool {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	now := time.Now()
+	if now.Before(bl.next) {
+		return false
+	}
+
+	bl.next = now.Add(bl.interval)
+	bl.interval *= 2
+	if bl.interval > bl.maxInterval {
+		bl.interval = bl.maxInterval
+	}
+	return true
+}
+
+// Next returns when the action is allowed again
+func (bl *BackoffLimiter) Next() time.Time {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	return bl.next
+}
+
+// Reset shrinks the interval back to the minimum
+func (bl *BackoffLimiter) Reset() {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	bl.interval = bl.minInterval
+}
+
+// EarlyRenewal is how long before its expiry a lease is renewed, either a
+// fixed duration or a percentage of its TTL such as 25%
+type EarlyRenewal struct {
+	Duration time.Duration
+	Percent  float64
+}
+
+// ParseEarlyRenewal parses a duration such as 2m or a percentage such as 25%
+func ParseEarlyRenewal(value string) (EarlyRenewal, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasSuffix(value, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil {
+			return EarlyRenewal{}, errors.Wrapf(err, "invalid early renewal percentage %q", value)
+		}
+		earlyRenewal := EarlyRenewal{Percent: percent}
+		return earlyRenewal, earlyRenewal.Validate()
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return EarlyRenewal{}, errors.Wrapf(err, "invalid early renewal %q", value)
+	}
+	earlyRenewal := EarlyRenewal{Duration: duration}
+	return earlyRenewal, earlyRenewal.Validate()
+}
+
+// Validate rejects negative durations and percentages outside [0, 100)
+func (er EarlyRenewal) Validate() error {
+	if er.Duration < 0 {
+		return errors.Errorf("early renewal %s is negative", er.Duration)
+	}
+	if er.Percent < 0 || er.Percent >= 100 {
+		return errors.Errorf("early renewal %v%% is not between 0%% and 100%%", er.Percent)
+	}
+	if er.Duration != 0 && er.Percent != 0 {
+		return errors.New("early renewal is both a duration and a percentage")
+	}
+	return nil
+}
+
+func (er EarlyRenewal) IsZero() bool {
+	return er.Duration == 0 && er.Percent == 0
+}
+
+// Before returns how long before its expiry a lease valid for ttl is renewed
+func (er EarlyRenewal) Before(ttl time.Duration) time.Duration {
+	if er.Percent != 0 {
+		return time.Duration(float64(ttl) * er.Percent / 100)
+	}
+	return er.Duration
+}
+
+func (er EarlyRenewal) String() string {
+	if er.Percent != 0 {
+		return strconv.FormatFloat(er.Percent, 'f', -1, 64) + "%"
+	}
+	return er.Duration.String()
+}
+
+// Set parses value, so EarlyRenewal can be bound to a flag
+func (er *EarlyRenewal) Set(value string) error {
+	earlyRenewal, err := ParseEarlyRenewal(value)
+	if err != nil {
+		return err
+	}
+	*er = earlyRenewal
+	return nil
+}
+
+func (er EarlyRenewal) MarshalText() ([]byte, error) {
+	return []byte(er.String()), nil
+}
+
+func (er *EarlyRenewal) UnmarshalText(text []byte) error {
+	return er.Set(string(text))
+}
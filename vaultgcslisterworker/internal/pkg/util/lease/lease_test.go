@@ -0,0 +1,165 @@
+package lease
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestParseEarlyRenewal(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected EarlyRenewal
+		invalid  bool
+	}{
+		{value: "2m", expected: EarlyRenewal{Duration: 2 * time.Minute}},
+		{value: " 90s ", expected: EarlyRenewal{Duration: 90 * time.Second}},
+		{value: "0s", expected: EarlyRenewal{}},
+		{value: "25%", expected: EarlyRenewal{Percent: 25}},
+		{value: "12.5%", expected: EarlyRenewal{Percent: 12.5}},
+		{value: "0%", expected: EarlyRenewal{}},
+		{value: "99.9%", expected: EarlyRenewal{Percent: 99.9}},
+		{value: "100%", invalid: true},
+		{value: "150%", invalid: true},
+		{value: "-5%", invalid: true},
+		{value: "-1m", invalid: true},
+		{value: "%", invalid: true},
+		{value: "abc%", invalid: true},
+		{value: "2", invalid: true},
+		{value: "", invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			earlyRenewal, err := ParseEarlyRenewal(tt.value)
+			if tt.invalid {
+				if err == nil {
+					t.Fatalf("expected %q to be rejected, got %+v", tt.value, earlyRenewal)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if earlyRenewal != tt.expected {
+				t.Fatalf("expected %+v, got %+v", tt.expected, earlyRenewal)
+			}
+		})
+	}
+}
+
+func TestEarlyRenewalValidate(t *testing.T) {
+	tests := []struct {
+		name         string
+		earlyRenewal EarlyRenewal
+		invalid      bool
+	}{
+		{name: "zero", earlyRenewal: EarlyRenewal{}},
+		{name: "duration", earlyRenewal: EarlyRenewal{Duration: time.Minute}},
+		{name: "percentage", earlyRenewal: EarlyRenewal{Percent: 50}},
+		{name: "negative duration", earlyRenewal: EarlyRenewal{Duration: -time.Second}, invalid: true},
+		{name: "negative percentage", earlyRenewal: EarlyRenewal{Percent: -1}, invalid: true},
+		{name: "whole TTL", earlyRenewal: EarlyRenewal{Percent: 100}, invalid: true},
+		{name: "both forms", earlyRenewal: EarlyRenewal{Duration: time.Minute, Percent: 10}, invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.earlyRenewal.Validate()
+			if tt.invalid && err == nil {
+				t.Fatalf("expected %+v to be rejected", tt.earlyRenewal)
+			}
+			if !tt.invalid && err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+		})
+	}
+}
+
+func TestEarlyRenewalBefore(t *testing.T) {
+	tests := []struct {
+		name         string
+		earlyRenewal EarlyRenewal
+		ttl          time.Duration
+		before       time.Duration
+	}{
+		{name: "zero", ttl: time.Hour, before: 0},
+		{name: "duration ignores the TTL", earlyRenewal: EarlyRenewal{Duration: 5 * time.Minute}, ttl: time.Hour, before: 5 * time.Minute},
+		{name: "duration longer than the TTL", earlyRenewal: EarlyRenewal{Duration: 2 * time.Hour}, ttl: time.Hour, before: 2 * time.Hour},
+		{name: "percentage of the TTL", earlyRenewal: EarlyRenewal{Percent: 25}, ttl: time.Hour, before: 15 * time.Minute},
+		{name: "fractional percentage", earlyRenewal: EarlyRenewal{Percent: 12.5}, ttl: 8 * time.Minute, before: time.Minute},
+		{name: "percentage of no TTL", earlyRenewal: EarlyRenewal{Percent: 25}, ttl: 0, before: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if before := tt.earlyRenewal.Before(tt.ttl); before != tt.before {
+				t.Fatalf("expected %v, got %v", tt.before, before)
+			}
+		})
+	}
+}
+
+func TestEarlyRenewalTextRoundTrip(t *testing.T) {
+	for _, value := range []string{"2m0s", "25%", "12.5%", "0s"} {
+		t.Run(value, func(t *testing.T) {
+			var earlyRenewal EarlyRenewal
+			if err := earlyRenewal.UnmarshalText([]byte(value)); err != nil {
+				t.Fatal(err)
+			}
+			text, err := earlyRenewal.MarshalText()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(text) != value {
+				t.Fatalf("expected %q, got %q", value, text)
+			}
+		})
+	}
+}
+
+func TestEarlyRenewalFlag(t *testing.T) {
+	var earlyRenewal EarlyRenewal
+	flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+	flagSet.Var(&earlyRenewal, "early-renewal", "")
+
+	if err := flagSet.Parse([]string{"--early-renewal", "10%"}); err != nil {
+		t.Fatal(err)
+	}
+	if earlyRenewal != (EarlyRenewal{Percent: 10}) {
+		t.Fatalf("unexpected early renewal %+v", earlyRenewal)
+	}
+
+	flagSet.SetOutput(io.Discard)
+	if err := flagSet.Parse([]string{"--early-renewal", "100%"}); err == nil {
+		t.Fatal("expected 100% to be rejected")
+	}
+	if earlyRenewal != (EarlyRenewal{Percent: 10}) {
+		t.Fatalf("a rejected value must not change the early renewal, got %+v", earlyRenewal)
+	}
+}
+
+func TestEarlyRenewalJSON(t *testing.T) {
+	conf := struct {
+		EarlyRenewal EarlyRenewal `json:"early_renewal"`
+	}{}
+	if err := json.Unmarshal([]byte(`{"early_renewal": "15%"}`), &conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.EarlyRenewal != (EarlyRenewal{Percent: 15}) {
+		t.Fatalf("unexpected early renewal %+v", conf.EarlyRenewal)
+	}
+
+	if err := json.Unmarshal([]byte(`{"early_renewal": "5m"}`), &conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.EarlyRenewal != (EarlyRenewal{Duration: 5 * time.Minute}) {
+		t.Fatalf("unexpected early renewal %+v", conf.EarlyRenewal)
+	}
+
+	if err := json.Unmarshal([]byte(`{"early_renewal": "-5m"}`), &conf); err == nil {
+		t.Fatal("expected a negative early renewal to be rejected")
+	}
+}
@@ -0,0 +1,93 @@
+package secret
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// Redacted replaces a secret wherever it is printed, marshaled or logged
+const Redacted = "[REDACTED]"
+
+// Bytes holds secret bytes such as a service account key. It redacts itself
+// when printed with fmt, marshaled to JSON or logged with zap, and Wipe zeroes
+// its memory so a dropped key does not linger on the heap.
+type Bytes struct {
+	mutex sync.RWMutex
+	data  []byte
+}
+
+// NewBytes takes ownership of data, the caller must not use data afterwards
+func NewBytes(data []byte) *Bytes {
+	return &Bytes{data: data}
+}
+
+// Len returns the length of the secret, it is 0 once wiped
+func (b *Bytes) Len() int {
+	if b == nil {
+		return 0
+	}
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return len(b.data)
+}
+
+// Copy returns a copy of the secret owned by the caller, who should Zero it
+// once done. It is nil once wiped.
+func (b *Bytes) Copy() []byte {
+	if b == nil {
+		return nil
+	}
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if len(b.data) == 0 {
+		return nil
+	}
+	return append([]byte(nil), b.data...)
+}
+
+// Wipe zeroes the secret and drops it
+func (b *Bytes) Wipe() {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	Zero(b.data)
+	b.data = nil
+}
+
+func (b *Bytes) String() string {
+	return Redacted
+}
+
+func (b *Bytes) GoString() string {
+	return Redacted
+}
+
+// Format redacts the secret for every verb, including %x and %#v
+func (b *Bytes) Format(f fmt.State, verb rune) {
+	io.WriteString(f, Redacted)
+}
+
+func (b *Bytes) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(Redacted)), nil
+}
+
+func (b *Bytes) MarshalText() ([]byte, error) {
+	return []byte(Redacted), nil
+}
+
+// Zero overwrites data with zeroes
+func Zero(data []byte) {
+	for idx := range data {
+		data[idx] = 0
+	}
+}
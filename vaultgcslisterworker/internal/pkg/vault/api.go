@@ -0,0 +1,126 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/config"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/util/errclass"
+)
+
+const (
+	certAuthLoginPath   string = "auth/cert/login"
+	leaseLookupPath     string = "sys/leases/lookup"
+	leaseRevokePath     string = "sys/leases/revoke"
+	tokenRenewSelfPath  string = "auth/token/renew-self"
+	tokenLookupSelfPath string = "auth/token/lookup-self"
+)
+
+func newUnauthenticatedAPIClient(vaultConf *config.VaultConfig, tlsConf *config.TLSConfig) (*api.Client, error) {
+	apiConfig := api.DefaultConfig()
+	apiConfig.Address = vaultConf.Address
+
+	if err := apiConfig.ConfigureTLS(&api.TLSConfig{
+		CACert:     tlsConf.CACertPath,
+		ClientCert: tlsConf.CertPath,
+		ClientKey:  tlsConf.KeyPath,
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to configure Vault TLS")
+	}
+
+	client, err := api.NewClient(apiConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create Vault API client")
+	}
+
+	// The token is only set by the login, not read from VAULT_TOKEN
+	client.ClearToken()
+	return client, nil
+}
+
+// readSecret reads the secret at path, it is nil if the path does not exist
+func readSecret(ctx context.Context, client *api.Client, path string) (*api.Secret, error) {
+	return send(ctx, client, client.NewRequest(http.MethodGet, "/v1/"+path))
+}
+
+func writeSecret(ctx context.Context, client *api.Client, path string, data map[string]interface{}) (*api.Secret, error) {
+	r := client.NewRequest(http.MethodPut, "/v1/"+path)
+	if err := r.SetJSONBody(data); err != nil {
+		return nil, err
+	}
+	return send(ctx, client, r)
+}
+
+// send does what the logical API does, but keeps the Retry-After of a rate
+// limited or sealed Vault which api.ResponseError drops
+func send(ctx context.Context, client *api.Client, r *api.Request) (*api.Secret, error) {
+	resp, err := client.RawRequestWithContext(ctx, r)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+
+	// Vault answers a read of a nonexistent path with 404
+	if resp != nil && resp.StatusCode == http.StatusNotFound && r.Method == http.MethodGet {
+		secret, parseErr := api.ParseSecret(resp.Body)
+		switch {
+		case parseErr == io.EOF:
+			return nil, nil
+		case parseErr != nil:
+			return nil, err
+		case secret != nil && (len(secret.Warnings) > 0 || len(secret.Data) > 0):
+			return secret, nil
+		default:
+			return nil, nil
+		}
+	}
+
+	// The API client takes a 429 for a standby node answering sys/health, any
+	// other request is rate limited
+	if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+		err = responseError(resp)
+	}
+
+	if err != nil {
+		if resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+			err = errclass.WithRetryAfter(err, resp.Header)
+		}
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	return api.ParseSecret(resp.Body)
+}
+
+func responseError(resp *api.Response) error {
+	var errResp api.ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil {
+		errResp.Errors = []string{"unreadable error response: " + err.Error()}
+	}
+
+	return &api.ResponseError{
+		HTTPMethod: resp.Request.Method,
+		URL:        resp.Request.URL.String(),
+		StatusCode: resp.StatusCode,
+		Errors:     errResp.Errors,
+	}
+}
+
+// RevokeLease revokes a lease issued by Vault, such as a GCP service account
+// key, so its key slot is released right away. It is revoked with the token of
+// the lease manager.
+func (vlm *VaultLeaseManager) RevokeLease(ctx context.Context, leaseID string) error {
+	if leaseID == "" {
+		return errors.New("lease ID is empty")
+	}
+
+	if err := vlm.client.RevokeLease(ctx, leaseID); err != nil {
+		return errors.Wrapf(err, "failed to revoke lease %s", leaseID)
+	}
+	return nil
+}
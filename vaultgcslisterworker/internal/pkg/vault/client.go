@@ -0,0 +1,113 @@
+package vault
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/config"
+)
+
+const (
+	ClientHashicorp string = "hashicorp"
+	ClientToolkit   string = "toolkit"
+)
+
+// VaultClient is the Vault client the lease chain reads its secrets with
+type VaultClient interface {
+	// Login authenticates with the TLS certificate auth method
+	Login(ctx context.Context) error
+	// EnsureToken renews the token, logging in again if it can not be renewed,
+	// it returns how the token was ensured
+	EnsureToken(ctx context.Context) (TokenRenewal, error)
+	// TTL returns the TTL of the token in seconds
+	TTL() int
+	// Token returns the lifecycle of the current token
+	Token() TokenInfo
+	// Get reads the secret at path, it is nil if the path does not exist
+	Get(ctx context.Context, path string) (*api.Secret, error)
+	// LookupLease returns the remaining ttl of a lease with sys/leases/lookup,
+	// it fails if Vault does not know the lease anymore
+	LookupLease(ctx context.Context, leaseID string) (*api.Secret, error)
+	// RevokeLease revokes a lease with sys/leases/revoke
+	RevokeLease(ctx context.Context, leaseID string) error
+}
+
+const (
+	// PathRenewSelf extends the current token with auth/token/renew-self
+	PathRenewSelf string = "renew_self"
+	// PathLogin replaces the token with a new login
+	PathLogin string = "login"
+	// PathToolkit lets the toolkit client decide on its own
+	PathToolkit string = "toolkit"
+)
+
+// TokenRenewal tells how EnsureToken got the current token
+type TokenRenewal struct {
+	// Path is PathRenewSelf, PathLogin or PathToolkit
+	Path string
+	// Reason tells why the token was not renewed with renew-self
+	Reason string
+}
+
+// TokenInfo is the lifecycle of the current token, looked up with
+// auth/token/lookup-self. Unknown fields are zero.
+type TokenInfo struct {
+	// Accessor identifies the token without being secret, it changes with
+	// every login
+	Accessor  string
+	Renewable bool
+	TTL       time.Duration
+	ExpiresAt time.Time
+	// CreationTTL is the TTL the token was issued with, a renewal extends it
+	// by as much
+	CreationTTL    time.Duration
+	ExplicitMaxTTL time.Duration
+	IssuedAt       time.Time
+	// MaxExpiresAt is when the token expires for good whatever its renewals,
+	// set by its explicit max TTL or by a renewal granting less than
+	// CreationTTL
+	MaxExpiresAt time.Time
+}
+
+// NearsMaxTTL reports whether a renewal would not extend the token by its
+// full CreationTTL anymore, so it is time to log in again
+func (ti TokenInfo) NearsMaxTTL(now time.Time) bool {
+	return !ti.MaxExpiresAt.IsZero() && ti.MaxExpiresAt.Sub(now) < ti.CreationTTL
+}
+
+type clientFactory func(vaultConf *config.VaultConfig, tlsConf *config.TLSConfig) (VaultClient, error)
+
+// clientFactories holds the available Vault clients by name, the toolkit
+// client is only registered when built with the toolkit tag
+var clientFactories = map[string]clientFactory{
+	ClientHashicorp: newHashicorpClient,
+}
+
+// NewVaultClient creates the Vault client named by vaultConf.Client, the
+// official hashicorp client by default. The client is not logged in yet.
+func NewVaultClient(vaultConf *config.VaultConfig, tlsConf *config.TLSConfig) (VaultClient, error) {
+	name := vaultConf.Client
+	if name == "" {
+		name = ClientHashicorp
+	}
+
+	factory, ok := clientFactories[name]
+	if !ok {
+		return nil, errors.Errorf("unknown Vault client %q, this build supports %v", name, ClientNames())
+	}
+	return factory(vaultConf, tlsConf)
+}
+
+// ClientNames returns the names of the Vault clients of this build
+func ClientNames() []string {
+	names := make([]string, 0, len(clientFactories))
+	for name := range clientFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -5,13 +5,23 @@ import (
 	"sync"
 	"time"
 
-	"github.com/cermati/devops-toolkit/common-libs/toolkit-go/pkg/log"
-
-	leaseUtil "github.com/mikeadityas/vault-gcs-lister/internal/pkg/util/lease"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/health"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/history"
+	leaseMgr "github.com/mikeadityas/vault-gcs-lister/internal/pkg/leasemanager"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/log"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/schedule"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/tracing"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/util/errclass"
 )
 
 const (
 	maxBackoff time.Duration = 64 * time.Second
+
+	// component is the ID of the Vault token in the health checks and the
+	// event history
+	component = "vault"
 )
 
 // Daemon is the interface for Vault daemon which renews the Vault token
@@ -23,10 +33,17 @@ type Daemon interface {
 type daemon struct {
 	vaultLeaseMgr         *VaultLeaseManager
 	refreshPeriodInSecond time.Duration
+	policy                schedule.Policy
 	ctx                   context.Context
 	ctxCancelFunc         context.CancelFunc
 	waitGroup             sync.WaitGroup
 	ticker                *time.Ticker
+	status                *health.Status
+	schedules             *schedule.Registry
+	events                *history.Buffer
+	tokenExpiresAt        time.Time
+	tokenRevoked          bool
+	childrenWarned        bool
 	numRetry              int
 	stopCh                chan bool
 }
@@ -40,8 +57,11 @@ func (d *daemon) Start() error {
 				d.stopCh <- true
 				return
 			case <-d.ticker.C:
-				d.vaultLeaseMgr.NotifyAllStaleLease()
-				d.ensureToken()
+				d.ensureToken("schedule")
+			case <-d.vaultLeaseMgr.renewCh:
+				log.Logger.Sugar().Warn("Vault daemon received renewal request")
+				d.events.Record(component, history.ForceNew, "Vault token renewal requested")
+				d.ensureToken("request")
 			}
 		}
 	}()
@@ -58,27 +78,73 @@ func (d *daemon) Stop() error {
 	return nil
 }
 
-func (d *daemon) ensureToken() {
+// ensureToken renews the Vault token, trigger names what asked for it in the
+// trace. The children are only notified of a new token, or once the token
+// they were warned about is fine again.
+func (d *daemon) ensureToken(trigger string) {
 	d.waitGroup.Add(1)
 	defer d.waitGroup.Done()
 
+	ctx, span := tracing.Start(d.ctx, "vault.ensure_token", attribute.String("trigger", trigger))
+	var err error
+	defer func() { tracing.End(span, err) }()
+
+	previous := d.vaultLeaseMgr.client.Token()
+
 	log.Logger.Sugar().Info("Ensuring Vault token...")
-	if err := d.vaultLeaseMgr.client.EnsureToken(); err != nil {
-		if d.numRetry == 0 {
-			d.vaultLeaseMgr.NotifyAllStaleLease()
+	var renewal TokenRenewal
+	if renewal, err = d.vaultLeaseMgr.client.EnsureToken(ctx); err != nil {
+		if d.numRetry == 0 && !d.tokenRevoked {
+			d.childrenWarned = true
+			d.vaultLeaseMgr.Publish(leaseMgr.ExpiringEvent{Cause: leaseMgr.CauseFrom(ctx), ExpiresAt: d.tokenExpiresAt})
+		}
+
+		// The child leases stay valid until the token they belong to expires
+		if !d.tokenRevoked && time.Now().After(d.tokenExpiresAt) {
+			d.tokenRevoked = true
+			d.childrenWarned = true
+			d.vaultLeaseMgr.Publish(leaseMgr.RevokedEvent{
+				Cause:  leaseMgr.CauseFrom(ctx),
+				Reason: "Vault token expired: " + err.Error(),
+			})
+			d.events.Record(component, history.Revoked, "Vault token expired", "err", err)
 		}
 
-		d.refreshPeriodInSecond = leaseUtil.CalculateBackoffTime(d.numRetry, maxBackoff)
+		errClass, retryAfter := errclass.Classify(err)
+		if errClass.IsPermanent() {
+			d.status.SetFailed(string(errClass), err, d.numRetry)
+		} else {
+			d.status.SetRetrying(string(errClass), err, d.numRetry)
+		}
 
 		if d.ticker != nil {
 			d.ticker.Stop()
 		}
 
+		// Every lease hangs off the token, giving up on it would stop them all
+		retryPeriod, retry := errClass.RetryDelay(retryAfter, d.numRetry, maxBackoff)
+		if !retry {
+			retryPeriod = errclass.PermanentRetryInterval
+		}
+
+		d.refreshPeriodInSecond = retryPeriod
 		d.ticker = time.NewTicker(d.refreshPeriodInSecond)
+		d.status.SetNextRun(time.Now().Add(d.refreshPeriodInSecond))
+		d.events.Record(
+			component,
+			history.BackoffScheduled,
+			"Failed to ensure Vault token",
+			"err", err,
+			"err.class", errClass,
+			"retry.num", d.numRetry,
+			"retry.interval", d.refreshPeriodInSecond,
+		)
 
 		log.Logger.Sugar().Errorw(
 			"Failed to ensure Vault token.",
 			"err", err,
+			"err.class", errClass,
+			"vault.token_path", renewal.Path,
 			"retry.num", d.numRetry,
 			"retry.interval", d.refreshPeriodInSecond,
 			"retry.next", time.Now().Add(d.refreshPeriodInSecond).Format(time.RFC3339),
@@ -88,19 +154,62 @@ func (d *daemon) ensureToken() {
 		return
 	}
 
-	d.vaultLeaseMgr.NotifyAllNewLease()
+	d.status.SetHealthy()
+
+	token := d.vaultLeaseMgr.client.Token()
+	// A client that failed to look up its accessor always reports a new token
+	tokenChanged := token.Accessor == "" || token.Accessor != previous.Accessor
+	span.SetAttributes(
+		attribute.String("vault.token_path", renewal.Path),
+		attribute.Bool("vault.token_changed", tokenChanged),
+	)
 
 	d.numRetry = 0
-	d.refreshPeriodInSecond = time.Duration(d.vaultLeaseMgr.client.TTL()) * time.Second
+	d.tokenRevoked = false
+	ttl := token.TTL
+	d.tokenExpiresAt = time.Now().Add(ttl)
+	d.vaultLeaseMgr.setTokenExpiresAt(d.tokenExpiresAt)
+
+	if tokenChanged || d.childrenWarned {
+		d.childrenWarned = false
+		d.vaultLeaseMgr.Publish(leaseMgr.NewLeaseEvent{Cause: leaseMgr.CauseFrom(ctx), TTL: ttl})
+	}
+	d.events.Record(
+		component,
+		history.TokenRenewed,
+		"Vault token renewed",
+		"ttl", ttl,
+		"path", renewal.Path,
+		"reason", renewal.Reason,
+		"token_changed", tokenChanged,
+	)
 
 	if d.ticker != nil {
 		d.ticker.Stop()
 	}
 
+	d.refreshPeriodInSecond = d.schedules.Plan(component, ttl, d.policy)
 	d.ticker = time.NewTicker(d.refreshPeriodInSecond)
-
-	log.Logger.Sugar().Info("Vault token renewed!")
+	d.status.SetNextRun(time.Now().Add(d.refreshPeriodInSecond))
+
+	log.Logger.Sugar().Infow(
+		"Vault token renewed!",
+		"vault.token_path", renewal.Path,
+		"vault.token_path_reason", renewal.Reason,
+		"vault.token_changed", tokenChanged,
+		"vault.token_accessor", token.Accessor,
+		"vault.token_renewable", token.Renewable,
+		"vault.token_max_expires_at", formatTime(token.MaxExpiresAt),
+	)
 
 	vaultRenewTime := time.Now().Add(d.refreshPeriodInSecond)
 	log.Logger.Sugar().Infow("Next Vault token renew", "renew_time", vaultRenewTime.Format(time.RFC3339))
 }
+
+// formatTime formats t as RFC3339, it is empty for the zero time
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,268 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/config"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/log"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/tracing"
+)
+
+// hashicorpClient is a VaultClient on the official Vault API client
+type hashicorpClient struct {
+	client   *api.Client
+	roleName string
+
+	mutex sync.RWMutex
+	token TokenInfo
+}
+
+func newHashicorpClient(vaultConf *config.VaultConfig, tlsConf *config.TLSConfig) (VaultClient, error) {
+	client, err := newUnauthenticatedAPIClient(vaultConf, tlsConf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hashicorpClient{
+		client:   client,
+		roleName: vaultConf.RoleName,
+	}, nil
+}
+
+func (hc *hashicorpClient) Login(ctx context.Context) (err error) {
+	ctx, span := tracing.Start(ctx, "vault.login", attribute.String("vault.role", hc.roleName))
+	defer func() { tracing.End(span, err) }()
+
+	// The login must not send the token it replaces, which may be expired
+	loginClient, err := hc.client.Clone()
+	if err != nil {
+		return errors.Wrap(err, "failed to clone Vault API client")
+	}
+	loginClient.ClearToken()
+
+	secret, err := certLogin(ctx, loginClient, hc.roleName)
+	if err != nil {
+		return err
+	}
+
+	hc.setAuth(secret.Auth)
+	hc.lookupSelf(ctx)
+	return nil
+}
+
+// EnsureToken renews the token with renew-self while it is renewable and a
+// renewal still extends it by its full creation TTL, it logs in again
+// otherwise or if the renewal fails
+func (hc *hashicorpClient) EnsureToken(ctx context.Context) (TokenRenewal, error) {
+	token := hc.Token()
+
+	var reason string
+	switch {
+	case !token.Renewable:
+		reason = "the token is not renewable"
+	case token.NearsMaxTTL(time.Now()):
+		reason = "the token nears its max TTL at " + token.MaxExpiresAt.Format(time.RFC3339)
+	default:
+		err := hc.renewSelf(ctx)
+		if err == nil {
+			return TokenRenewal{Path: PathRenewSelf}, nil
+		}
+		reason = "renew-self failed: " + err.Error()
+	}
+
+	return TokenRenewal{Path: PathLogin, Reason: reason}, hc.Login(ctx)
+}
+
+// renewSelf renews the current token, the caller logs in again on error
+func (hc *hashicorpClient) renewSelf(ctx context.Context) (err error) {
+	ctx, span := tracing.Start(ctx, "vault.renew_self")
+	defer func() { tracing.End(span, err) }()
+
+	secret, err := writeSecret(ctx, hc.client, tokenRenewSelfPath, map[string]interface{}{
+		"increment": 0,
+	})
+	if err != nil {
+		return err
+	}
+	if secret == nil || secret.Auth == nil {
+		return errors.New("Vault token renewal returns no auth info")
+	}
+
+	hc.setAuth(secret.Auth)
+	hc.lookupSelf(ctx)
+	return nil
+}
+
+// lookupSelf completes the lifecycle of the current token with
+// auth/token/lookup-self. A failure is only logged, the token itself works.
+func (hc *hashicorpClient) lookupSelf(ctx context.Context) {
+	var err error
+	ctx, span := tracing.Start(ctx, "vault.lookup_self")
+	defer func() { tracing.End(span, err) }()
+
+	secret, err := readSecret(ctx, hc.client, tokenLookupSelfPath)
+	if err == nil && (secret == nil || secret.Data == nil) {
+		err = errors.New("Vault token lookup returns no data")
+	}
+	if err == nil {
+		err = hc.setLookup(secret.Data)
+	}
+	if err != nil {
+		log.Logger.Sugar().Warnw("Failed to look up the Vault token, its max TTL is unknown", "err", err)
+	}
+}
+
+func (hc *hashicorpClient) TTL() int {
+	hc.mutex.RLock()
+	defer hc.mutex.RUnlock()
+
+	return int(hc.token.TTL / time.Second)
+}
+
+func (hc *hashicorpClient) Token() TokenInfo {
+	hc.mutex.RLock()
+	defer hc.mutex.RUnlock()
+
+	return hc.token
+}
+
+func (hc *hashicorpClient) Get(ctx context.Context, path string) (secret *api.Secret, err error) {
+	ctx, span := tracing.Start(ctx, "vault.read", attribute.String("vault.path", path))
+	defer func() { tracing.End(span, err) }()
+
+	return readSecret(ctx, hc.client, path)
+}
+
+func (hc *hashicorpClient) LookupLease(ctx context.Context, leaseID string) (secret *api.Secret, err error) {
+	ctx, span := tracing.Start(ctx, "vault.lookup_lease")
+	defer func() { tracing.End(span, err) }()
+
+	secret, err = writeSecret(ctx, hc.client, leaseLookupPath, map[string]interface{}{
+		"lease_id": leaseID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, errors.New("Vault lease lookup returns no lease")
+	}
+	return secret, nil
+}
+
+func (hc *hashicorpClient) RevokeLease(ctx context.Context, leaseID string) (err error) {
+	ctx, span := tracing.Start(ctx, "vault.revoke_lease")
+	defer func() { tracing.End(span, err) }()
+
+	_, err = writeSecret(ctx, hc.client, leaseRevokePath, map[string]interface{}{
+		"lease_id": leaseID,
+	})
+	return err
+}
+
+// setAuth switches to the token of auth, the lifecycle of a new token starts
+// over
+func (hc *hashicorpClient) setAuth(auth *api.SecretAuth) {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	hc.client.SetToken(auth.ClientToken)
+	if auth.Accessor == "" || auth.Accessor != hc.token.Accessor {
+		hc.token = TokenInfo{Accessor: auth.Accessor}
+	}
+	hc.token.Renewable = auth.Renewable
+	hc.token.TTL = time.Duration(auth.LeaseDuration) * time.Second
+	hc.token.ExpiresAt = time.Now().Add(hc.token.TTL)
+
+	// A renewal granting less than the creation TTL is capped by a max TTL,
+	// the token expires for good then
+	if hc.token.CreationTTL > 0 && hc.token.TTL < hc.token.CreationTTL {
+		if hc.token.MaxExpiresAt.IsZero() || hc.token.ExpiresAt.Before(hc.token.MaxExpiresAt) {
+			hc.token.MaxExpiresAt = hc.token.ExpiresAt
+		}
+	}
+}
+
+// setLookup records the lifecycle of the token from the data of
+// auth/token/lookup-self
+func (hc *hashicorpClient) setLookup(data map[string]interface{}) error {
+	creationTTL, err := durationField(data, "creation_ttl")
+	if err != nil {
+		return err
+	}
+	explicitMaxTTL, err := durationField(data, "explicit_max_ttl")
+	if err != nil {
+		return err
+	}
+
+	var issuedAt time.Time
+	if issueTime, ok := data["issue_time"].(string); ok && issueTime != "" {
+		if issuedAt, err = time.Parse(time.RFC3339Nano, issueTime); err != nil {
+			return errors.Wrap(err, "invalid issue_time")
+		}
+	}
+
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	if accessor, _ := data["accessor"].(string); accessor != "" && accessor != hc.token.Accessor {
+		return errors.New("the looked up token is not the current token")
+	}
+	hc.token.CreationTTL = creationTTL
+	hc.token.ExplicitMaxTTL = explicitMaxTTL
+	hc.token.IssuedAt = issuedAt
+	if explicitMaxTTL > 0 && !issuedAt.IsZero() {
+		hc.token.MaxExpiresAt = issuedAt.Add(explicitMaxTTL)
+	}
+	return nil
+}
+
+// durationField reads a duration in seconds, Vault returns it as a number or
+// a string depending on the endpoint
+func durationField(data map[string]interface{}, key string) (time.Duration, error) {
+	switch value := data[key].(type) {
+	case nil:
+		return 0, nil
+	case json.Number:
+		seconds, err := value.Int64()
+		if err != nil {
+			return 0, errors.Wrapf(err, "invalid %s", key)
+		}
+		return time.Duration(seconds) * time.Second, nil
+	case float64:
+		return time.Duration(value) * time.Second, nil
+	case string:
+		if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return time.Duration(seconds) * time.Second, nil
+		}
+		duration, err := time.ParseDuration(value)
+		return duration, errors.Wrapf(err, "invalid %s", key)
+	default:
+		return 0, errors.Errorf("invalid %s %v", key, value)
+	}
+}
+
+// certLogin logs in with the TLS certificate auth method, the returned secret
+// always has auth info
+func certLogin(ctx context.Context, client *api.Client, roleName string) (*api.Secret, error) {
+	secret, err := writeSecret(ctx, client, certAuthLoginPath, map[string]interface{}{
+		"name": roleName,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to login to Vault")
+	}
+
+	if secret == nil || secret.Auth == nil {
+		return nil, errors.New("Vault login returns no auth info")
+	}
+	return secret, nil
+}
+
+var _ VaultClient = (*hashicorpClient)(nil)
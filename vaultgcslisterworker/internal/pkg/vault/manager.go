@@ -7,94 +7,147 @@ import (
 
 	"github.com/pkg/errors"
 
-	"github.com/cermati/devops-toolkit/common-libs/toolkit-go/pkg/csvault"
-	"github.com/cermati/devops-toolkit/common-libs/toolkit-go/pkg/cvault"
 	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/config"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/health"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/history"
 	leaseMgr "github.com/mikeadityas/vault-gcs-lister/internal/pkg/leasemanager"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/log"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/schedule"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/util/errclass"
 )
 
-var instance *VaultLeaseManager
-
 type VaultLeaseManager struct {
-	childLeases []leaseMgr.Observer
+	bus *leaseMgr.Bus
 
-	client cvault.CVault
-}
+	client VaultClient
 
-func (vlm *VaultLeaseManager) Register(childLease leaseMgr.Observer) {
-	vlm.childLeases = append(vlm.childLeases, childLease)
+	renewCh        chan struct{}
+	mutex          sync.RWMutex
+	tokenExpiresAt time.Time
 }
 
-func (vlm *VaultLeaseManager) Deregister(childLease leaseMgr.Observer) {
-	vlm.childLeases = leaseMgr.RemoveObserver(vlm.childLeases, childLease)
+// RequestRenewal asks the daemon to renew the Vault token now
+func (vlm *VaultLeaseManager) RequestRenewal() {
+	select {
+	case vlm.renewCh <- struct{}{}:
+	default:
+	}
 }
 
-func (vlm *VaultLeaseManager) NotifyAllNewLease() {
-	for _, childLease := range vlm.childLeases {
-		childLease.NotifyNewLease()
+// TokenRejected reports whether err is Vault denying the token itself. Vault
+// answers 403 permission denied both for a denying policy and for an expired
+// or revoked token, the latter is told apart by the expiry of the token or by
+// a lookup-self denied as well.
+func (vlm *VaultLeaseManager) TokenRejected(ctx context.Context, err error) bool {
+	errClass, _ := errclass.Classify(err)
+	if errClass != errclass.PermissionDenied {
+		return errClass == errclass.AuthExpired
+	}
+
+	if expiresAt := vlm.GetTokenExpiresAt(); !expiresAt.IsZero() && time.Now().After(expiresAt) {
+		return true
 	}
-}
 
-func (vlm *VaultLeaseManager) NotifyAllStaleLease() {
-	for _, childLease := range vlm.childLeases {
-		childLease.NotifyStaleLease()
+	_, lookupErr := vlm.client.Get(ctx, tokenLookupSelfPath)
+	if lookupErr == nil {
+		return false
 	}
+	lookupClass, _ := errclass.Classify(lookupErr)
+	return lookupClass == errclass.PermissionDenied || lookupClass == errclass.AuthExpired
+}
+
+// GetTokenExpiresAt returns when the current Vault token expires
+func (vlm *VaultLeaseManager) GetTokenExpiresAt() time.Time {
+	vlm.mutex.RLock()
+	defer vlm.mutex.RUnlock()
+
+	return vlm.tokenExpiresAt
+}
+
+func (vlm *VaultLeaseManager) setTokenExpiresAt(tokenExpiresAt time.Time) {
+	vlm.mutex.Lock()
+	defer vlm.mutex.Unlock()
+
+	vlm.tokenExpiresAt = tokenExpiresAt
+}
+
+func (vlm *VaultLeaseManager) Register(childLease leaseMgr.Observer) {
+	childLease.Follow(vlm.bus.Subscribe(childLease.GetID()))
 }
 
-func (vlm *VaultLeaseManager) Client() cvault.CVault {
+func (vlm *VaultLeaseManager) Deregister(childLease leaseMgr.Observer) {
+	vlm.bus.Unsubscribe(childLease.GetID())
+}
+
+func (vlm *VaultLeaseManager) Publish(event leaseMgr.Event) {
+	vlm.bus.Publish(event)
+}
+
+func (vlm *VaultLeaseManager) Client() VaultClient {
 	return vlm.client
 }
 
 func (vlm *VaultLeaseManager) Daemonize(
 	ctx context.Context,
 	ctxCancelFunc context.CancelFunc,
-	refreshPeriodInSecond time.Duration,
+	ttl time.Duration,
+	policy schedule.Policy,
+	registry *health.Registry,
+	schedules *schedule.Registry,
+	events *history.Buffer,
 ) Daemon {
+	tokenExpiresAt := time.Now().Add(ttl)
+	vlm.setTokenExpiresAt(tokenExpiresAt)
+
+	refreshPeriodInSecond := schedules.Plan(component, ttl, policy)
 	tick := time.NewTicker(refreshPeriodInSecond)
 
+	status := newHealthyStatus(registry)
+	status.SetNextRun(time.Now().Add(refreshPeriodInSecond))
+
+	vaultRenewTime := time.Now().Add(refreshPeriodInSecond)
+	log.Logger.Sugar().Infow("Next Vault token renew", "renew_time", vaultRenewTime.Format(time.RFC3339))
+
 	return &daemon{
 		vaultLeaseMgr:         vlm,
 		refreshPeriodInSecond: refreshPeriodInSecond,
+		policy:                policy,
 		ctx:                   ctx,
 		ctxCancelFunc:         ctxCancelFunc,
 		waitGroup:             sync.WaitGroup{},
 		ticker:                tick,
+		status:                status,
+		schedules:             schedules,
+		events:                events,
+		tokenExpiresAt:        tokenExpiresAt,
 		numRetry:              0,
 		stopCh:                make(chan bool),
 	}
 }
 
-func NewVaultLeaseManager(vaultConf *config.VaultConfig, tlsConf *config.TLSConfig) error {
-	vaultConfig, err := cvault.GenVaultConfig(
-		vaultConf.Address,
-		true,
-		tlsConf.CACertPath,
-		tlsConf.CertPath,
-		tlsConf.KeyPath,
-	)
-	if err != nil {
-		return errors.Wrap(err, "failed to generate Vault config")
-	}
+// newHealthyStatus registers the Vault daemon status, healthy since the
+// manager only exists after a successful login
+func newHealthyStatus(registry *health.Registry) *health.Status {
+	status := registry.Register(component)
+	status.SetHealthy()
+	return status
+}
 
-	client, err := csvault.NewCSVault(vaultConfig, vaultConf.RoleName)
+// NewVaultLeaseManager logs in to Vault, every manager has its own client and
+// token
+func NewVaultLeaseManager(ctx context.Context, vaultConf *config.VaultConfig, tlsConf *config.TLSConfig) (*VaultLeaseManager, error) {
+	client, err := NewVaultClient(vaultConf, tlsConf)
 	if err != nil {
-		return errors.Wrap(err, "failed to initialize Vault client")
-	}
-
-	if err := client.EnsureToken(); err != nil {
-		return errors.Wrap(err, "failed to ensure Vault token")
+		return nil, errors.Wrap(err, "failed to initialize Vault client")
 	}
 
-	instance = &VaultLeaseManager{
-		client: client,
+	if err := client.Login(ctx); err != nil {
+		return nil, errors.Wrap(err, "failed to ensure Vault token")
 	}
 
-	return nil
-}
-
-func GetInstance() *VaultLeaseManager {
-	if instance == nil {
-		panic("The Vault lease manager instance hasn't been initialized")
-	}
-	return instance
+	return &VaultLeaseManager{
+		bus:     leaseMgr.NewBus(),
+		client:  client,
+		renewCh: make(chan struct{}, 1),
+	}, nil
 }
@@ -0,0 +1,168 @@
+//go:build toolkit
+// +build toolkit
+
+package vault
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cermati/devops-toolkit/common-libs/toolkit-go/pkg/csvault"
+	"github.com/cermati/devops-toolkit/common-libs/toolkit-go/pkg/cvault"
+	"github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/config"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/log"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/tracing"
+)
+
+func init() {
+	clientFactories[ClientToolkit] = newToolkitClient
+}
+
+// toolkitClient adapts the cermati devops-toolkit Vault client to VaultClient
+type toolkitClient struct {
+	vaultConfig *api.Config
+	roleName    string
+
+	// mutex guards the client, replaced by every login, and its accessor
+	mutex    sync.RWMutex
+	client   cvault.CVault
+	accessor string
+}
+
+func newToolkitClient(vaultConf *config.VaultConfig, tlsConf *config.TLSConfig) (VaultClient, error) {
+	vaultConfig, err := cvault.GenVaultConfig(
+		vaultConf.Address,
+		true,
+		tlsConf.CACertPath,
+		tlsConf.CertPath,
+		tlsConf.KeyPath,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate Vault config")
+	}
+
+	return &toolkitClient{
+		vaultConfig: vaultConfig,
+		roleName:    vaultConf.RoleName,
+	}, nil
+}
+
+func (tc *toolkitClient) Login(ctx context.Context) (err error) {
+	_, span := tracing.Start(ctx, "vault.login", attribute.String("vault.role", tc.roleName))
+	defer func() { tracing.End(span, err) }()
+
+	client, err := csvault.NewCSVault(tc.vaultConfig, tc.roleName)
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize Vault client")
+	}
+
+	if err := client.EnsureToken(); err != nil {
+		return err
+	}
+
+	tc.mutex.Lock()
+	tc.client = client
+	tc.mutex.Unlock()
+
+	tc.lookupAccessor(client)
+	return nil
+}
+
+func (tc *toolkitClient) EnsureToken(ctx context.Context) (_ TokenRenewal, err error) {
+	client := tc.getClient()
+	if client == nil {
+		return TokenRenewal{Path: PathLogin, Reason: "not logged in"}, tc.Login(ctx)
+	}
+
+	// The toolkit client decides on its own whether to renew or log in again
+	_, span := tracing.Start(ctx, "vault.ensure_token")
+	defer func() { tracing.End(span, err) }()
+
+	if err := client.EnsureToken(); err != nil {
+		return TokenRenewal{Path: PathToolkit}, err
+	}
+	tc.lookupAccessor(client)
+	return TokenRenewal{Path: PathToolkit}, nil
+}
+
+// lookupAccessor records the accessor of the token the toolkit client ended up
+// with, which tells a renewal from a new login. A failure is only logged, the
+// token is then taken as a new one.
+func (tc *toolkitClient) lookupAccessor(client cvault.CVault) {
+	var accessor string
+	secret, err := client.Get(tokenLookupSelfPath)
+	if err == nil && (secret == nil || secret.Data == nil) {
+		err = errors.New("Vault token lookup returns no data")
+	}
+	if err == nil {
+		if accessor, _ = secret.Data["accessor"].(string); accessor == "" {
+			err = errors.New("Vault token lookup returns no accessor")
+		}
+	}
+	if err != nil {
+		log.Logger.Sugar().Warnw("Failed to look up the Vault token accessor", "err", err)
+	}
+
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	tc.accessor = accessor
+}
+
+func (tc *toolkitClient) getClient() cvault.CVault {
+	tc.mutex.RLock()
+	defer tc.mutex.RUnlock()
+
+	return tc.client
+}
+
+func (tc *toolkitClient) TTL() int {
+	client := tc.getClient()
+	if client == nil {
+		return 0
+	}
+	return client.TTL()
+}
+
+// Token only knows the accessor and the TTL, the toolkit client does not
+// expose the rest of its token
+func (tc *toolkitClient) Token() TokenInfo {
+	tc.mutex.RLock()
+	accessor := tc.accessor
+	tc.mutex.RUnlock()
+
+	ttl := time.Duration(tc.TTL()) * time.Second
+	return TokenInfo{
+		Accessor:  accessor,
+		TTL:       ttl,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+}
+
+func (tc *toolkitClient) Get(ctx context.Context, path string) (secret *api.Secret, err error) {
+	_, span := tracing.Start(ctx, "vault.read", attribute.String("vault.path", path))
+	defer func() { tracing.End(span, err) }()
+
+	client := tc.getClient()
+	if client == nil {
+		return nil, errors.New("Vault client is not logged in")
+	}
+	return client.Get(path)
+}
+
+// LookupLease is not supported, the toolkit client only reads secrets
+func (tc *toolkitClient) LookupLease(ctx context.Context, leaseID string) (*api.Secret, error) {
+	return nil, errors.New("the toolkit Vault client can not look up leases")
+}
+
+// RevokeLease is not supported, the toolkit client only reads secrets
+func (tc *toolkitClient) RevokeLease(ctx context.Context, leaseID string) error {
+	return errors.New("the toolkit Vault client can not revoke leases")
+}
+
+var _ VaultClient = (*toolkitClient)(nil)
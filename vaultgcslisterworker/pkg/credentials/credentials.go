@@ -0,0 +1,165 @@
+// Package credentials exposes the service account key leased from the Vault
+// GCP secrets engine to Google API clients.
+//
+// The token source always reflects the current key of its KeySource. While
+// there is no valid key, e.g. during the first fetch or after the key expired
+// and its renewal is in progress, Token blocks up to the wait duration before
+// returning a *NoCredentialsError.
+//
+// Example:
+//
+//	client, err := storage.NewClient(
+//		ctx,
+//		credentials.ClientOption(keySource, credentials.WithScopes(storage.ScopeReadOnly)),
+//	)
+//	if err != nil {
+//		return err
+//	}
+//	defer client.Close()
+//
+//	// Every request is authorized with the key current at the time
+//	bucketIter := client.Buckets(ctx, projectID)
+package credentials
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/util/secret"
+)
+
+const (
+	defaultScope = "https://www.googleapis.com/auth/cloud-platform"
+	defaultWait  = 5 * time.Second
+)
+
+// KeySource is the source of the leased service account key
+type KeySource interface {
+	// CurrentKey returns the JSON of the current service account key, its
+	// private key ID and when its lease expires, zero for a lease without TTL.
+	// The key is empty if there is no valid key.
+	CurrentKey() (key []byte, keyID string, expiresAt time.Time)
+	// WaitKey blocks until there is a valid key or ctx is done
+	WaitKey(ctx context.Context) error
+}
+
+// NoCredentialsError is returned when the key source has no valid key after
+// waiting for it
+type NoCredentialsError struct {
+	Waited time.Duration
+}
+
+func (e *NoCredentialsError) Error() string {
+	return fmt.Sprintf("no valid GCP service account key after waiting %s", e.Waited)
+}
+
+// Option configures the token source
+type Option func(*tokenSource)
+
+// WithScopes sets the OAuth2 scopes of the access tokens, cloud-platform by
+// default
+func WithScopes(scopes ...string) Option {
+	return func(ts *tokenSource) {
+		ts.scopes = scopes
+	}
+}
+
+// WithWait sets how long Token waits for a valid key, 5s by default
+func WithWait(wait time.Duration) Option {
+	return func(ts *tokenSource) {
+		ts.wait = wait
+	}
+}
+
+type tokenSource struct {
+	keySource KeySource
+	scopes    []string
+	wait      time.Duration
+
+	mutex     sync.Mutex
+	keyID     string
+	jwtSource oauth2.TokenSource
+}
+
+// TokenSource returns a token source minting access tokens from the current
+// key of keySource
+func TokenSource(keySource KeySource, opts ...Option) oauth2.TokenSource {
+	ts := &tokenSource{
+		keySource: keySource,
+		scopes:    []string{defaultScope},
+		wait:      defaultWait,
+	}
+	for _, opt := range opts {
+		opt(ts)
+	}
+	return ts
+}
+
+// ClientOption returns a client option authorizing Google API clients with
+// TokenSource
+func ClientOption(keySource KeySource, opts ...Option) option.ClientOption {
+	return option.WithTokenSource(TokenSource(keySource, opts...))
+}
+
+func (ts *tokenSource) Token() (*oauth2.Token, error) {
+	key, keyID, expiresAt, err := ts.waitForKey()
+	if err != nil {
+		return nil, err
+	}
+	// The JWT config keeps its own parsed key, the copy is only needed here
+	defer secret.Zero(key)
+
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	if ts.jwtSource == nil || keyID != ts.keyID {
+		jwtConfig, err := google.JWTConfigFromJSON(key, ts.scopes...)
+		if err != nil {
+			return nil, err
+		}
+		ts.keyID = keyID
+		ts.jwtSource = jwtConfig.TokenSource(context.Background())
+	}
+
+	token, err := ts.jwtSource.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	// An access token must not outlive the key it was minted from
+	if !expiresAt.IsZero() && (token.Expiry.IsZero() || expiresAt.Before(token.Expiry)) {
+		capped := *token
+		capped.Expiry = expiresAt
+		return &capped, nil
+	}
+	return token, nil
+}
+
+func (ts *tokenSource) waitForKey() ([]byte, string, time.Time, error) {
+	key, keyID, expiresAt := ts.keySource.CurrentKey()
+	if len(key) > 0 {
+		return key, keyID, expiresAt, nil
+	}
+
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), ts.wait)
+	defer cancel()
+
+	for {
+		if err := ts.keySource.WaitKey(ctx); err != nil {
+			return nil, "", time.Time{}, &NoCredentialsError{Waited: time.Since(started)}
+		}
+
+		// The key may have expired again since
+		key, keyID, expiresAt = ts.keySource.CurrentKey()
+		if len(key) > 0 {
+			return key, keyID, expiresAt, nil
+		}
+	}
+}
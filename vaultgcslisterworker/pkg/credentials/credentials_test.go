@@ -0,0 +1,283 @@
+package credentials_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/gcp"
+	leaseMgr "github.com/mikeadityas/vault-gcs-lister/internal/pkg/leasemanager"
+	"github.com/mikeadityas/vault-gcs-lister/pkg/credentials"
+)
+
+const (
+	secretsPath   = "gcp/key/infra"
+	leaseDuration = 10 * time.Minute
+)
+
+var (
+	privateKeyOnce sync.Once
+	privateKeyPEM  string
+)
+
+func testPrivateKey() string {
+	privateKeyOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			panic(err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			panic(err)
+		}
+		privateKeyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	})
+	return privateKeyPEM
+}
+
+// newOAuthServer exchanges the signed JWT of a service account key for an
+// access token named after the key ID, token-<key ID>
+func newOAuthServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertion := strings.Split(r.FormValue("assertion"), ".")
+		header, err := base64.RawURLEncoding.DecodeString(assertion[0])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		jwtHeader := struct {
+			KeyID string `json:"kid"`
+		}{}
+		if err := json.Unmarshal(header, &jwtHeader); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "token-" + jwtHeader.KeyID,
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	}))
+}
+
+// fakeVault serves the keys of the GCP secrets engine at secretsPath, each
+// read leases the key of the current key ID
+type fakeVault struct {
+	*httptest.Server
+	tokenURI string
+
+	mutex sync.Mutex
+	keyID string
+	reads int
+}
+
+func newFakeVault(tokenURI string) *fakeVault {
+	fv := &fakeVault{tokenURI: tokenURI, keyID: "key-1"}
+	fv.Server = httptest.NewServer(http.HandlerFunc(fv.serve))
+	return fv
+}
+
+func (fv *fakeVault) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/"+secretsPath {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string][]string{"errors": {}})
+		return
+	}
+
+	fv.mutex.Lock()
+	keyID := fv.keyID
+	fv.reads++
+	fv.mutex.Unlock()
+
+	keyJSON, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "infra",
+		"private_key_id": keyID,
+		"private_key":    testPrivateKey(),
+		"client_email":   "lister@infra.iam.gserviceaccount.com",
+		"client_id":      "1234",
+		"token_uri":      fv.tokenURI,
+	})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"lease_id":       secretsPath + "/" + keyID,
+		"lease_duration": int(leaseDuration / time.Second),
+		"renewable":      true,
+		"data": map[string]interface{}{
+			"private_key_data": base64.StdEncoding.EncodeToString(keyJSON),
+		},
+	})
+}
+
+func (fv *fakeVault) rotate(keyID string) {
+	fv.mutex.Lock()
+	defer fv.mutex.Unlock()
+
+	fv.keyID = keyID
+}
+
+// keySource returns a key source leasing its keys from the fake Vault, it has
+// no key until its first GetNewLease
+func (fv *fakeVault) keySource() *gcp.GCPLeaseManager {
+	config := api.DefaultConfig()
+	config.Address = fv.URL
+	client, err := api.NewClient(config)
+	if err != nil {
+		panic(err)
+	}
+	return gcp.NewGCPLeaseManager("infra", secretsPath, gcp.KeyExpectation{}, vaultReader{client: client})
+}
+
+// vaultReader reads the secrets with the official Vault API client
+type vaultReader struct {
+	client *api.Client
+}
+
+func (vr vaultReader) Get(ctx context.Context, path string) (*api.Secret, error) {
+	return vr.client.Logical().Read(path)
+}
+
+func (vr vaultReader) LookupLease(ctx context.Context, leaseID string) (*api.Secret, error) {
+	return vr.client.Logical().Write("sys/leases/lookup", map[string]interface{}{"lease_id": leaseID})
+}
+
+// fetchKey leases a new key like the lease chain does, announcing it to the
+// waiting token sources
+func fetchKey(t *testing.T, keys *gcp.GCPLeaseManager) {
+	t.Helper()
+
+	if err := keys.GetNewLease(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	keys.Publish(leaseMgr.NewLeaseEvent{KeyID: keys.GetKeyID(), LeaseID: keys.GetLeaseID()})
+}
+
+func newFakes(t *testing.T) *fakeVault {
+	oauthServer := newOAuthServer()
+	t.Cleanup(oauthServer.Close)
+
+	vault := newFakeVault(oauthServer.URL + "/token")
+	t.Cleanup(vault.Close)
+	return vault
+}
+
+func TestTokenFromCurrentKey(t *testing.T) {
+	vault := newFakes(t)
+	keys := vault.keySource()
+	fetchKey(t, keys)
+
+	token, err := credentials.TokenSource(keys).Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "token-key-1" {
+		t.Fatalf("expected the token of key-1, got %s", token.AccessToken)
+	}
+
+	// The access token is valid for an hour, the key only for its lease
+	if !token.Expiry.Equal(keys.GetExpiresAt()) {
+		t.Fatalf("expected the token to expire with the key at %s, got %s", keys.GetExpiresAt(), token.Expiry)
+	}
+}
+
+func TestTokenFollowsRotation(t *testing.T) {
+	vault := newFakes(t)
+	keys := vault.keySource()
+	fetchKey(t, keys)
+
+	tokenSource := credentials.TokenSource(keys)
+	if token, err := tokenSource.Token(); err != nil || token.AccessToken != "token-key-1" {
+		t.Fatalf("expected the token of key-1, got %v %v", token, err)
+	}
+
+	vault.rotate("key-2")
+	fetchKey(t, keys)
+
+	if token, err := tokenSource.Token(); err != nil || token.AccessToken != "token-key-2" {
+		t.Fatalf("expected the token of key-2, got %v %v", token, err)
+	}
+}
+
+func TestTokenWaitsForFirstKey(t *testing.T) {
+	vault := newFakes(t)
+	keys := vault.keySource()
+
+	type result struct {
+		accessToken string
+		err         error
+	}
+	resultCh := make(chan result)
+	go func() {
+		token, err := credentials.TokenSource(keys, credentials.WithWait(5*time.Second)).Token()
+		if err != nil {
+			resultCh <- result{err: err}
+			return
+		}
+		resultCh <- result{accessToken: token.AccessToken}
+	}()
+
+	select {
+	case r := <-resultCh:
+		t.Fatalf("Token returned before any key was fetched: %+v", r)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	fetchKey(t, keys)
+	select {
+	case r := <-resultCh:
+		if r.err != nil || r.accessToken != "token-key-1" {
+			t.Fatalf("expected the token of key-1, got %+v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Token still waiting after the key was fetched")
+	}
+}
+
+func TestTokenWithoutKey(t *testing.T) {
+	vault := newFakes(t)
+	keys := vault.keySource()
+
+	started := time.Now()
+	_, err := credentials.TokenSource(keys, credentials.WithWait(50*time.Millisecond)).Token()
+
+	var noCredentialsErr *credentials.NoCredentialsError
+	if !errors.As(err, &noCredentialsErr) {
+		t.Fatalf("expected a *NoCredentialsError, got %v", err)
+	}
+	if waited := time.Since(started); waited < 50*time.Millisecond || waited > time.Second {
+		t.Fatalf("expected to wait for 50ms, waited %s", waited)
+	}
+	vault.mutex.Lock()
+	defer vault.mutex.Unlock()
+	if vault.reads != 0 {
+		t.Fatal("the token source must not fetch keys itself")
+	}
+}
+
+func TestTokenWithoutRemainingLifetime(t *testing.T) {
+	vault := newFakes(t)
+	keys := vault.keySource()
+	fetchKey(t, keys)
+
+	// A key too close to its expiry is not handed out while it is replaced
+	keys.SetMinRemaining(2 * leaseDuration)
+	_, err := credentials.TokenSource(keys, credentials.WithWait(50*time.Millisecond)).Token()
+	var noCredentialsErr *credentials.NoCredentialsError
+	if !errors.As(err, &noCredentialsErr) {
+		t.Fatalf("expected a *NoCredentialsError, got %v", err)
+	}
+}
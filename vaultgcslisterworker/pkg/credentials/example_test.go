@@ -0,0 +1,144 @@
+package credentials_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+
+	"github.com/mikeadityas/vault-gcs-lister/pkg/credentials"
+	"github.com/mikeadityas/vault-gcs-lister/pkg/leasechain"
+)
+
+// bucketCounter is a lease chain consumer counting the buckets of a project
+// with the current key of its target
+type bucketCounter struct {
+	projectID string
+}
+
+func (bc *bucketCounter) GetID() string {
+	return "bucket-counter"
+}
+
+func (bc *bucketCounter) Consume(ctx context.Context, keys credentials.KeySource, events <-chan leasechain.Event) {
+	client, err := storage.NewClient(ctx, credentials.ClientOption(keys, credentials.WithScopes(storage.ScopeReadOnly)))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer client.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			// The client follows the key rotations on its own, the events
+			// only tell when to count again
+			if _, isNewLease := event.(leasechain.NewLeaseEvent); !isNewLease {
+				continue
+			}
+
+			buckets := 0
+			bucketIter := client.Buckets(ctx, bc.projectID)
+			for {
+				if _, err := bucketIter.Next(); err == iterator.Done {
+					break
+				} else if err != nil {
+					log.Println(err)
+					break
+				}
+				buckets++
+			}
+			log.Println("buckets:", buckets)
+		}
+	}
+}
+
+func ExampleClientOption() {
+	chain, err := leasechain.New(
+		leasechain.WithVault("https://vault.example.com:8200", "gcs-lister"),
+		leasechain.WithTLS("/etc/vault/ca.pem", "/etc/vault/cert.pem", "/etc/vault/key.pem"),
+		leasechain.WithTarget(leasechain.Target{ID: "infra", SecretsPath: "gcp/key/infra"}),
+		leasechain.WithConsumer("infra", &bucketCounter{projectID: "infra"}),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := chain.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// staticKeys is a key source of a single key, a lease chain hands a key
+// source following the lease of its target to every consumer instead
+type staticKeys struct {
+	key       []byte
+	keyID     string
+	expiresAt time.Time
+}
+
+func (sk *staticKeys) CurrentKey() ([]byte, string, time.Time) {
+	return append([]byte(nil), sk.key...), sk.keyID, sk.expiresAt
+}
+
+func (sk *staticKeys) WaitKey(ctx context.Context) error {
+	if len(sk.key) > 0 {
+		return nil
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func ExampleTokenSource() {
+	oauthServer := newOAuthServer()
+	defer oauthServer.Close()
+
+	key, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "infra",
+		"private_key_id": "key-1",
+		"private_key":    testPrivateKey(),
+		"client_email":   "lister@infra.iam.gserviceaccount.com",
+		"token_uri":      oauthServer.URL + "/token",
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	keys := &staticKeys{key: key, keyID: "key-1", expiresAt: time.Now().Add(10 * time.Minute)}
+
+	tokenSource := credentials.TokenSource(keys, credentials.WithScopes("https://www.googleapis.com/auth/devstorage.read_only"))
+	token, err := tokenSource.Token()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	fmt.Println(token.TokenType, token.AccessToken)
+	fmt.Println("expires with the key:", token.Expiry.Equal(keys.expiresAt))
+	// Output:
+	// Bearer token-key-1
+	// expires with the key: true
+}
+
+func ExampleWithWait() {
+	// No key has been leased yet, Token gives up after the wait
+	keys := &staticKeys{}
+	_, err := credentials.TokenSource(keys, credentials.WithWait(10*time.Millisecond)).Token()
+
+	var noCredentialsErr *credentials.NoCredentialsError
+	fmt.Println(errors.As(err, &noCredentialsErr))
+	// Output: true
+}
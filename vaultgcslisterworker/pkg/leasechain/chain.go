@@ -0,0 +1,400 @@
+// Package leasechain embeds the lease chain of vault-gcs-lister in other Go
+// services: a Vault token, logged in with cert auth, leases the GCP service
+// account keys of the targets, which authorize their GCS bucket listers and
+// are handed to their consumers.
+//
+// The package follows semantic versioning, see Version. Every chain logs in
+// to Vault with its own client and keeps the health, renewal schedule and
+// event history of its own daemons, see Chain.HealthHandler,
+// Chain.ScheduleHandler and Chain.EventsHandler, so a process may run several
+// chains.
+//
+// Example:
+//
+//	chain, err := leasechain.New(
+//		leasechain.WithVault("https://vault.example.com:9443", "gcslister"),
+//		leasechain.WithTLS("$CA_CERT_FILE", "$CERT_FILE", "$KEY_FILE"),
+//		leasechain.WithTarget(leasechain.Target{
+//			ID:          "infra",
+//			SecretsPath: "gcp/key/gcslister",
+//		}),
+//		leasechain.WithConsumer("infra", myConsumer),
+//	)
+//	if err != nil {
+//		return err
+//	}
+//	return chain.Run(ctx)
+package leasechain
+
+import (
+	"context"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/config"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/gcp"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/gcs"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/health"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/history"
+	leaseMgr "github.com/mikeadityas/vault-gcs-lister/internal/pkg/leasemanager"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/leasestore"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/log"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/schedule"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/util/lease"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/vault"
+)
+
+// Version is the version of the leasechain API
+const Version = "1.0.0"
+
+// Chain is the lease chain built by New
+type Chain struct {
+	vaultConf config.VaultConfig
+	tlsConf   config.TLSConfig
+	targets   []Target
+	sinks     map[string][]Sink
+	consumers map[string][]Consumer
+
+	persistDir        string
+	persistPassphrase string
+	coordination      *Coordination
+	schedule          Schedule
+	vaultRenewal      Renewal
+
+	health        *health.Registry
+	schedules     *schedule.Registry
+	events        *history.Buffer
+	mutex         sync.RWMutex
+	vaultLeaseMgr *vault.VaultLeaseManager
+	running       map[string]*runningTarget
+}
+
+type daemon interface {
+	Start() error
+	Stop() error
+}
+
+// consumerObserver subscribes a consumer to the events of a GCP lease manager
+type consumerObserver struct {
+	id           string
+	subscription *leaseMgr.Subscription
+}
+
+func (co *consumerObserver) Follow(subscription *leaseMgr.Subscription) {
+	co.subscription = subscription
+}
+
+func (co *consumerObserver) GetID() string {
+	return co.id
+}
+
+// New builds a chain from opts, it returns an error for an incomplete or
+// inconsistent configuration
+func New(opts ...Option) (*Chain, error) {
+	c := &Chain{
+		sinks:     map[string][]Sink{},
+		consumers: map[string][]Consumer{},
+		health:    health.NewRegistry(),
+		schedules: schedule.NewRegistry(),
+		events:    history.NewBuffer(history.DefaultCapacity),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.vaultConf.Address == "" || c.vaultConf.RoleName == "" {
+		return nil, errors.New("the Vault address and role name are required")
+	}
+
+	if len(c.targets) == 0 {
+		return nil, errors.New("at least one target is required")
+	}
+
+	targetIDs := map[string]bool{}
+	for _, target := range c.targets {
+		if target.ID == "" {
+			return nil, errors.New("target ID is empty")
+		}
+		if targetIDs[target.ID] {
+			return nil, errors.Errorf("duplicate target %s", target.ID)
+		}
+		targetIDs[target.ID] = true
+
+		if target.SecretsPath == "" {
+			return nil, errors.Errorf("target %s has no secrets path", target.ID)
+		}
+		if target.ProjectID != "" && target.Interval <= 0 {
+			return nil, errors.Errorf("target %s lists buckets without a positive interval", target.ID)
+		}
+		if err := earlyRenewal(target.EarlyRenewal, target.EarlyRenewalPercent).Validate(); err != nil {
+			return nil, errors.Wrapf(err, "target %s", target.ID)
+		}
+		if target.MinRemaining < 0 {
+			return nil, errors.Errorf("target %s has a negative minimum remaining lifetime", target.ID)
+		}
+	}
+
+	if err := c.coordination.validate(); err != nil {
+		return nil, err
+	}
+	if err := c.schedule.validate(); err != nil {
+		return nil, err
+	}
+	if err := earlyRenewal(c.vaultRenewal.EarlyRenewal, c.vaultRenewal.EarlyRenewalPercent).Validate(); err != nil {
+		return nil, errors.Wrap(err, "Vault token")
+	}
+	if c.vaultRenewal.MinRemaining < 0 {
+		return nil, errors.New("the Vault token has a negative minimum remaining lifetime")
+	}
+
+	for targetID := range c.sinks {
+		if !targetIDs[targetID] {
+			return nil, errors.Errorf("sink of unknown target %s", targetID)
+		}
+	}
+	for targetID := range c.consumers {
+		if !targetIDs[targetID] {
+			return nil, errors.Errorf("consumer of unknown target %s", targetID)
+		}
+	}
+
+	return c, nil
+}
+
+// Run logs in to Vault and runs the chain until ctx is done. It only returns
+// an error if the chain can not start, failures afterwards are retried.
+func (c *Chain) Run(ctx context.Context) error {
+	tlsConf, err := expandTLSConfig(c.tlsConf)
+	if err != nil {
+		return err
+	}
+
+	store, err := c.openLeaseStore(tlsConf)
+	if err != nil {
+		return err
+	}
+	if store != nil {
+		defer store.Close()
+	}
+
+	// Replicas started together by a rollout log in at different times
+	if jitter := schedule.Jitter(c.schedule.StartupJitter); jitter > 0 {
+		log.Logger.Sugar().Infow("Delaying the start of the lease chain", "startup_jitter", jitter)
+		c.schedules.SetStartupJitter(jitter)
+		select {
+		case <-time.After(jitter):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+
+	log.Logger.Sugar().Info("Initializing Vault lease manager")
+	vaultLeaseMgr, err := vault.NewVaultLeaseManager(ctx, &c.vaultConf, tlsConf)
+	if err != nil {
+		return err
+	}
+	log.Logger.Sugar().Info("Vault lease manager initialized")
+
+	renewalWindow := c.schedule.window()
+	vaultTTL := time.Duration(vaultLeaseMgr.Client().TTL()) * time.Second
+
+	chainCtx, chainCancel := context.WithCancel(ctx)
+	defer chainCancel()
+
+	vaultCtx, vaultCancel := context.WithCancel(chainCtx)
+	vaultPolicy := schedule.Policy{
+		Window:       renewalWindow,
+		EarlyRenewal: earlyRenewal(c.vaultRenewal.EarlyRenewal, c.vaultRenewal.EarlyRenewalPercent),
+		MinRemaining: c.vaultRenewal.MinRemaining,
+	}
+	daemons := []daemon{vaultLeaseMgr.Daemonize(vaultCtx, vaultCancel, vaultTTL, vaultPolicy, c.health, c.schedules, c.events)}
+
+	coordinator, err := c.startCoordination(chainCtx, tlsConf)
+	if err != nil {
+		return err
+	}
+	if coordinator != nil {
+		defer coordinator.stop()
+	}
+
+	var consumerWaitGroup sync.WaitGroup
+	running := map[string]*runningTarget{}
+	for _, target := range c.targets {
+		var secretReader gcp.SecretReader = vaultLeaseMgr.Client()
+		if coordinator != nil {
+			secretReader = coordinator.secretReader(vaultLeaseMgr.Client())
+		}
+
+		gcpLeaseMgr := newGCPLeaseManager(target, secretReader)
+		if coordinator != nil {
+			coordinator.server.Register(target.SecretsPath, gcpLeaseMgr)
+		}
+		if store != nil {
+			gcpLeaseMgr.Persist(store)
+		}
+		gcpLeaseMgr.SetTokenRenewer(vaultLeaseMgr)
+		vaultLeaseMgr.Register(gcpLeaseMgr)
+		defer vaultLeaseMgr.Deregister(gcpLeaseMgr)
+
+		gcpCtx, gcpCancel := context.WithCancel(chainCtx)
+		gcpRefreshPeriod := time.Duration(gcpLeaseMgr.GetTTL()) * time.Second
+		gcpPolicy := schedule.Policy{
+			Window:       renewalWindow,
+			EarlyRenewal: earlyRenewal(target.EarlyRenewal, target.EarlyRenewalPercent),
+			MinRemaining: target.MinRemaining,
+		}
+		daemons = append(daemons, gcpLeaseMgr.Daemonize(gcpCtx, gcpCancel, gcpRefreshPeriod, gcpPolicy, c.health, c.schedules, c.events))
+		running[target.ID] = &runningTarget{target: target, gcpLeaseMgr: gcpLeaseMgr}
+
+		if target.ProjectID != "" {
+			gcsCtx, gcsCancel := context.WithCancel(chainCtx)
+			gcsBucketListerSvc := newBucketLister(gcsCtx, gcsCancel, target, gcpLeaseMgr)
+			gcpLeaseMgr.Register(gcsBucketListerSvc)
+			defer gcpLeaseMgr.Deregister(gcsBucketListerSvc)
+
+			for _, sink := range c.sinks[target.ID] {
+				gcsBucketListerSvc.RegisterSink(listingSink{sink: sink})
+			}
+			daemons = append(daemons, gcsBucketListerSvc.Daemonize(target.Interval, c.health, c.events))
+			running[target.ID].bucketListerSvc = gcsBucketListerSvc
+		}
+
+		for _, consumer := range c.consumers[target.ID] {
+			observer := &consumerObserver{id: consumer.GetID()}
+			gcpLeaseMgr.Register(observer)
+			defer gcpLeaseMgr.Deregister(observer)
+
+			consumerWaitGroup.Add(1)
+			go func(consumer Consumer, events <-chan Event) {
+				defer consumerWaitGroup.Done()
+				consumer.Consume(chainCtx, gcpLeaseMgr, events)
+			}(consumer, forwardEvents(chainCtx, observer.subscription))
+		}
+	}
+
+	for _, d := range daemons {
+		if err := d.Start(); err != nil {
+			return errors.Wrap(err, "failed to start daemon")
+		}
+		defer d.Stop()
+	}
+	c.setRunning(vaultLeaseMgr, running)
+	defer c.setRunning(nil, nil)
+	log.Logger.Sugar().Info("Lease chain started")
+
+	<-ctx.Done()
+	log.Logger.Sugar().Info("Shutting down lease chain...")
+
+	// The consumers stop with the chain context, the deferred calls then stop
+	// the daemons in the reverse order they started in
+	chainCancel()
+	consumerWaitGroup.Wait()
+	return nil
+}
+
+// newGCPLeaseManager leases the keys of target, read with reader
+func newGCPLeaseManager(target Target, reader gcp.SecretReader) *gcp.GCPLeaseManager {
+	gcpLeaseMgr := gcp.NewGCPLeaseManager(
+		"gcp-"+target.ID,
+		target.SecretsPath,
+		gcp.KeyExpectation{
+			ClientEmail: target.ExpectedClientEmail,
+			ProjectID:   target.ExpectedProjectID,
+		},
+		reader,
+	)
+	gcpLeaseMgr.SetMinRemaining(target.MinRemaining)
+	return gcpLeaseMgr
+}
+
+// newBucketLister lists the buckets of the project of target with the keys of
+// gcpLeaseMgr
+func newBucketLister(
+	ctx context.Context,
+	ctxCancelFunc context.CancelFunc,
+	target Target,
+	gcpLeaseMgr *gcp.GCPLeaseManager,
+) *gcs.BucketListerService {
+	return gcs.NewBucketListerService(
+		ctx,
+		ctxCancelFunc,
+		"gcs-"+target.ID,
+		target.ProjectID,
+		gcpLeaseMgr,
+		gcs.ListOptions{
+			Prefix:   target.Prefix,
+			PageSize: target.PageSize,
+		},
+	)
+}
+
+// openLeaseStore opens the store of the persisted leases, it is nil without
+// persistence
+func (c *Chain) openLeaseStore(tlsConf *config.TLSConfig) (*leasestore.Store, error) {
+	if c.persistDir == "" {
+		return nil, nil
+	}
+
+	dir, err := config.ExpandPath(c.persistDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid persistence directory")
+	}
+
+	passphrase := []byte(c.persistPassphrase)
+	if len(passphrase) == 0 {
+		if passphrase, err = ioutil.ReadFile(tlsConf.KeyPath); err != nil {
+			return nil, errors.Wrap(err, "failed to read the TLS key encrypting the persisted leases")
+		}
+	}
+
+	log.Logger.Sugar().Infow("Persisting leases", "path", dir)
+	return leasestore.NewStore(dir, passphrase)
+}
+
+func (s Schedule) validate() error {
+	if s.StartupJitter < 0 {
+		return errors.New("the startup jitter is negative")
+	}
+	if s.RenewalWindowFrom == 0 && s.RenewalWindowTo == 0 {
+		return nil
+	}
+	if s.RenewalWindowFrom <= 0 || s.RenewalWindowFrom > s.RenewalWindowTo || s.RenewalWindowTo >= 1 {
+		return errors.Errorf("the renewal window %v-%v is not within the TTL", s.RenewalWindowFrom, s.RenewalWindowTo)
+	}
+	return nil
+}
+
+func (s Schedule) window() schedule.Window {
+	return schedule.Window{From: s.RenewalWindowFrom, To: s.RenewalWindowTo}
+}
+
+// earlyRenewal prefers the percentage of the TTL over the fixed duration
+func earlyRenewal(duration time.Duration, percent float64) lease.EarlyRenewal {
+	if percent != 0 {
+		return lease.EarlyRenewal{Percent: percent}
+	}
+	return lease.EarlyRenewal{Duration: duration}
+}
+
+func expandTLSConfig(tlsConf config.TLSConfig) (*config.TLSConfig, error) {
+	var err error
+	tlsConf.CACertPath, err = config.ValidateFilePathValue(tlsConf.CACertPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid CA cert")
+	}
+
+	tlsConf.CertPath, err = config.ValidateFilePathValue(tlsConf.CertPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid cert")
+	}
+
+	tlsConf.KeyPath, err = config.ValidateFilePathValue(tlsConf.KeyPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid key")
+	}
+
+	return &tlsConf, nil
+}
@@ -0,0 +1,435 @@
+package leasechain_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mikeadityas/vault-gcs-lister/pkg/leasechain"
+)
+
+const (
+	secretsPath   = "gcp/key/infra"
+	leaseDuration = 10 * time.Minute
+	tokenTTL      = time.Hour
+)
+
+// fakeVault serves the cert login, the token renewal and lookup, and the keys
+// of the GCP secrets engine at secretsPath over TLS
+type fakeVault struct {
+	*httptest.Server
+
+	privateKey string
+
+	mutex   sync.Mutex
+	keys    int
+	revoked []string
+}
+
+func newFakeVault(t *testing.T) *fakeVault {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fv := &fakeVault{privateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))}
+	fv.Server = httptest.NewTLSServer(http.HandlerFunc(fv.serve))
+	t.Cleanup(fv.Close)
+	return fv
+}
+
+func (fv *fakeVault) serve(w http.ResponseWriter, r *http.Request) {
+	auth := map[string]interface{}{
+		"client_token":   "token",
+		"accessor":       "accessor",
+		"lease_duration": int(tokenTTL / time.Second),
+		"renewable":      true,
+	}
+
+	switch r.URL.Path {
+	case "/v1/auth/cert/login", "/v1/auth/token/renew-self":
+		json.NewEncoder(w).Encode(map[string]interface{}{"auth": auth})
+	case "/v1/auth/token/lookup-self":
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+			"accessor":     "accessor",
+			"creation_ttl": int(tokenTTL / time.Second),
+		}})
+	case "/v1/" + secretsPath:
+		json.NewEncoder(w).Encode(fv.lease())
+	case "/v1/sys/leases/lookup":
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+			"ttl": int(leaseDuration / time.Second),
+		}})
+	case "/v1/sys/leases/revoke":
+		body := struct {
+			LeaseID string `json:"lease_id"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&body)
+
+		fv.mutex.Lock()
+		fv.revoked = append(fv.revoked, body.LeaseID)
+		fv.mutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string][]string{"errors": {}})
+	}
+}
+
+// lease returns a new key on every read, key-1, key-2 and so on
+func (fv *fakeVault) lease() map[string]interface{} {
+	fv.mutex.Lock()
+	fv.keys++
+	keyID := "key-" + strconv.Itoa(fv.keys)
+	fv.mutex.Unlock()
+
+	keyJSON, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "infra",
+		"private_key_id": keyID,
+		"private_key":    fv.privateKey,
+		"client_email":   "lister@infra.iam.gserviceaccount.com",
+		"client_id":      "1234",
+		"token_uri":      "https://oauth2.googleapis.com/token",
+	})
+	return map[string]interface{}{
+		"lease_id":       secretsPath + "/" + keyID,
+		"lease_duration": int(leaseDuration / time.Second),
+		"renewable":      true,
+		"data": map[string]interface{}{
+			"private_key_data": base64.StdEncoding.EncodeToString(keyJSON),
+		},
+	}
+}
+
+func (fv *fakeVault) revokedLeases() []string {
+	fv.mutex.Lock()
+	defer fv.mutex.Unlock()
+
+	return append([]string(nil), fv.revoked...)
+}
+
+// writeTLSFiles writes the CA of the fake Vault and a self-signed client
+// cert, the fake Vault does not check client certs
+func writeTLSFiles(t *testing.T, fv *fakeVault) (caCertPath, certPath, keyPath string) {
+	t.Helper()
+	dir := t.TempDir()
+
+	caCertPath = filepath.Join(dir, "ca.pem")
+	writePEM(t, caCertPath, "CERTIFICATE", fv.Certificate().Raw)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "vault-gcs-lister"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath = filepath.Join(dir, "cert.pem")
+	writePEM(t, certPath, "CERTIFICATE", der)
+	keyPath = filepath.Join(dir, "key.pem")
+	writePEM(t, keyPath, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+	return caCertPath, certPath, keyPath
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestChain(t *testing.T, fv *fakeVault, opts ...leasechain.Option) *leasechain.Chain {
+	t.Helper()
+
+	caCertPath, certPath, keyPath := writeTLSFiles(t, fv)
+	chain, err := leasechain.New(append([]leasechain.Option{
+		leasechain.WithVault(fv.URL, "lister"),
+		leasechain.WithTLS(caCertPath, certPath, keyPath),
+		leasechain.WithTarget(leasechain.Target{ID: "infra", SecretsPath: secretsPath}),
+	}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chain
+}
+
+func TestNewValidation(t *testing.T) {
+	vault := leasechain.WithVault("https://vault:8200", "lister")
+	target := leasechain.WithTarget(leasechain.Target{ID: "infra", SecretsPath: secretsPath})
+
+	tests := []struct {
+		name string
+		opts []leasechain.Option
+		err  string
+	}{
+		{
+			name: "valid",
+			opts: []leasechain.Option{vault, target},
+		},
+		{
+			name: "no Vault",
+			opts: []leasechain.Option{target},
+			err:  "the Vault address and role name are required",
+		},
+		{
+			name: "no target",
+			opts: []leasechain.Option{vault},
+			err:  "at least one target is required",
+		},
+		{
+			name: "empty target ID",
+			opts: []leasechain.Option{vault, leasechain.WithTarget(leasechain.Target{SecretsPath: secretsPath})},
+			err:  "target ID is empty",
+		},
+		{
+			name: "duplicate target",
+			opts: []leasechain.Option{vault, target, target},
+			err:  "duplicate target infra",
+		},
+		{
+			name: "no secrets path",
+			opts: []leasechain.Option{vault, leasechain.WithTarget(leasechain.Target{ID: "infra"})},
+			err:  "target infra has no secrets path",
+		},
+		{
+			name: "lister without interval",
+			opts: []leasechain.Option{vault, leasechain.WithTarget(leasechain.Target{ID: "infra", SecretsPath: secretsPath, ProjectID: "infra"})},
+			err:  "target infra lists buckets without a positive interval",
+		},
+		{
+			name: "early renewal of the whole TTL",
+			opts: []leasechain.Option{vault, leasechain.WithTarget(leasechain.Target{ID: "infra", SecretsPath: secretsPath, EarlyRenewalPercent: 100})},
+			err:  "target infra",
+		},
+		{
+			name: "negative minimum remaining",
+			opts: []leasechain.Option{vault, leasechain.WithTarget(leasechain.Target{ID: "infra", SecretsPath: secretsPath, MinRemaining: -time.Second})},
+			err:  "target infra has a negative minimum remaining lifetime",
+		},
+		{
+			name: "negative Vault minimum remaining",
+			opts: []leasechain.Option{vault, target, leasechain.WithVaultRenewal(leasechain.Renewal{MinRemaining: -time.Second})},
+			err:  "the Vault token has a negative minimum remaining lifetime",
+		},
+		{
+			name: "negative startup jitter",
+			opts: []leasechain.Option{vault, target, leasechain.WithSchedule(leasechain.Schedule{StartupJitter: -time.Second})},
+			err:  "the startup jitter is negative",
+		},
+		{
+			name: "renewal window past the TTL",
+			opts: []leasechain.Option{vault, target, leasechain.WithSchedule(leasechain.Schedule{RenewalWindowFrom: 0.5, RenewalWindowTo: 1})},
+			err:  "not within the TTL",
+		},
+		{
+			name: "unknown coordination mode",
+			opts: []leasechain.Option{vault, target, leasechain.WithCoordination(leasechain.Coordination{Mode: "zookeeper"})},
+			err:  "zookeeper",
+		},
+		{
+			name: "file coordination without lock path",
+			opts: []leasechain.Option{vault, target, leasechain.WithCoordination(leasechain.Coordination{
+				Mode:             leasechain.CoordinationFile,
+				Address:          ":8443",
+				AdvertiseAddress: "https://127.0.0.1:8443",
+			})},
+			err: "the coordination lock path is empty",
+		},
+		{
+			name: "coordination retry period past the lease duration",
+			opts: []leasechain.Option{vault, target, leasechain.WithCoordination(leasechain.Coordination{
+				Mode:             leasechain.CoordinationFile,
+				LockPath:         "/tmp/lister.lock",
+				LeaseDuration:    time.Second,
+				RetryPeriod:      2 * time.Second,
+				Address:          ":8443",
+				AdvertiseAddress: "https://127.0.0.1:8443",
+			})},
+			err: "must be shorter than the lease duration",
+		},
+		{
+			name: "sink of unknown target",
+			opts: []leasechain.Option{vault, target, leasechain.WithSink("other", nil)},
+			err:  "sink of unknown target other",
+		},
+		{
+			name: "consumer of unknown target",
+			opts: []leasechain.Option{vault, target, leasechain.WithConsumer("other", nil)},
+			err:  "consumer of unknown target other",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := leasechain.New(tt.opts...)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestRunStartStop(t *testing.T) {
+	fv := newFakeVault(t)
+	chain := newTestChain(t, fv)
+
+	if _, err := chain.State(); errors.Cause(err) != leasechain.ErrNotRunning {
+		t.Fatalf("expected ErrNotRunning before Run, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- chain.Run(ctx) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		state, err := chain.State()
+		if err == nil && state.Targets[0].Key.KeyID != "" {
+			if state.Targets[0].Key.LeaseID != secretsPath+"/key-1" {
+				t.Errorf("unexpected lease %s", state.Targets[0].Key.LeaseID)
+			}
+			if state.Targets[0].Lister != nil {
+				t.Error("a target without project ID has no lister")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the chain did not fetch a key, last error %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	recorder := httptest.NewRecorder()
+	chain.HealthHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected a ready chain, got %d %s", recorder.Code, recorder.Body)
+	}
+
+	if err := chain.ListNow("infra"); errors.Cause(err) != leasechain.ErrNoLister {
+		t.Errorf("expected ErrNoLister, got %v", err)
+	}
+	if err := chain.RotateKey("other"); errors.Cause(err) != leasechain.ErrUnknownTarget {
+		t.Errorf("expected ErrUnknownTarget, got %v", err)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the chain did not stop")
+	}
+
+	if _, err := chain.State(); errors.Cause(err) != leasechain.ErrNotRunning {
+		t.Fatalf("expected ErrNotRunning after Run, got %v", err)
+	}
+}
+
+func TestRunInvalidTLS(t *testing.T) {
+	chain, err := leasechain.New(
+		leasechain.WithVault("https://vault:8200", "lister"),
+		leasechain.WithTLS("/nonexistent/ca.pem", "/nonexistent/cert.pem", "/nonexistent/key.pem"),
+		leasechain.WithTarget(leasechain.Target{ID: "infra", SecretsPath: secretsPath}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := chain.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "invalid CA cert") {
+		t.Fatalf("expected an invalid CA cert error, got %v", err)
+	}
+}
+
+func TestSession(t *testing.T) {
+	fv := newFakeVault(t)
+	chain := newTestChain(t, fv)
+	ctx := context.Background()
+
+	session, err := chain.Login(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := session.FetchKey(ctx, "infra")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.LeaseID != secretsPath+"/key-1" || key.TTL != leaseDuration {
+		t.Errorf("unexpected lease %s of %v", key.LeaseID, key.TTL)
+	}
+	if key.Info.PrivateKeyID != "key-1" || key.Info.ClientEmail != "lister@infra.iam.gserviceaccount.com" {
+		t.Errorf("unexpected key info %+v", key.Info)
+	}
+
+	if _, err := session.ListBuckets(ctx, key); errors.Cause(err) != leasechain.ErrNoLister {
+		t.Errorf("expected ErrNoLister, got %v", err)
+	}
+	if _, err := session.FetchKey(ctx, "other"); errors.Cause(err) != leasechain.ErrUnknownTarget {
+		t.Errorf("expected ErrUnknownTarget, got %v", err)
+	}
+
+	if err := session.Revoke(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if revoked := fv.revokedLeases(); len(revoked) != 1 || revoked[0] != key.LeaseID {
+		t.Errorf("unexpected revoked leases %v", revoked)
+	}
+}
+
+func TestSessionRejectsUnexpectedKey(t *testing.T) {
+	fv := newFakeVault(t)
+	chain := newTestChain(t, fv, leasechain.WithTarget(leasechain.Target{
+		ID:                  "other",
+		SecretsPath:         secretsPath,
+		ExpectedClientEmail: "other@infra.iam.gserviceaccount.com",
+	}))
+
+	session, err := chain.Login(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.FetchKey(context.Background(), "other"); err == nil {
+		t.Fatal("expected a key of another service account to be rejected")
+	}
+}
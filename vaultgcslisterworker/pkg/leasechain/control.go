@@ -0,0 +1,255 @@
+package leasechain
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/gcp"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/gcs"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/vault"
+)
+
+var (
+	// ErrNotRunning is returned by the controls of a chain that is not running
+	ErrNotRunning = errors.New("the lease chain is not running")
+	// ErrUnknownTarget is returned for a target ID the chain does not have
+	ErrUnknownTarget = errors.New("unknown target")
+	// ErrNoLister is returned for a target without GCS bucket lister
+	ErrNoLister = errors.New("the target has no GCS bucket lister")
+)
+
+// ComponentStatus is the health of a daemon of the chain
+type ComponentStatus struct {
+	Component string `json:"component"`
+	// State is starting, healthy, degraded, retrying or failed
+	State     string    `json:"state"`
+	ErrClass  string    `json:"err_class,omitempty"`
+	LastErr   string    `json:"last_err,omitempty"`
+	NumRetry  int       `json:"num_retry"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// LastSuccessAt and NextRunAt are zero if the daemon never succeeded or
+	// has nothing scheduled
+	LastSuccessAt time.Time `json:"last_success_at"`
+	NextRunAt     time.Time `json:"next_run_at"`
+}
+
+// State is the state of every daemon of a running chain, shaped as its lease
+// tree
+type State struct {
+	Vault   VaultState    `json:"vault"`
+	Targets []TargetState `json:"targets"`
+}
+
+type VaultState struct {
+	ComponentStatus
+	TokenExpiresAt time.Time `json:"token_expires_at"`
+}
+
+type TargetState struct {
+	ID     string       `json:"id"`
+	Key    KeyState     `json:"key"`
+	Lister *ListerState `json:"lister,omitempty"`
+}
+
+type KeyState struct {
+	ComponentStatus
+	KeyID     string    `json:"key_id"`
+	LeaseID   string    `json:"lease_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Degraded  bool      `json:"degraded"`
+}
+
+type ListerState struct {
+	ComponentStatus
+	ProjectID string `json:"project_id"`
+	Paused    bool   `json:"paused"`
+}
+
+// runningTarget holds the managers of a target while the chain runs
+type runningTarget struct {
+	target          Target
+	gcpLeaseMgr     *gcp.GCPLeaseManager
+	bucketListerSvc *gcs.BucketListerService
+}
+
+// RotateKey fetches a new key for the target right away
+func (c *Chain) RotateKey(targetID string) error {
+	rt, err := c.runningTarget(targetID)
+	if err != nil {
+		return err
+	}
+
+	rt.gcpLeaseMgr.ForceRotation(context.Background(), "requested through the lease chain controls")
+	return nil
+}
+
+// RenewToken renews the Vault token right away
+func (c *Chain) RenewToken() error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.vaultLeaseMgr == nil {
+		return ErrNotRunning
+	}
+	c.vaultLeaseMgr.RequestRenewal()
+	return nil
+}
+
+// ListNow lists the buckets of the target right away, even if paused
+func (c *Chain) ListNow(targetID string) error {
+	bucketListerSvc, err := c.bucketLister(targetID)
+	if err != nil {
+		return err
+	}
+
+	bucketListerSvc.RequestListing()
+	return nil
+}
+
+// PauseLister skips the scheduled listings of the target until ResumeLister
+func (c *Chain) PauseLister(targetID string) error {
+	bucketListerSvc, err := c.bucketLister(targetID)
+	if err != nil {
+		return err
+	}
+
+	bucketListerSvc.Pause()
+	return nil
+}
+
+// ResumeLister resumes the scheduled listings of the target
+func (c *Chain) ResumeLister(targetID string) error {
+	bucketListerSvc, err := c.bucketLister(targetID)
+	if err != nil {
+		return err
+	}
+
+	bucketListerSvc.Resume()
+	return nil
+}
+
+// State returns the state of every daemon of the chain
+func (c *Chain) State() (*State, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.vaultLeaseMgr == nil {
+		return nil, ErrNotRunning
+	}
+
+	state := &State{
+		Vault: VaultState{
+			ComponentStatus: c.componentStatus("vault"),
+			TokenExpiresAt:  c.vaultLeaseMgr.GetTokenExpiresAt(),
+		},
+	}
+
+	for _, target := range c.targets {
+		rt := c.running[target.ID]
+
+		targetState := TargetState{
+			ID: target.ID,
+			Key: KeyState{
+				ComponentStatus: c.componentStatus(rt.gcpLeaseMgr.GetID()),
+				KeyID:           rt.gcpLeaseMgr.GetKeyID(),
+				LeaseID:         rt.gcpLeaseMgr.GetLeaseID(),
+				ExpiresAt:       rt.gcpLeaseMgr.GetExpiresAt(),
+				Degraded:        rt.gcpLeaseMgr.IsDegraded(),
+			},
+		}
+
+		if rt.bucketListerSvc != nil {
+			targetState.Lister = &ListerState{
+				ComponentStatus: c.componentStatus(rt.bucketListerSvc.GetID()),
+				ProjectID:       target.ProjectID,
+				Paused:          rt.bucketListerSvc.IsPaused(),
+			}
+		}
+
+		state.Targets = append(state.Targets, targetState)
+	}
+	return state, nil
+}
+
+// componentStatus is the zero status for a daemon that has not started
+func (c *Chain) componentStatus(component string) ComponentStatus {
+	snapshot, ok := c.health.Lookup(component)
+	if !ok {
+		return ComponentStatus{}
+	}
+
+	return ComponentStatus{
+		Component:     snapshot.Component,
+		State:         string(snapshot.State),
+		ErrClass:      snapshot.ErrClass,
+		LastErr:       snapshot.LastErr,
+		NumRetry:      snapshot.NumRetry,
+		UpdatedAt:     snapshot.UpdatedAt,
+		LastSuccessAt: snapshot.LastSuccessAt,
+		NextRunAt:     snapshot.NextRunAt,
+	}
+}
+
+// HealthHandler serves /healthz and /readyz with the status of every daemon
+// of the chain, /readyz answers 503 once any of them has failed
+func (c *Chain) HealthHandler() http.Handler {
+	return c.health.Handler()
+}
+
+// ScheduleHandler serves /debug/schedule with the next renewal of every lease
+// of the chain and its startup jitter
+func (c *Chain) ScheduleHandler() http.Handler {
+	return c.schedules.Handler()
+}
+
+// EventsHandler serves /debug/events with the lease lifecycle events of the
+// chain, filtered by the component, kind, since, until and limit queries
+func (c *Chain) EventsHandler() http.Handler {
+	return c.events.Handler()
+}
+
+// DumpEvents logs every lease lifecycle event of the chain, so the history
+// survives in the logs once the process stops
+func (c *Chain) DumpEvents() {
+	c.events.Dump()
+}
+
+func (c *Chain) runningTarget(targetID string) (*runningTarget, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.vaultLeaseMgr == nil {
+		return nil, ErrNotRunning
+	}
+
+	rt, ok := c.running[targetID]
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownTarget, "target %s", targetID)
+	}
+	return rt, nil
+}
+
+func (c *Chain) bucketLister(targetID string) (*gcs.BucketListerService, error) {
+	rt, err := c.runningTarget(targetID)
+	if err != nil {
+		return nil, err
+	}
+
+	if rt.bucketListerSvc == nil {
+		return nil, errors.Wrapf(ErrNoLister, "target %s", targetID)
+	}
+	return rt.bucketListerSvc, nil
+}
+
+// setRunning makes the controls act on the managers of a running chain, nil
+// managers mark the chain as stopped
+func (c *Chain) setRunning(vaultLeaseMgr *vault.VaultLeaseManager, running map[string]*runningTarget) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.vaultLeaseMgr = vaultLeaseMgr
+	c.running = running
+}
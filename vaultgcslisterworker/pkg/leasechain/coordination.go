@@ -0,0 +1,151 @@
+package leasechain
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/config"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/coordination"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/log"
+)
+
+const (
+	CoordinationKubernetes = "kubernetes"
+	CoordinationFile       = "file"
+)
+
+// coordinator runs the election and the distribution endpoint of the chain
+type coordinator struct {
+	elector     *coordination.Elector
+	server      *coordination.Server
+	httpServer  *http.Server
+	clientConf  *tls.Config
+	cancel      context.CancelFunc
+	electorDone chan struct{}
+}
+
+func (co *Coordination) validate() error {
+	if co == nil {
+		return nil
+	}
+
+	switch co.Mode {
+	case CoordinationKubernetes:
+		if co.LeaseName == "" {
+			return errors.New("the coordination lease name is empty")
+		}
+	case CoordinationFile:
+		if co.LockPath == "" {
+			return errors.New("the coordination lock path is empty")
+		}
+	default:
+		return errors.Errorf("unknown coordination mode %q", co.Mode)
+	}
+
+	if co.Address == "" || co.AdvertiseAddress == "" {
+		return errors.New("the coordination address and advertise address are required")
+	}
+
+	// Zero durations fall back to the defaults of the elector
+	leaseDuration, retryPeriod := co.LeaseDuration, co.RetryPeriod
+	if leaseDuration <= 0 {
+		leaseDuration = coordination.DefaultLeaseDuration
+	}
+	if retryPeriod <= 0 {
+		retryPeriod = coordination.DefaultRetryPeriod
+	}
+	if retryPeriod >= leaseDuration {
+		return errors.Errorf("the coordination retry period %s must be shorter than the lease duration %s", retryPeriod, leaseDuration)
+	}
+	return nil
+}
+
+// startCoordination runs a first round of the election, so the daemons know
+// whether to fetch from Vault, then campaigns and serves the keys until ctx is
+// done. It is nil without coordination.
+func (c *Chain) startCoordination(ctx context.Context, tlsConf *config.TLSConfig) (*coordinator, error) {
+	if c.coordination == nil {
+		return nil, nil
+	}
+
+	identity := c.coordination.Identity
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get the hostname identifying the replica")
+		}
+		identity = hostname
+	}
+
+	var lock coordination.Lock
+	var err error
+	switch c.coordination.Mode {
+	case CoordinationKubernetes:
+		lock, err = coordination.NewKubernetesLock(c.coordination.LeaseName, c.coordination.LeaseNamespace, c.coordination.LeaseDuration)
+	case CoordinationFile:
+		lock, err = coordination.NewFileLock(c.coordination.LockPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	serverConf, clientConf, err := coordination.TLSConfigs(tlsConf.CACertPath, tlsConf.CertPath, tlsConf.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	elector := coordination.NewElector(
+		lock,
+		coordination.Record{Identity: identity, Address: c.coordination.AdvertiseAddress},
+		c.coordination.LeaseDuration,
+		c.coordination.RetryPeriod,
+		c.health,
+		c.events,
+	)
+	ctx, cancel := context.WithCancel(ctx)
+	co := &coordinator{
+		elector:     elector,
+		server:      coordination.NewServer(elector),
+		clientConf:  clientConf,
+		cancel:      cancel,
+		electorDone: make(chan struct{}),
+	}
+	co.httpServer = &http.Server{
+		Addr:      c.coordination.Address,
+		Handler:   co.server.Handler(),
+		TLSConfig: serverConf,
+	}
+
+	go func() {
+		log.Logger.Sugar().Infow("Serving coordination server", "address", c.coordination.Address, "identity", identity)
+		if err := co.httpServer.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+			log.Logger.Sugar().Errorw("The coordination server stopped", "err", err)
+		}
+	}()
+
+	elector.Campaign(ctx)
+	go func() {
+		defer close(co.electorDone)
+		elector.Run(ctx)
+	}()
+	return co, nil
+}
+
+func (co *coordinator) secretReader(vault coordination.VaultReader) *coordination.SecretReader {
+	return coordination.NewSecretReader(vault, co.elector, co.clientConf)
+}
+
+// stop releases the leadership and stops serving the keys
+func (co *coordinator) stop() {
+	co.cancel()
+	<-co.electorDone
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	co.httpServer.Shutdown(ctx)
+}
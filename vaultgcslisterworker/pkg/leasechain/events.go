@@ -0,0 +1,115 @@
+package leasechain
+
+import (
+	"context"
+	"time"
+
+	leaseMgr "github.com/mikeadityas/vault-gcs-lister/internal/pkg/leasemanager"
+)
+
+// Kind is the kind of an Event
+type Kind int
+
+const (
+	KindNewLease Kind = iota
+	KindStaleLease
+	KindRevoked
+	KindExpiring
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindNewLease:
+		return "new_lease"
+	case KindStaleLease:
+		return "stale_lease"
+	case KindRevoked:
+		return "revoked"
+	case KindExpiring:
+		return "expiring"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is a lifecycle event of the key of a target, one of NewLeaseEvent,
+// StaleLeaseEvent, RevokedEvent or ExpiringEvent
+type Event interface {
+	Kind() Kind
+}
+
+// NewLeaseEvent is delivered after the key has been renewed or replaced
+type NewLeaseEvent struct {
+	KeyID   string
+	LeaseID string
+	TTL     time.Duration
+}
+
+// StaleLeaseEvent is delivered when the key can no longer be used
+type StaleLeaseEvent struct {
+	Reason string
+}
+
+// RevokedEvent is delivered when the key has been revoked for good
+type RevokedEvent struct {
+	Reason string
+}
+
+// ExpiringEvent is delivered when the key is about to expire
+type ExpiringEvent struct {
+	ExpiresAt time.Time
+}
+
+func (NewLeaseEvent) Kind() Kind   { return KindNewLease }
+func (StaleLeaseEvent) Kind() Kind { return KindStaleLease }
+func (RevokedEvent) Kind() Kind    { return KindRevoked }
+func (ExpiringEvent) Kind() Kind   { return KindExpiring }
+
+// newEvent converts an event of a lease manager, it is nil for an event
+// consumers do not receive
+func newEvent(event leaseMgr.Event) Event {
+	switch e := event.(type) {
+	case leaseMgr.NewLeaseEvent:
+		return NewLeaseEvent{KeyID: e.KeyID, LeaseID: e.LeaseID, TTL: e.TTL}
+	case leaseMgr.StaleLeaseEvent:
+		return StaleLeaseEvent{Reason: e.Reason}
+	case leaseMgr.RevokedEvent:
+		return RevokedEvent{Reason: e.Reason}
+	case leaseMgr.ExpiringEvent:
+		return ExpiringEvent{ExpiresAt: e.ExpiresAt}
+	default:
+		return nil
+	}
+}
+
+// forwardEvents delivers the events of subscription to a consumer until ctx
+// is done or the subscription ends, the returned channel is closed then. An
+// event waits unbuffered for the consumer, the later ones keep coalescing in
+// the subscription meanwhile.
+func forwardEvents(ctx context.Context, subscription *leaseMgr.Subscription) <-chan Event {
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-subscription.Events():
+				if !ok {
+					return
+				}
+				converted := newEvent(event)
+				if converted == nil {
+					continue
+				}
+				select {
+				case events <- converted:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events
+}
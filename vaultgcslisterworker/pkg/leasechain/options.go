@@ -0,0 +1,86 @@
+package leasechain
+
+// Option configures the chain built by New
+type Option func(*Chain)
+
+// WithVault sets the Vault address and the cert auth role to log in with
+func WithVault(address, roleName string) Option {
+	return func(c *Chain) {
+		c.vaultConf.Address = address
+		c.vaultConf.RoleName = roleName
+	}
+}
+
+// WithVaultClient selects the Vault client by name, hashicorp by default or
+// toolkit when built with the toolkit tag
+func WithVaultClient(name string) Option {
+	return func(c *Chain) {
+		c.vaultConf.Client = name
+	}
+}
+
+// WithVaultRenewal renews the Vault token ahead of its expiry, by default it
+// is renewed once it expires
+func WithVaultRenewal(renewal Renewal) Option {
+	return func(c *Chain) {
+		c.vaultRenewal = renewal
+	}
+}
+
+// WithTLS sets the CA cert and the client cert used to log in to Vault, the
+// paths may contain environment variables and ~
+func WithTLS(caCertPath, certPath, keyPath string) Option {
+	return func(c *Chain) {
+		c.tlsConf.CACertPath = caCertPath
+		c.tlsConf.CertPath = certPath
+		c.tlsConf.KeyPath = keyPath
+	}
+}
+
+// WithPersistence keeps the current lease of each target in an encrypted file
+// in dir, so a restarted chain reuses its keys instead of fetching new ones.
+// The files are encrypted with passphrase, or with the TLS client key if
+// passphrase is empty. dir may contain environment variables and ~.
+func WithPersistence(dir, passphrase string) Option {
+	return func(c *Chain) {
+		c.persistDir = dir
+		c.persistPassphrase = passphrase
+	}
+}
+
+// WithCoordination elects a leader among the replicas of the deployment, only
+// the leader fetches the keys from Vault and the followers fetch them from it
+func WithCoordination(coordination Coordination) Option {
+	return func(c *Chain) {
+		c.coordination = &coordination
+	}
+}
+
+// WithSchedule staggers the renewals of the replicas of the deployment with a
+// startup jitter and a renewal window
+func WithSchedule(schedule Schedule) Option {
+	return func(c *Chain) {
+		c.schedule = schedule
+	}
+}
+
+// WithTarget adds a target whose keys are leased
+func WithTarget(target Target) Option {
+	return func(c *Chain) {
+		c.targets = append(c.targets, target)
+	}
+}
+
+// WithSink adds a sink for the bucket listings of a target
+func WithSink(targetID string, sink Sink) Option {
+	return func(c *Chain) {
+		c.sinks[targetID] = append(c.sinks[targetID], sink)
+	}
+}
+
+// WithConsumer adds a consumer of the key of a target
+func WithConsumer(targetID string, consumer Consumer) Option {
+	return func(c *Chain) {
+		c.consumers[targetID] = append(c.consumers[targetID], consumer)
+	}
+}
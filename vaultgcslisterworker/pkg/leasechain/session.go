@@ -0,0 +1,117 @@
+package leasechain
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/gcp"
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/vault"
+)
+
+// Session is a Vault login of a chain for one-shot work, it leases keys and
+// lists buckets on demand without running the daemons of the chain
+type Session struct {
+	chain         *Chain
+	vaultLeaseMgr *vault.VaultLeaseManager
+}
+
+// Key is a GCP service account key leased by a Session
+type Key struct {
+	TargetID string
+	LeaseID  string
+	TTL      time.Duration
+	Info     KeyInfo
+
+	gcpLeaseMgr *gcp.GCPLeaseManager
+}
+
+// KeyInfo is the non-secret metadata of a service account key
+type KeyInfo struct {
+	Type         string `json:"type"`
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	ClientEmail  string `json:"client_email"`
+	ClientID     string `json:"client_id"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// Login logs in to Vault like Run does, without starting the chain
+func (c *Chain) Login(ctx context.Context) (*Session, error) {
+	tlsConf, err := expandTLSConfig(c.tlsConf)
+	if err != nil {
+		return nil, err
+	}
+
+	vaultLeaseMgr, err := vault.NewVaultLeaseManager(ctx, &c.vaultConf, tlsConf)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{chain: c, vaultLeaseMgr: vaultLeaseMgr}, nil
+}
+
+// FetchKey leases a new key of the target, checked like the keys of a running
+// chain
+func (s *Session) FetchKey(ctx context.Context, targetID string) (*Key, error) {
+	target, err := s.chain.target(targetID)
+	if err != nil {
+		return nil, err
+	}
+
+	gcpLeaseMgr := newGCPLeaseManager(target, s.vaultLeaseMgr.Client())
+	if err := gcpLeaseMgr.GetNewLease(ctx); err != nil {
+		return nil, err
+	}
+
+	keyInfo := gcpLeaseMgr.GetKeyInfo()
+	return &Key{
+		TargetID: target.ID,
+		LeaseID:  gcpLeaseMgr.GetLeaseID(),
+		TTL:      time.Duration(gcpLeaseMgr.GetTTL()) * time.Second,
+		Info: KeyInfo{
+			Type:         keyInfo.Type,
+			ProjectID:    keyInfo.ProjectID,
+			PrivateKeyID: keyInfo.PrivateKeyID,
+			ClientEmail:  keyInfo.ClientEmail,
+			ClientID:     keyInfo.ClientID,
+			TokenURI:     keyInfo.TokenURI,
+		},
+		gcpLeaseMgr: gcpLeaseMgr,
+	}, nil
+}
+
+// ListBuckets lists the buckets of the project of the target of key once
+func (s *Session) ListBuckets(ctx context.Context, key *Key) ([]Bucket, error) {
+	target, err := s.chain.target(key.TargetID)
+	if err != nil {
+		return nil, err
+	}
+	if target.ProjectID == "" {
+		return nil, errors.Wrapf(ErrNoLister, "target %s", target.ID)
+	}
+
+	listCtx, listCancel := context.WithCancel(ctx)
+	defer listCancel()
+
+	buckets, err := newBucketLister(listCtx, listCancel, target, key.gcpLeaseMgr).ListBucket(listCtx)
+	if err != nil {
+		return nil, err
+	}
+	return newBuckets(buckets), nil
+}
+
+// Revoke revokes the lease of key with the token of the session, so its key
+// slot is released right away
+func (s *Session) Revoke(ctx context.Context, key *Key) error {
+	return s.vaultLeaseMgr.RevokeLease(ctx, key.LeaseID)
+}
+
+func (c *Chain) target(targetID string) (Target, error) {
+	for _, target := range c.targets {
+		if target.ID == targetID {
+			return target, nil
+		}
+	}
+	return Target{}, errors.Wrapf(ErrUnknownTarget, "target %s", targetID)
+}
@@ -0,0 +1,89 @@
+package leasechain
+
+import (
+	"time"
+
+	"github.com/mikeadityas/vault-gcs-lister/internal/pkg/gcs"
+)
+
+// Sink receives the bucket listings of a target. Write is called by the GCS
+// bucket lister, it should not block. The chain does not close its sinks.
+type Sink interface {
+	Write(listing *Listing) error
+	Close() error
+}
+
+// Listing is the result of a successful bucket listing
+type Listing struct {
+	ListerID  string    `json:"lister_id"`
+	ProjectID string    `json:"project_id"`
+	ListedAt  time.Time `json:"listed_at"`
+	Buckets   []Bucket  `json:"buckets"`
+}
+
+// Bucket is a listed GCS bucket
+type Bucket struct {
+	Name                     string            `json:"name"`
+	Location                 string            `json:"location"`
+	LocationType             string            `json:"location_type,omitempty"`
+	StorageClass             string            `json:"storage_class"`
+	Labels                   map[string]string `json:"labels,omitempty"`
+	VersioningEnabled        bool              `json:"versioning_enabled"`
+	RetentionPolicy          *RetentionPolicy  `json:"retention_policy,omitempty"`
+	UniformBucketLevelAccess bool              `json:"uniform_bucket_level_access"`
+	Created                  time.Time         `json:"created"`
+}
+
+// RetentionPolicy is the retention policy of a bucket
+type RetentionPolicy struct {
+	RetentionPeriod time.Duration `json:"retention_period"`
+	EffectiveTime   time.Time     `json:"effective_time"`
+	IsLocked        bool          `json:"is_locked"`
+}
+
+// listingSink hands the listings of a GCS bucket lister to a Sink
+type listingSink struct {
+	sink Sink
+}
+
+func (ls listingSink) Write(listing *gcs.Listing) error {
+	return ls.sink.Write(newListing(listing))
+}
+
+func (ls listingSink) Close() error {
+	return ls.sink.Close()
+}
+
+func newListing(listing *gcs.Listing) *Listing {
+	return &Listing{
+		ListerID:  listing.ListerID,
+		ProjectID: listing.ProjectID,
+		ListedAt:  listing.ListedAt,
+		Buckets:   newBuckets(listing.Buckets),
+	}
+}
+
+func newBuckets(buckets []gcs.Bucket) []Bucket {
+	converted := make([]Bucket, 0, len(buckets))
+	for _, bucket := range buckets {
+		convertedBucket := Bucket{
+			Name:                     bucket.Name,
+			Location:                 bucket.Location,
+			LocationType:             bucket.LocationType,
+			StorageClass:             bucket.StorageClass,
+			Labels:                   bucket.Labels,
+			VersioningEnabled:        bucket.VersioningEnabled,
+			UniformBucketLevelAccess: bucket.UniformBucketLevelAccess,
+			Created:                  bucket.Created,
+		}
+		if bucket.RetentionPolicy != nil {
+			convertedBucket.RetentionPolicy = &RetentionPolicy{
+				RetentionPeriod: bucket.RetentionPolicy.RetentionPeriod,
+				EffectiveTime:   bucket.RetentionPolicy.EffectiveTime,
+				IsLocked:        bucket.RetentionPolicy.IsLocked,
+			}
+		}
+		converted = append(converted, convertedBucket)
+	}
+	return converted
+}
@@ -0,0 +1,92 @@
+package leasechain
+
+import (
+	"context"
+	"time"
+
+	"github.com/mikeadityas/vault-gcs-lister/pkg/credentials"
+)
+
+// Consumer follows the key of a target, e.g. to hand it to other processes
+type Consumer interface {
+	GetID() string
+	// Consume runs in its own goroutine until ctx is done. keys always returns
+	// the current key of the target, events delivers its lifecycle events.
+	Consume(ctx context.Context, keys credentials.KeySource, events <-chan Event)
+}
+
+// Target is a GCP secrets path whose keys are leased with the Vault token
+type Target struct {
+	ID          string
+	SecretsPath string
+	// EarlyRenewal renews the key before its lease expires, or
+	// EarlyRenewalPercent percent of its TTL before if set
+	EarlyRenewal        time.Duration
+	EarlyRenewalPercent float64
+	// MinRemaining is the lifetime the key must have left to be handed to the
+	// consumers, it is renewed before it drops below
+	MinRemaining time.Duration
+
+	// ExpectedClientEmail and ExpectedProjectID reject keys of another
+	// service account, empty values are not checked
+	ExpectedClientEmail string
+	ExpectedProjectID   string
+
+	// ProjectID is the project whose buckets are listed every Interval with
+	// the key, empty disables the GCS bucket lister
+	ProjectID string
+	Interval  time.Duration
+	Prefix    string
+	PageSize  int
+}
+
+// Coordination elects one replica of a deployment to fetch the keys from
+// Vault, the other replicas fetch them from the leader so the deployment uses
+// a single key per target
+type Coordination struct {
+	// Mode is kubernetes, electing with a Lease object of the Kubernetes API,
+	// or file, electing with a lock file shared by replicas on one host
+	Mode string
+	// Identity names this replica, the hostname by default
+	Identity string
+	// LeaseName and LeaseNamespace name the Lease object of the kubernetes
+	// mode, the namespace of the pod by default
+	LeaseName      string
+	LeaseNamespace string
+	// LockPath is the lock file of the file mode
+	LockPath string
+	// LeaseDuration is how long the leadership outlives the last renewal of
+	// the leader, RetryPeriod how often the replicas campaign, it must be
+	// shorter. Zero values default to 15s and 2s.
+	LeaseDuration time.Duration
+	RetryPeriod   time.Duration
+	// Address serves the keys to the followers over mTLS with the TLS client
+	// cert, AdvertiseAddress is the URL they reach it at, e.g.
+	// https://10.0.0.12:8443
+	Address          string
+	AdvertiseAddress string
+}
+
+// Renewal is when the Vault token is renewed, see WithVaultRenewal
+type Renewal struct {
+	// EarlyRenewal renews the token before it expires, or EarlyRenewalPercent
+	// percent of its TTL before if set
+	EarlyRenewal        time.Duration
+	EarlyRenewalPercent float64
+	// MinRemaining is the lifetime the token must have left, it is renewed
+	// before it drops below
+	MinRemaining time.Duration
+}
+
+// Schedule staggers the Vault and GCP renewals of replicas started together,
+// so they do not hit Vault in lockstep
+type Schedule struct {
+	// StartupJitter delays the Vault login and the first key fetches by a
+	// random duration up to it
+	StartupJitter time.Duration
+	// RenewalWindowFrom and RenewalWindowTo renew every lease at a random
+	// point between these fractions of its TTL, e.g. 0.66 and 0.8, instead of
+	// EarlyRenewal before it expires. Zero values disable the window.
+	RenewalWindowFrom float64
+	RenewalWindowTo   float64
+}